@@ -0,0 +1,28 @@
+package cmd
+
+import (
+	"context"
+	"log"
+)
+
+func runCleanup(ctx context.Context, args []string) int {
+	fs := newFlagSet("cleanup", "Remove the migration namespace and cluster role binding left behind by an interrupted run.")
+	if code, ok := parse(fs, args); !ok {
+		return code
+	}
+
+	cw, err := getClientWrapper()
+	if err != nil {
+		log.Println(err.Error())
+		return 1
+	}
+
+	err = cw.CleanupMigrationObjects(ctx)
+	if err != nil {
+		log.Println(err.Error())
+		return 1
+	}
+
+	log.Println("Migration objects removed")
+	return 0
+}
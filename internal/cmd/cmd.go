@@ -0,0 +1,270 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/AnthonyEnr1quez/local-path-provisioner-volume-converter/internal/kube"
+	"github.com/samber/lo"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const binaryName = "local-path-provisioner-volume-converter"
+
+type command struct {
+	name        string
+	description string
+	run         func(ctx context.Context, args []string) int
+}
+
+var commands = []command{
+	{name: "list", description: "List every host path volume of a supported resource", run: runList},
+	{name: "convert", description: "Convert a host path volume to a local volume", run: runConvert},
+	{name: "plan", description: "Print the steps a conversion would take", run: runPlan},
+	{name: "cleanup", description: "Remove leftover migration namespace and cluster role binding", run: runCleanup},
+	{name: "status", description: "Show the migration objects present in the cluster", run: runStatus},
+}
+
+// Run executes the subcommand named by the first argument and returns the process exit code.
+// Without a subcommand the interactive conversion is started.
+func Run(args []string) int {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		// a second Ctrl+C kills the process, even during rollback or cleanup
+		stop()
+	}()
+
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") && args[0] != "-h" && args[0] != "--help" {
+		return runConvert(ctx, args)
+	}
+
+	for _, c := range commands {
+		if c.name == args[0] {
+			return c.run(ctx, args[1:])
+		}
+	}
+
+	usage()
+	if args[0] == "-h" || args[0] == "--help" || args[0] == "help" {
+		return 0
+	}
+	return 2
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s <command> [flags]\n\nCommands:\n", binaryName)
+	for _, c := range commands {
+		fmt.Fprintf(out, "  %-10s%s\n", c.name, c.description)
+	}
+	fmt.Fprintf(out, "\nRun \"%s <command> --help\" for the flags of a command.\n", binaryName)
+}
+
+func newFlagSet(name, description string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s [flags]\n\n%s\n\nFlags:\n", binaryName, name, description)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parse parses the flags of a subcommand, returning the exit code to use if parsing stopped the command.
+func parse(fs *flag.FlagSet, args []string) (int, bool) {
+	err := fs.Parse(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return 0, false
+	}
+	if err != nil {
+		return 2, false
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(fs.Output(), "unexpected arguments: %s\n", strings.Join(fs.Args(), " "))
+		fs.Usage()
+		return 2, false
+	}
+	return 0, true
+}
+
+func getClientWrapper() (kube.ClientWrapper, error) {
+	config, err := kube.GetKubeconfig()
+	if err != nil {
+		return kube.ClientWrapper{}, err
+	}
+
+	return kube.GetClientWrapper(config), nil
+}
+
+func addSelectorFlag(fs *flag.FlagSet) *string {
+	return fs.String("selector", "", "label selector for the Deployments, StatefulSets and PVCs of a resource, {resource} is replaced by the resource name (default the objects Helm installed with the release)")
+}
+
+// getResourceClientWrapper returns a client finding the objects of a resource with selector, if set.
+func getResourceClientWrapper(selector string) (kube.ClientWrapper, int, error) {
+	cw, err := getClientWrapper()
+	if err != nil {
+		return cw, 1, err
+	}
+
+	err = cw.SetSelector(selector)
+	if err != nil {
+		return cw, 2, err
+	}
+
+	return cw, 0, nil
+}
+
+// engineFlags select how the data is moved between PVCs, verified and backed up.
+type engineFlags struct {
+	engine          string
+	rsyncImage      string
+	strategy        string
+	verify          bool
+	verifyImage     string
+	velero          bool
+	veleroNamespace string
+	snapshot        bool
+	storageClass    string
+}
+
+func addEngineFlags(fs *flag.FlagSet) *engineFlags {
+	ef := &engineFlags{}
+	fs.StringVar(&ef.engine, "engine", kube.PVMigrateEngine, "migration engine, pv-migrate or rsync; rsync copies with a single pod mounting both PVCs and needs no cluster wide rights")
+	fs.StringVar(&ef.rsyncImage, "rsync-image", kube.DefaultRsyncImage, "image providing rsync for the rsync engine")
+	fs.BoolVar(&ef.verify, "verify", false, "compare file counts, sizes and SHA-256 hashes of both PVCs after every migration job, failing the conversion if they differ")
+	fs.StringVar(&ef.verifyImage, "verify-image", kube.DefaultVerifyImage, "image providing the shell tools for --verify")
+	fs.BoolVar(&ef.velero, "velero", false, "back up the namespaces of the resource with Velero before converting and add the converted volume to the backup.velero.io/backup-volumes pod annotation")
+	fs.StringVar(&ef.veleroNamespace, "velero-namespace", kube.DefaultVeleroNamespace, "namespace Velero runs in")
+	fs.BoolVar(&ef.snapshot, "snapshot", false, "take a VolumeSnapshot of the original PVC before deleting it and restore from it on rollback, if the cluster and the CSI driver of the volume support snapshots. Has no effect on host path and local volumes, so it only applies to CSI volumes moved with --storage-class")
+	fs.StringVar(&ef.strategy, "strategy", kube.CopyStrategy, "copy moves the data to a new local volume twice, rebind points a local volume at the existing directory without copying")
+	fs.StringVar(&ef.storageClass, "storage-class", "", "migrate the volume to this storage class by setting storageClass in the persistence values, instead of converting it to a local volume")
+	return ef
+}
+
+// options returns the conversion options set by the flags.
+func (ef *engineFlags) options(migrator kube.Migrator) kube.ConvertOptions {
+	return kube.ConvertOptions{
+		Migrator:        migrator,
+		Strategy:        ef.strategy,
+		Verify:          ef.verify,
+		VerifyImage:     ef.verifyImage,
+		Velero:          ef.velero,
+		VeleroNamespace: ef.veleroNamespace,
+		Snapshot:        ef.snapshot,
+		StorageClass:    ef.storageClass,
+	}
+}
+
+// args returns the flags to pass them on to another command.
+func (ef *engineFlags) args() []string {
+	return []string{
+		"--engine", ef.engine,
+		"--rsync-image", ef.rsyncImage,
+		"--strategy", ef.strategy,
+		fmt.Sprintf("--verify=%t", ef.verify),
+		"--verify-image", ef.verifyImage,
+		fmt.Sprintf("--velero=%t", ef.velero),
+		"--velero-namespace", ef.veleroNamespace,
+		fmt.Sprintf("--snapshot=%t", ef.snapshot),
+		"--storage-class", ef.storageClass,
+	}
+}
+
+// migrator validates the flags and returns the migrator they select.
+func (ef *engineFlags) migrator() (kube.Migrator, error) {
+	if ef.strategy != kube.CopyStrategy && ef.strategy != kube.RebindStrategy {
+		return nil, errors.New(fmt.Sprintf("unsupported strategy %s", ef.strategy))
+	}
+	if ef.storageClass != "" && ef.strategy == kube.RebindStrategy {
+		return nil, errors.New("--storage-class requires the copy strategy")
+	}
+	return kube.NewMigrator(ef.engine, ef.rsyncImage)
+}
+
+// volumeFlags select a single volume of a resource without going through the survey.
+type volumeFlags struct {
+	resourceNamespace string
+	resourceName      string
+	kind              string
+	pvc               string
+	raw               bool
+	pvcNamespace      string
+}
+
+func addVolumeFlags(fs *flag.FlagSet) *volumeFlags {
+	vf := &volumeFlags{}
+	fs.StringVar(&vf.resourceNamespace, "resource-namespace", "", "namespace of the HelmRelease or HelmChart owning the volume")
+	fs.StringVar(&vf.resourceName, "resource", "", "name of the HelmRelease or HelmChart owning the volume")
+	fs.StringVar(&vf.kind, "kind", "", "kind of the resource, HelmRelease or HelmChart")
+	fs.StringVar(&vf.pvc, "pvc", "", "name of the host path PVC, or a comma-separated list of PVCs of the resource to convert with a single scale-down per migration")
+	fs.BoolVar(&vf.raw, "raw", false, "convert a PVC not declared by a HelmRelease or HelmChart, selected with --pvc-namespace and --pvc")
+	fs.StringVar(&vf.pvcNamespace, "pvc-namespace", "", "namespace of the PVC, with --raw")
+	return vf
+}
+
+// isSet reports whether any volume flag was passed, meaning the survey is skipped.
+func (vf *volumeFlags) isSet() bool {
+	return vf.resourceNamespace != "" || vf.resourceName != "" || vf.kind != "" || vf.pvc != "" || vf.raw || vf.pvcNamespace != ""
+}
+
+func (vf *volumeFlags) validate() error {
+	if vf.raw {
+		if vf.resourceNamespace != "" || vf.resourceName != "" || vf.kind != "" {
+			return errors.New("--raw can not be combined with --resource-namespace, --resource or --kind")
+		}
+		if vf.pvcNamespace == "" || vf.pvc == "" {
+			return errors.New("--pvc-namespace and --pvc are required with --raw")
+		}
+		if len(vf.pvcs()) > 1 {
+			return errors.New("--raw converts a single --pvc")
+		}
+		return nil
+	}
+	if vf.pvcNamespace != "" {
+		return errors.New("--pvc-namespace requires --raw")
+	}
+	if vf.resourceNamespace == "" || vf.resourceName == "" || vf.kind == "" || vf.pvc == "" {
+		return errors.New("--resource-namespace, --resource, --kind and --pvc are all required")
+	}
+	return nil
+}
+
+// validateAll validates the flags limiting convert --all to the volumes of a namespace or a single resource.
+func (vf *volumeFlags) validateAll() error {
+	if vf.raw || vf.pvc != "" || vf.pvcNamespace != "" {
+		return errors.New("--all can not be combined with --raw, --pvc or --pvc-namespace")
+	}
+	if (vf.resourceName != "" || vf.kind != "") && (vf.resourceNamespace == "" || vf.resourceName == "" || vf.kind == "") {
+		return errors.New("--resource-namespace, --resource and --kind are all required to convert every volume of a resource")
+	}
+	return nil
+}
+
+// pvcs returns the PVCs listed by --pvc.
+func (vf *volumeFlags) pvcs() []string {
+	return lo.Compact(lo.Map(strings.Split(vf.pvc, ","), func(pvc string, _ int) string {
+		return strings.TrimSpace(pvc)
+	}))
+}
+
+func (vf *volumeFlags) resolve(ctx context.Context, cw kube.ClientWrapper, opts kube.ConvertOptions) (*corev1.PersistentVolume, kube.Patcher, error) {
+	patcher, err := kube.NewPatcher(vf.kind)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	volume, err := getVolume(ctx, cw, vf, vf.pvc, patcher, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return volume, patcher, nil
+}
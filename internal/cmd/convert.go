@@ -0,0 +1,368 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/AlecAivazis/survey/v2/terminal"
+	"github.com/AnthonyEnr1quez/local-path-provisioner-volume-converter/internal/kube"
+	"github.com/AnthonyEnr1quez/local-path-provisioner-volume-converter/internal/prompt"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func runConvert(ctx context.Context, args []string) int {
+	fs := newFlagSet("convert", "Convert a host path volume to a local volume. Without flags an interactive survey selects the volume.")
+	vf := addVolumeFlags(fs)
+	dryRun := fs.Bool("dry-run", false, "print the conversion plan instead of converting")
+	rollback := fs.Bool("rollback", false, "roll back to the original host path volume if a step fails, instead of leaving a checkpoint to resume from")
+	bindTimeout := fs.Duration("bind-timeout", kube.DefaultBindTimeout, "how long to wait for a PVC to bind, 0 waits forever")
+	jobTimeout := fs.Duration("job-timeout", 0, "how long to wait for a migration job to finish, 0 waits forever")
+	rolloutTimeout := fs.Duration("rollout-timeout", kube.DefaultRolloutTimeout, "how long to wait for a workload to scale or roll out, 0 waits forever")
+	jobRetries := fs.Int("job-retries", 0, "how many times to start a failed migration job again before the step fails")
+	jobLogFile := fs.String("job-log-file", "", "append the logs of the migration jobs to this file")
+	purge := fs.Bool("purge-old-volumes", false, "remove the host path PVs finished conversions retained, together with their directories, and the snapshots they took, instead of converting")
+	all := fs.Bool("all", false, "convert every host path volume of the cluster, of the resources in --resource-namespace, or of the resource selected with --resource-namespace, --resource and --kind")
+	concurrency := fs.Int("concurrency", 1, "how many volumes of different resources --all converts at the same time")
+	revert := fs.Bool("revert", false, "convert the local volumes selected with --pvc back to host path volumes, with the copy strategy")
+	skipPreflight := fs.Bool("skip-preflight", false, "start the conversion without checking the reclaim policy, provisioner version, free space, resource state, storage class and permissions first")
+	ef := addEngineFlags(fs)
+	output := addOutputFlag(fs)
+	selector := addSelectorFlag(fs)
+	if code, ok := parse(fs, args); !ok {
+		return code
+	}
+
+	if *revert {
+		err := errors.New("--revert can not be combined with --raw, --all, --purge-old-volumes, --dry-run or --storage-class")
+		if !vf.raw && !*all && !*purge && !*dryRun && ef.storageClass == "" {
+			err = vf.validate()
+		}
+		if err != nil {
+			log.Println(err.Error())
+			fs.Usage()
+			return 2
+		}
+	}
+
+	if *purge {
+		if vf.isSet() {
+			log.Println("--purge-old-volumes can not be combined with a volume")
+			return 2
+		}
+		return purgeOldVolumes(ctx, *dryRun)
+	}
+
+	if *all {
+		err := vf.validateAll()
+		if err == nil && *dryRun {
+			err = errors.New("--dry-run is not supported with --all, use plan for each volume")
+		}
+		if err == nil && *concurrency < 1 {
+			err = errors.New("--concurrency must be at least 1")
+		}
+		if err != nil {
+			log.Println(err.Error())
+			fs.Usage()
+			return 2
+		}
+	} else if vf.isSet() {
+		err := vf.validate()
+		if err != nil {
+			log.Println(err.Error())
+			fs.Usage()
+			return 2
+		}
+	}
+
+	migrator, err := ef.migrator()
+	if err != nil {
+		log.Println(err.Error())
+		fs.Usage()
+		return 2
+	}
+
+	opts := ef.options(migrator)
+	opts.Rollback, opts.SkipPreflight, opts.Revert = *rollback, *skipPreflight, *revert
+	opts.BindTimeout, opts.JobTimeout, opts.JobRetries = *bindTimeout, *jobTimeout, *jobRetries
+	if *jobLogFile != "" && !*dryRun {
+		f, err := os.OpenFile(*jobLogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			log.Println(err.Error())
+			return 1
+		}
+		defer f.Close()
+		opts.JobLog = f
+	}
+
+	cw, code, err := getResourceClientWrapper(*selector)
+	if err != nil {
+		log.Println(err.Error())
+		return code
+	}
+	cw.SetRolloutTimeout(*rolloutTimeout)
+
+	if *all {
+		return convertAll(ctx, cw, vf, opts, *concurrency)
+	}
+
+	if !vf.isSet() {
+		if *dryRun {
+			return runPlan(ctx, append([]string{"--output", *output, "--selector", *selector}, ef.args()...))
+		}
+		return convertInteractive(ctx, cw, opts)
+	}
+
+	if vf.raw {
+		if *dryRun {
+			log.Println("--dry-run is not supported with --raw")
+			return 2
+		}
+		return withMigrationObjects(ctx, cw, opts.Migrator, func() error {
+			return kube.ResumeRawConversion(ctx, cw, vf.pvcNamespace, vf.pvc, opts)
+		})
+	}
+
+	patcher, err := kube.NewPatcher(vf.kind)
+	if err != nil {
+		log.Println(err.Error())
+		return 2
+	}
+
+	if pvcs := vf.pvcs(); len(pvcs) > 1 {
+		if *dryRun {
+			log.Println("--dry-run supports a single --pvc, run plan for each")
+			return 2
+		}
+		return withMigrationObjects(ctx, cw, opts.Migrator, func() error {
+			return convertPVCs(ctx, cw, vf, pvcs, patcher, opts)
+		})
+	}
+
+	_, pending, err := cw.GetPVCCheckpoint(ctx, patcher, vf.resourceNamespace, vf.resourceName, vf.pvc)
+	if err != nil {
+		log.Println(err.Error())
+		return 1
+	}
+	if pending && !*dryRun {
+		return withMigrationObjects(ctx, cw, opts.Migrator, func() error {
+			return kube.ResumeConversion(ctx, cw, vf.resourceNamespace, vf.resourceName, vf.pvc, patcher, opts)
+		})
+	}
+
+	volume, err := getVolume(ctx, cw, vf, vf.pvc, patcher, opts)
+	if err != nil {
+		log.Println(err.Error())
+		return 1
+	}
+
+	if *dryRun {
+		return printPlan(ctx, cw, vf.resourceNamespace, vf.resourceName, volume, patcher, opts, *output)
+	}
+
+	return withMigrationObjects(ctx, cw, opts.Migrator, func() error {
+		return kube.ConvertVolume(ctx, cw, vf.resourceNamespace, vf.resourceName, volume, patcher, opts)
+	})
+}
+
+// convertPVCs resumes the pending conversions of pvcs one by one and converts the others together.
+func convertPVCs(ctx context.Context, cw kube.ClientWrapper, vf *volumeFlags, pvcs []string, patcher kube.Patcher, opts kube.ConvertOptions) error {
+	var volumes []*corev1.PersistentVolume
+	for _, pvc := range pvcs {
+		_, pending, err := cw.GetPVCCheckpoint(ctx, patcher, vf.resourceNamespace, vf.resourceName, pvc)
+		if err != nil {
+			return err
+		}
+		if pending {
+			err = kube.ResumeConversion(ctx, cw, vf.resourceNamespace, vf.resourceName, pvc, patcher, opts)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		volume, err := getVolume(ctx, cw, vf, pvc, patcher, opts)
+		if err != nil {
+			return err
+		}
+		volumes = append(volumes, volume)
+	}
+	if len(volumes) == 0 {
+		return nil
+	}
+
+	return kube.ConvertVolumes(ctx, cw, vf.resourceNamespace, vf.resourceName, volumes, patcher, opts)
+}
+
+// getVolume resolves pvc of the resource selected by vf to the host path volume to convert, to the local volume to
+// revert, or to the volume of any type to migrate to another storage class.
+func getVolume(ctx context.Context, cw kube.ClientWrapper, vf *volumeFlags, pvc string, patcher kube.Patcher, opts kube.ConvertOptions) (*corev1.PersistentVolume, error) {
+	if opts.StorageClass != "" {
+		return cw.GetStorageClassVolume(ctx, patcher, vf.resourceNamespace, vf.resourceName, pvc, opts.StorageClass)
+	}
+	if opts.Revert {
+		return cw.GetLocalVolume(ctx, patcher, vf.resourceNamespace, vf.resourceName, pvc)
+	}
+	return cw.GetHostPathVolume(ctx, patcher, vf.resourceNamespace, vf.resourceName, pvc)
+}
+
+// convertAll converts every host path volume selected by vf and prints the result of each.
+func convertAll(ctx context.Context, cw kube.ClientWrapper, vf *volumeFlags, opts kube.ConvertOptions, concurrency int) int {
+	resources, err := cw.GetAllHostPathVolumes(ctx)
+	if err != nil {
+		log.Println(err.Error())
+		return 1
+	}
+	resources = kube.FilterResources(resources, vf.resourceNamespace, vf.resourceName, vf.kind)
+	if len(resources) == 0 {
+		log.Println("No host path volumes found")
+		return 0
+	}
+
+	var results []kube.BatchResult
+	code := withMigrationObjects(ctx, cw, opts.Migrator, func() error {
+		results = kube.ConvertAll(ctx, cw, resources, opts, concurrency)
+		return nil
+	})
+	if code != 0 {
+		return code
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "RESOURCE NAMESPACE\tKIND\tRESOURCE\tPVC NAMESPACE\tPVC\tRESULT\tDETAIL")
+	counts := map[string]int{}
+	for _, r := range results {
+		counts[r.Result]++
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			r.ResourceNamespace, r.Kind, r.ResourceName, r.PVCNamespace, r.PVC, r.Result, r.Detail,
+		)
+	}
+	err = w.Flush()
+	if err != nil {
+		log.Println(err.Error())
+		return 1
+	}
+	fmt.Printf("\n%d converted, %d skipped, %d failed\n", counts[kube.BatchConverted], counts[kube.BatchSkipped], counts[kube.BatchFailed])
+
+	if counts[kube.BatchConverted] < len(results) {
+		return 1
+	}
+	return 0
+}
+
+func purgeOldVolumes(ctx context.Context, dryRun bool) int {
+	cw, err := getClientWrapper()
+	if err != nil {
+		log.Println(err.Error())
+		return 1
+	}
+
+	if dryRun {
+		pvs, err := cw.GetRetainedVolumes(ctx)
+		if err != nil {
+			log.Println(err.Error())
+			return 1
+		}
+		for _, pv := range pvs {
+			fmt.Printf("PV %s (was %s/%s)\n", pv.Name, pv.Spec.ClaimRef.Namespace, pv.Spec.ClaimRef.Name)
+		}
+		snapshots, err := cw.GetVolumeSnapshots(ctx)
+		if err != nil {
+			log.Println(err.Error())
+			return 1
+		}
+		for _, snapshot := range snapshots {
+			fmt.Printf("VolumeSnapshot %s/%s\n", snapshot.GetNamespace(), snapshot.GetName())
+		}
+		return 0
+	}
+
+	err = cw.PurgeRetainedVolumes(ctx)
+	if err != nil {
+		log.Println(err.Error())
+		return 1
+	}
+	err = cw.DeleteVolumeSnapshots(ctx)
+	if err != nil {
+		log.Println(err.Error())
+		return 1
+	}
+	return 0
+}
+
+// withMigrationObjects runs convert between creating and removing the migration objects and returns the exit code.
+func withMigrationObjects(ctx context.Context, cw kube.ClientWrapper, migrator kube.Migrator, convert func() error) int {
+	err := createMigrationObjects(ctx, cw, migrator)
+	if err != nil {
+		log.Println(err.Error())
+		return 1
+	}
+	// cleanup runs after Ctrl+C cancelled ctx too
+	defer cw.CleanupMigrationObjects(context.Background())
+
+	err = convert()
+	if err != nil {
+		log.Println(err.Error())
+		return 1
+	}
+
+	return 0
+}
+
+// createMigrationObjects creates the migration namespace and service account if the jobs of migrator need them.
+func createMigrationObjects(ctx context.Context, cw kube.ClientWrapper, migrator kube.Migrator) error {
+	if !migrator.NeedsMigrationObjects() {
+		return nil
+	}
+	return cw.CreateMigrationNamespaceAndServiceAccount(ctx)
+}
+
+func convertInteractive(ctx context.Context, cw kube.ClientWrapper, opts kube.ConvertOptions) int {
+	log.Print("Use \"Ctrl+C\" to quit\n\n")
+
+	pending, err := cw.GetPendingConversions(ctx)
+	if err != nil {
+		log.Println(err.Error())
+		return 1
+	}
+	for _, p := range pending {
+		log.Printf("Conversion of PVC %s/%s stopped after step %s, resume it with:\n  %s\n", p.Checkpoint.PVCNamespace, p.Checkpoint.PVC, p.Checkpoint.Step, resumeCommand(p))
+	}
+
+	err = createMigrationObjects(ctx, cw, opts.Migrator)
+	if err != nil {
+		log.Println(err.Error())
+		return 1
+	}
+	// cleanup runs after Ctrl+C cancelled ctx too
+	defer cw.CleanupMigrationObjects(context.Background())
+
+	for {
+		selected, err := prompt.SurveyMany(ctx, cw, opts)
+		if err != nil {
+			log.Println(err.Error())
+			if err == terminal.InterruptErr {
+				return 0
+			}
+			continue
+		}
+
+		for _, r := range selected {
+			err = kube.ConvertVolumes(ctx, cw, r.Namespace, r.Name, r.Volumes, r.Patcher, opts)
+			if err != nil {
+				log.Println(err.Error())
+				return 1
+			}
+		}
+	}
+}
+
+func resumeCommand(p kube.PendingConversion) string {
+	if p.Kind == "" {
+		return fmt.Sprintf("%s convert --raw --pvc-namespace %s --pvc %s", binaryName, p.Checkpoint.PVCNamespace, p.Checkpoint.PVC)
+	}
+	return fmt.Sprintf("%s convert --resource-namespace %s --resource %s --kind %s --pvc %s", binaryName, p.ResourceNamespace, p.ResourceName, p.Kind, p.Checkpoint.PVC)
+}
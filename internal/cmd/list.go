@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/AnthonyEnr1quez/local-path-provisioner-volume-converter/internal/kube"
+)
+
+func runList(ctx context.Context, args []string) int {
+	fs := newFlagSet("list", "List every host path volume reachable through a HelmRelease or HelmChart.")
+	namespace := fs.String("resource-namespace", "", "only list volumes of resources, or with --raw of PVCs, in this namespace")
+	raw := fs.Bool("raw", false, "list host path volumes of PVCs not declared by a HelmRelease or HelmChart instead")
+	selector := addSelectorFlag(fs)
+	if code, ok := parse(fs, args); !ok {
+		return code
+	}
+
+	cw, code, err := getResourceClientWrapper(*selector)
+	if err != nil {
+		log.Println(err.Error())
+		return code
+	}
+
+	if *raw {
+		return listRaw(ctx, cw, *namespace)
+	}
+
+	resources, err := cw.GetAllHostPathVolumes(ctx)
+	if err != nil {
+		log.Println(err.Error())
+		return 1
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "RESOURCE NAMESPACE\tKIND\tRESOURCE\tPVC NAMESPACE\tPVC\tPV\tCAPACITY\tPATH")
+	for _, r := range resources {
+		if *namespace != "" && r.Namespace != *namespace {
+			continue
+		}
+		for _, v := range r.Volumes {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				r.Namespace, r.Kind, r.Name,
+				v.Spec.ClaimRef.Namespace, v.Spec.ClaimRef.Name, v.Name,
+				v.Spec.Capacity.Storage().String(), v.Spec.HostPath.Path,
+			)
+		}
+	}
+
+	err = w.Flush()
+	if err != nil {
+		log.Println(err.Error())
+		return 1
+	}
+
+	return 0
+}
+
+func listRaw(ctx context.Context, cw kube.ClientWrapper, namespace string) int {
+	volumes, err := cw.GetRawHostPathVolumes(ctx)
+	if err != nil {
+		log.Println(err.Error())
+		return 1
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PVC NAMESPACE\tPVC\tPV\tCAPACITY\tPATH")
+	for _, v := range volumes {
+		if namespace != "" && v.Spec.ClaimRef.Namespace != namespace {
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+			v.Spec.ClaimRef.Namespace, v.Spec.ClaimRef.Name, v.Name,
+			v.Spec.Capacity.Storage().String(), v.Spec.HostPath.Path,
+		)
+	}
+
+	err = w.Flush()
+	if err != nil {
+		log.Println(err.Error())
+		return 1
+	}
+
+	return 0
+}
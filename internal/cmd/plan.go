@@ -0,0 +1,150 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/AnthonyEnr1quez/local-path-provisioner-volume-converter/internal/kube"
+	"github.com/AnthonyEnr1quez/local-path-provisioner-volume-converter/internal/prompt"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+func runPlan(ctx context.Context, args []string) int {
+	fs := newFlagSet("plan", "Print the patches, jobs and deletions converting a volume would make without changing anything. Without flags an interactive survey selects the volume.")
+	vf := addVolumeFlags(fs)
+	ef := addEngineFlags(fs)
+	output := addOutputFlag(fs)
+	selector := addSelectorFlag(fs)
+	if code, ok := parse(fs, args); !ok {
+		return code
+	}
+
+	if vf.raw {
+		log.Println("plan does not support --raw")
+		return 2
+	}
+	if vf.isSet() {
+		err := vf.validate()
+		if err == nil && len(vf.pvcs()) > 1 {
+			err = errors.New("plan supports a single --pvc")
+		}
+		if err != nil {
+			log.Println(err.Error())
+			fs.Usage()
+			return 2
+		}
+	}
+
+	migrator, err := ef.migrator()
+	if err != nil {
+		log.Println(err.Error())
+		fs.Usage()
+		return 2
+	}
+
+	cw, code, err := getResourceClientWrapper(*selector)
+	if err != nil {
+		log.Println(err.Error())
+		return code
+	}
+
+	opts := ef.options(migrator)
+	resourceNamespace, resourceName := vf.resourceNamespace, vf.resourceName
+	var volume *corev1.PersistentVolume
+	var patcher kube.Patcher
+	if vf.isSet() {
+		volume, patcher, err = vf.resolve(ctx, cw, opts)
+	} else {
+		var resource kube.ResourceVolumes
+		resource, volume, err = prompt.SurveyOne(ctx, cw)
+		resourceNamespace, resourceName, patcher = resource.Namespace, resource.Name, resource.Patcher
+	}
+	if err != nil {
+		log.Println(err.Error())
+		return 1
+	}
+
+	return printPlan(ctx, cw, resourceNamespace, resourceName, volume, patcher, opts, *output)
+}
+
+func addOutputFlag(fs *flag.FlagSet) *string {
+	return fs.String("output", "text", "format of the plan, text or yaml")
+}
+
+func printPlan(ctx context.Context, cw kube.ClientWrapper, resourceNamespace, resourceName string, volume *corev1.PersistentVolume, patcher kube.Patcher, opts kube.ConvertOptions, output string) int {
+	plan, err := cw.PlanConversion(ctx, resourceNamespace, resourceName, volume, patcher, opts)
+	if err != nil {
+		log.Println(err.Error())
+		return 1
+	}
+
+	switch output {
+	case "text":
+		printPlanText(plan)
+	case "yaml":
+		out, err := yaml.Marshal(plan)
+		if err != nil {
+			log.Println(err.Error())
+			return 1
+		}
+		os.Stdout.Write(out)
+	default:
+		log.Println(errors.New(fmt.Sprintf("unsupported output format %s", output)))
+		return 2
+	}
+
+	return 0
+}
+
+func printPlanText(plan kube.Plan) {
+	fmt.Printf("Converting PVC %s/%s (PV %s, host path %s) of %s %s mounted by %s\n\n", plan.PVCNamespace, plan.PVC, plan.PV, plan.HostPath, plan.Kind, plan.Resource, plan.Workload)
+
+	if plan.StorageClass != "" {
+		fmt.Printf("Migrating to storage class %s instead of a local volume\n\n", plan.StorageClass)
+	}
+
+	if plan.VeleroBackup != "" {
+		fmt.Printf("%s\n\n", plan.VeleroBackup)
+	}
+
+	fmt.Println("Pre-flight checks:")
+	for _, result := range plan.Preflight {
+		switch {
+		case result.Problem == "":
+			fmt.Printf("  ok      %s\n", result.Check)
+		case result.Warning:
+			fmt.Printf("  warning %s: %s\n", result.Check, result.Problem)
+		default:
+			fmt.Printf("  failed  %s: %s\n", result.Check, result.Problem)
+		}
+	}
+	fmt.Println()
+
+	for i, step := range plan.Steps {
+		fmt.Printf("%2d. %s (%s)\n", i+1, step.Description, step.Name)
+		if step.OrphanDelete != "" {
+			fmt.Printf("    delete %s orphaning its pods, the release recreates it\n", step.OrphanDelete)
+		}
+		if step.Patch != nil {
+			fmt.Printf("    patch (%s): %s\n", step.Patch.Type, step.Patch.Payload)
+		}
+		if step.CreatePV != nil {
+			fmt.Printf("    create PV %s: local path %s\n", step.CreatePV.Name, step.CreatePV.Spec.Local.Path)
+		}
+		if step.Job != nil {
+			container := step.Job.Spec.Template.Spec.Containers[0]
+			fmt.Printf("    job in namespace %s: %s %v\n", step.Job.Namespace, container.Image, append(container.Command, container.Args...))
+		}
+		if step.VerifyJob != nil {
+			fmt.Printf("    verify with job in namespace %s: %s comparing file counts, sizes and SHA-256 hashes\n", step.VerifyJob.Namespace, step.VerifyJob.Spec.Template.Spec.Containers[0].Image)
+		}
+		if step.ServerDryRun != "" {
+			fmt.Printf("    server dry run: %s\n", step.ServerDryRun)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	batchv1 "k8s.io/api/batch/v1"
+)
+
+func runStatus(ctx context.Context, args []string) int {
+	fs := newFlagSet("status", "Show the migration namespace, cluster role binding and migration jobs present in the cluster.")
+	if code, ok := parse(fs, args); !ok {
+		return code
+	}
+
+	cw, err := getClientWrapper()
+	if err != nil {
+		log.Println(err.Error())
+		return 1
+	}
+
+	status, err := cw.GetMigrationStatus(ctx)
+	if err != nil {
+		log.Println(err.Error())
+		return 1
+	}
+
+	fmt.Printf("Namespace %s: %s\n", status.Namespace, presence(status.NamespaceExists))
+	fmt.Printf("ClusterRoleBinding %s: %s\n", status.ClusterRoleBinding, presence(status.CRBExists))
+	for _, job := range status.Jobs {
+		fmt.Printf("Job %s: %s\n", job.Name, jobState(job))
+	}
+
+	pending, err := cw.GetPendingConversions(ctx)
+	if err != nil {
+		log.Println(err.Error())
+		return 1
+	}
+	for _, p := range pending {
+		owner := "raw"
+		if p.Kind != "" {
+			owner = fmt.Sprintf("%s %s/%s", p.Kind, p.ResourceNamespace, p.ResourceName)
+		}
+		fmt.Printf("Conversion of PVC %s/%s (%s): stopped after step %s\n", p.Checkpoint.PVCNamespace, p.Checkpoint.PVC, owner, p.Checkpoint.Step)
+		fmt.Printf("  resume with: %s\n", resumeCommand(p))
+	}
+
+	if status.NamespaceExists || status.CRBExists {
+		fmt.Printf("\nRun \"%s cleanup\" once no conversion is running to remove them.\n", binaryName)
+	}
+
+	return 0
+}
+
+func presence(exists bool) string {
+	if exists {
+		return "present"
+	}
+	return "absent"
+}
+
+func jobState(job batchv1.Job) string {
+	for _, cond := range job.Status.Conditions {
+		if cond.Status != "True" {
+			continue
+		}
+		switch cond.Type {
+		case batchv1.JobComplete:
+			return "complete"
+		case batchv1.JobFailed:
+			return "failed"
+		}
+	}
+	return "running"
+}
@@ -0,0 +1,112 @@
+package kube
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+const (
+	BatchConverted = "converted"
+	BatchSkipped   = "skipped"
+	BatchFailed    = "failed"
+)
+
+var errNotStarted = errors.New("interrupted before the conversion started")
+
+// BatchResult is the outcome of converting a single volume of a batch.
+type BatchResult struct {
+	ResourceNamespace string
+	ResourceName      string
+	Kind              string
+	PVCNamespace      string
+	PVC               string
+	Result            string
+	Detail            string
+}
+
+// FilterResources returns the resources in namespace, or only the resource of kind named name, if set.
+func FilterResources(resources []ResourceVolumes, namespace, name, kind string) []ResourceVolumes {
+	var filtered []ResourceVolumes
+	for _, r := range resources {
+		if namespace != "" && r.Namespace != namespace {
+			continue
+		}
+		if name != "" && (r.Name != name || r.Kind != kind) {
+			continue
+		}
+		filtered = append(filtered, r)
+	}
+	return filtered
+}
+
+// ConvertAll converts every volume of resources and returns a result per volume, in the order of resources.
+// The volumes of a resource are converted together by ConvertVolumes, while different resources are converted
+// concurrently, at most concurrency at a time. A failed conversion fails the volumes converted along with it and
+// skips the volumes of the resource after them, and the resources not started before ctx is cancelled are skipped.
+func ConvertAll(ctx context.Context, cw ClientWrapper, resources []ResourceVolumes, opts ConvertOptions, concurrency int) []BatchResult {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	results := make([][]BatchResult, len(resources))
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, r := range resources {
+		results[i] = make([]BatchResult, len(r.Volumes))
+		for j, v := range r.Volumes {
+			results[i][j] = BatchResult{
+				ResourceNamespace: r.Namespace,
+				ResourceName:      r.Name,
+				Kind:              r.Kind,
+				PVCNamespace:      v.Spec.ClaimRef.Namespace,
+				PVC:               v.Spec.ClaimRef.Name,
+			}
+		}
+
+		wg.Add(1)
+		go func(r ResourceVolumes, results []BatchResult) {
+			defer wg.Done()
+			err := inSlot(ctx, slots, func() error {
+				return ConvertVolumes(ctx, cw, r.Namespace, r.Name, r.Volumes, r.Patcher, opts)
+			})
+			var convertErr *ConvertError
+			for j := range results {
+				volumeErr := err
+				if errors.As(err, &convertErr) {
+					volumeErr = convertErr.Errs[j]
+				}
+				switch {
+				case volumeErr == errNotStarted || volumeErr == errStopped:
+					results[j].Result, results[j].Detail = BatchSkipped, volumeErr.Error()
+				case volumeErr != nil:
+					results[j].Result, results[j].Detail = BatchFailed, volumeErr.Error()
+				default:
+					results[j].Result = BatchConverted
+				}
+			}
+		}(r, results[i])
+	}
+	wg.Wait()
+
+	var all []BatchResult
+	for _, r := range results {
+		all = append(all, r...)
+	}
+	return all
+}
+
+// inSlot runs f once one of slots is free, or returns errNotStarted if ctx is cancelled first.
+func inSlot(ctx context.Context, slots chan struct{}, f func() error) error {
+	select {
+	case slots <- struct{}{}:
+	case <-ctx.Done():
+		return errNotStarted
+	}
+	defer func() { <-slots }()
+
+	if ctx.Err() != nil {
+		return errNotStarted
+	}
+	return f()
+}
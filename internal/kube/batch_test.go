@@ -0,0 +1,79 @@
+package kube
+
+import (
+	"context"
+	"testing"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func batchVolume(namespace, pvc string) *corev1.PersistentVolume {
+	return &corev1.PersistentVolume{Spec: corev1.PersistentVolumeSpec{
+		ClaimRef: &corev1.ObjectReference{Namespace: namespace, Name: pvc},
+	}}
+}
+
+func TestFilterResources(t *testing.T) {
+	resources := []ResourceVolumes{
+		{Namespace: "apps", Name: "app", Kind: "HelmRelease"},
+		{Namespace: "apps", Name: "app", Kind: "HelmChart"},
+		{Namespace: "media", Name: "player", Kind: "HelmRelease"},
+	}
+
+	assert.Len(t, FilterResources(resources, "", "", ""), 3)
+	assert.Equal(t, []string{"HelmRelease", "HelmChart"}, lo.Map(FilterResources(resources, "apps", "", ""), func(r ResourceVolumes, _ int) string {
+		return r.Kind
+	}))
+	assert.Equal(t, resources[1:2], FilterResources(resources, "apps", "app", "HelmChart"))
+	assert.Empty(t, FilterResources(resources, "media", "app", "HelmRelease"))
+}
+
+func TestConvertAllCancelled(t *testing.T) {
+	resources := []ResourceVolumes{
+		{Namespace: "apps", Name: "app", Kind: "HelmRelease", Volumes: []*corev1.PersistentVolume{batchVolume("apps", "config"), batchVolume("apps", "data")}},
+		{Namespace: "media", Name: "player", Kind: "HelmChart", Volumes: []*corev1.PersistentVolume{batchVolume("media", "library")}},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	results := ConvertAll(ctx, ClientWrapper{}, resources, ConvertOptions{}, 2)
+	assert.Equal(t, []string{"config", "data", "library"}, lo.Map(results, func(r BatchResult, _ int) string {
+		return r.PVC
+	}))
+	for _, r := range results {
+		assert.Equal(t, BatchSkipped, r.Result)
+		assert.Equal(t, errNotStarted.Error(), r.Detail)
+	}
+	assert.Equal(t, "media", results[2].ResourceNamespace)
+	assert.Equal(t, "HelmChart", results[2].Kind)
+}
+
+func TestConvertAll(t *testing.T) {
+	// the PVCs are mounted by different workloads, so they are converted one after the other
+	persistence := map[string]interface{}{
+		"config": map[string]interface{}{"enabled": true},
+		"data":   map[string]interface{}{"enabled": true},
+		"cache":  map[string]interface{}{"enabled": true},
+	}
+	cluster := newFakeCluster(t, 1, []runtime.Object{fakeHelmRelease(persistence, nil)},
+		fakeHostPathVolume("config"), fakeHostPathVolume("data"), fakeHostPathVolume("cache"),
+		fakePVC("app-config", "pvc-config", false), fakePVC("app-data", "pvc-data", false), fakePVC("app-cache", "pvc-cache", false),
+		fakeDeployment("worker", "app-data"), fakeDeployment("cron", "app-cache"),
+	)
+	cluster.failMigrationFrom = "app-data"
+	resources := []ResourceVolumes{{
+		Namespace: "default", Name: "app", Kind: "HelmRelease", Patcher: HelmReleasePatcher{},
+		Volumes: []*corev1.PersistentVolume{fakeHostPathVolume("config"), fakeHostPathVolume("data"), fakeHostPathVolume("cache")},
+	}}
+
+	results := ConvertAll(context.Background(), cluster.cw, resources, ConvertOptions{Migrator: RsyncMigrator{}, SkipPreflight: true}, 1)
+	assert.Equal(t, []string{BatchConverted, BatchFailed, BatchSkipped}, lo.Map(results, func(r BatchResult, _ int) string {
+		return r.Result
+	}))
+	assert.Contains(t, results[1].Detail, "step migrate-to-temp-pvc failed")
+	assert.Equal(t, errStopped.Error(), results[2].Detail)
+	assert.Equal(t, []string{"app-config -> app-config-temp", "app-config-temp -> app-config", "app-data -> app-data-temp"}, cluster.migrations)
+}
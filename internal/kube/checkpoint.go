@@ -0,0 +1,187 @@
+package kube
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const checkpointAnnotationPrefix = "local-path-provisioner-volume-converter/checkpoint-"
+
+// Checkpoint records the last completed step of a volume conversion so a rerun can resume from it.
+// It is stored as an annotation on the HelmRelease or HelmChart, which outlives the migration namespace.
+type Checkpoint struct {
+	Step         string   `json:"step"`
+	PVC          string   `json:"pvc"`
+	PVCNamespace string   `json:"pvcNamespace"`
+	Size         string   `json:"size"`
+	Workload     Workload `json:"workload"`
+	// Replicas and Persistence are the state before the conversion started, used for rollback.
+	Replicas    *int32                 `json:"replicas,omitempty"`
+	Persistence map[string]interface{} `json:"persistence,omitempty"`
+	// Claim is the original PVC of a raw conversion.
+	Claim *corev1.PersistentVolumeClaim `json:"claim,omitempty"`
+	// Strategy is how the conversion moves the data, copy when empty.
+	Strategy string `json:"strategy,omitempty"`
+	// PV and ReclaimPolicy are the original PV and its reclaim policy before the conversion retained it.
+	PV            string                               `json:"pv,omitempty"`
+	ReclaimPolicy corev1.PersistentVolumeReclaimPolicy `json:"reclaimPolicy,omitempty"`
+	// Snapshot is the VolumeSnapshot of the original PVC the rollback restores from, if one was taken.
+	Snapshot *SnapshotRef `json:"snapshot,omitempty"`
+	// Revert is set when the conversion moves a local volume back to a host path volume.
+	Revert bool `json:"revert,omitempty"`
+	// StorageClass is the class a storage class migration moves the volume to.
+	StorageClass string `json:"storageClass,omitempty"`
+}
+
+// PendingConversion is a checkpoint found on a resource, or on the temp PVC of a raw conversion, which has no
+// resource.
+type PendingConversion struct {
+	ResourceNamespace string
+	ResourceName      string
+	Kind              string
+	Checkpoint        Checkpoint
+}
+
+func checkpointAnnotation(volumeName string) string {
+	return checkpointAnnotationPrefix + volumeName
+}
+
+func (cw *ClientWrapper) GetCheckpoint(ctx context.Context, patcher Patcher, namespace, name, volumeName string) (checkpoint Checkpoint, found bool, err error) {
+	resource, err := cw.GetResource(ctx, namespace, name, patcher.getResource())
+	if err != nil {
+		return
+	}
+
+	value, found := resource.GetAnnotations()[checkpointAnnotation(volumeName)]
+	if !found {
+		return
+	}
+
+	err = json.Unmarshal([]byte(value), &checkpoint)
+	return
+}
+
+// GetPVCCheckpoint returns the checkpoint of a conversion of pvcName on the resource, if any.
+func (cw *ClientWrapper) GetPVCCheckpoint(ctx context.Context, patcher Patcher, namespace, name, pvcName string) (Checkpoint, bool, error) {
+	resource, err := cw.GetResource(ctx, namespace, name, patcher.getResource())
+	if err != nil {
+		return Checkpoint{}, false, err
+	}
+
+	for key, value := range resource.GetAnnotations() {
+		if !strings.HasPrefix(key, checkpointAnnotationPrefix) {
+			continue
+		}
+
+		var checkpoint Checkpoint
+		err := json.Unmarshal([]byte(value), &checkpoint)
+		if err != nil {
+			return Checkpoint{}, false, err
+		}
+		if checkpoint.PVC == pvcName {
+			return checkpoint, true, nil
+		}
+	}
+
+	return Checkpoint{}, false, nil
+}
+
+func (cw *ClientWrapper) SetCheckpoint(ctx context.Context, patcher Patcher, namespace, name, volumeName string, checkpoint Checkpoint) error {
+	value, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+
+	return cw.patchCheckpoint(ctx, patcher, namespace, name, volumeName, string(value))
+}
+
+func (cw *ClientWrapper) ClearCheckpoint(ctx context.Context, patcher Patcher, namespace, name, volumeName string) error {
+	return cw.patchCheckpoint(ctx, patcher, namespace, name, volumeName, nil)
+}
+
+func (cw *ClientWrapper) patchCheckpoint(ctx context.Context, patcher Patcher, namespace, name, volumeName string, value interface{}) error {
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{
+				checkpointAnnotation(volumeName): value,
+			},
+		},
+	}
+	payload, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+
+	_, err = cw.dc.Resource(patcher.getResource()).Namespace(namespace).Patch(ctx, name, types.MergePatchType, payload, metav1.PatchOptions{})
+	return err
+}
+
+// GetPendingConversions returns every checkpoint left on a supported resource or temp PVC in the cluster.
+func (cw *ClientWrapper) GetPendingConversions(ctx context.Context) ([]PendingConversion, error) {
+	resourcesByNamespace, err := cw.GetResourcesByNamespace(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []PendingConversion
+	for _, resources := range resourcesByNamespace {
+		for _, resource := range resources {
+			for key, value := range resource.GetAnnotations() {
+				if !strings.HasPrefix(key, checkpointAnnotationPrefix) {
+					continue
+				}
+
+				var checkpoint Checkpoint
+				err := json.Unmarshal([]byte(value), &checkpoint)
+				if err != nil {
+					return nil, errors.New(fmt.Sprintf("invalid checkpoint %s on resource %s: %s", key, resource.GetName(), err.Error()))
+				}
+
+				pending = append(pending, PendingConversion{
+					ResourceNamespace: resource.GetNamespace(),
+					ResourceName:      resource.GetName(),
+					Kind:              resource.GetKind(),
+					Checkpoint:        checkpoint,
+				})
+			}
+		}
+	}
+
+	pvcs, err := cw.cs.CoreV1().PersistentVolumeClaims("").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, pvc := range pvcs.Items {
+		value, found := pvc.Annotations[rawCheckpointKey]
+		if !found {
+			continue
+		}
+
+		var checkpoint Checkpoint
+		err := json.Unmarshal([]byte(value), &checkpoint)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid checkpoint on PVC %s: %s", pvc.Name, err.Error()))
+		}
+		pending = append(pending, PendingConversion{Checkpoint: checkpoint})
+	}
+
+	sort.Slice(pending, func(i, j int) bool {
+		if pending[i].ResourceNamespace != pending[j].ResourceNamespace {
+			return pending[i].ResourceNamespace < pending[j].ResourceNamespace
+		}
+		if pending[i].ResourceName != pending[j].ResourceName {
+			return pending[i].ResourceName < pending[j].ResourceName
+		}
+		return pending[i].Checkpoint.PVC < pending[j].Checkpoint.PVC
+	})
+
+	return pending, nil
+}
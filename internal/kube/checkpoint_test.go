@@ -0,0 +1,70 @@
+package kube
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestGetPVCCheckpoint(t *testing.T) {
+	cw := ClientWrapper{dc: newFakeDynamicClient(fakeHelmRelease(nil, map[string]interface{}{
+		checkpointAnnotation("config"): `{"step":"delete-original-pvc","pvc":"app-config","pvcNamespace":"default"}`,
+		checkpointAnnotation("data"):   `{"step":"add-temp-pvc","pvc":"data-app-0","pvcNamespace":"default"}`,
+		"meta.helm.sh/release-name":    "app",
+	}))}
+
+	tests := []struct {
+		pvc   string
+		step  string
+		found bool
+	}{
+		{pvc: "app-config", step: StepDeleteOriginalPVC, found: true},
+		{pvc: "data-app-0", step: StepAddTempPVC, found: true},
+		// the checkpoint is looked up by the original PVC, never by its temp PVC
+		{pvc: "app-config-temp"},
+		{pvc: "app-cache"},
+	}
+	for _, test := range tests {
+		t.Run(test.pvc, func(t *testing.T) {
+			checkpoint, found, err := cw.GetPVCCheckpoint(context.Background(), HelmReleasePatcher{}, "default", "app", test.pvc)
+			require.NoError(t, err)
+			assert.Equal(t, test.found, found)
+			assert.Equal(t, test.step, checkpoint.Step)
+		})
+	}
+}
+
+func TestGetRawCheckpoint(t *testing.T) {
+	tempPVC := func(name string, annotations map[string]string) *corev1.PersistentVolumeClaim {
+		return &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Annotations: annotations}}
+	}
+	cw := ClientWrapper{cs: fake.NewSimpleClientset(
+		tempPVC("data-temp", map[string]string{rawCheckpointKey: `{"step":"raw-scale-down","pvc":"data","pvcNamespace":"default"}`}),
+		tempPVC("cache-temp", nil),
+	)}
+
+	tests := []struct {
+		pvc   string
+		step  string
+		found bool
+	}{
+		{pvc: "data", step: StepRawScaleDown, found: true},
+		{pvc: "cache"},
+		// no temp PVC, nothing was started
+		{pvc: "logs"},
+		{pvc: "data-temp"},
+	}
+	for _, test := range tests {
+		t.Run(test.pvc, func(t *testing.T) {
+			checkpoint, found, err := cw.GetRawCheckpoint(context.Background(), "default", test.pvc)
+			require.NoError(t, err)
+			assert.Equal(t, test.found, found)
+			assert.Equal(t, test.step, checkpoint.Step)
+		})
+	}
+}
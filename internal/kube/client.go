@@ -6,12 +6,17 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
+	"time"
+
+	"github.com/samber/lo"
 
 	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	rbacv1 "k8s.io/api/rbac/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
@@ -35,6 +40,10 @@ var (
 type ClientWrapper struct {
 	dc dynamic.Interface
 	cs kubernetes.Interface
+	// selector overrides how the workloads and PVCs of a resource are found
+	selector string
+	// rolloutTimeout limits the wait for a workload to scale or roll out, zero waits forever
+	rolloutTimeout time.Duration
 }
 
 func GetClientWrapper(config *rest.Config) ClientWrapper {
@@ -49,9 +58,27 @@ func GetClientWrapper(config *rest.Config) ClientWrapper {
 	}
 
 	return ClientWrapper{
-		dc: dc,
-		cs: cs,
+		dc:             dc,
+		cs:             cs,
+		rolloutTimeout: DefaultRolloutTimeout,
+	}
+}
+
+// SetSelector makes the workloads and PVCs matching the label selector belong to a resource, instead of those Helm
+// annotated with the release. {resource} in the selector is replaced by the resource name.
+func (cw *ClientWrapper) SetSelector(selector string) error {
+	_, err := labels.Parse(strings.ReplaceAll(selector, "{resource}", "resource"))
+	if err != nil {
+		return errors.New(fmt.Sprintf("invalid selector %s: %s", selector, err.Error()))
 	}
+
+	cw.selector = selector
+	return nil
+}
+
+// SetRolloutTimeout limits how long to wait for a workload to scale, roll out or be deleted, 0 waits forever.
+func (cw *ClientWrapper) SetRolloutTimeout(timeout time.Duration) {
+	cw.rolloutTimeout = timeout
 }
 
 func GetKubeconfig() (*rest.Config, error) {
@@ -68,8 +95,8 @@ func GetKubeconfig() (*rest.Config, error) {
 	return config, nil
 }
 
-func (cw *ClientWrapper) GetNamespaces() ([]corev1.Namespace, error) {
-	namespaces, err := cw.cs.CoreV1().Namespaces().List(context.Background(), metav1.ListOptions{})
+func (cw *ClientWrapper) GetNamespaces(ctx context.Context) ([]corev1.Namespace, error) {
+	namespaces, err := cw.cs.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
 	if err != nil {
 		return nil, err
 	}
@@ -77,8 +104,8 @@ func (cw *ClientWrapper) GetNamespaces() ([]corev1.Namespace, error) {
 	return namespaces.Items, nil
 }
 
-func (cw *ClientWrapper) GetResourceList(namespace string, resource schema.GroupVersionResource) ([]unstructured.Unstructured, error) {
-	resources, err := cw.dc.Resource(resource).Namespace(namespace).List(context.Background(), metav1.ListOptions{})
+func (cw *ClientWrapper) GetResourceList(ctx context.Context, namespace string, resource schema.GroupVersionResource) ([]unstructured.Unstructured, error) {
+	resources, err := cw.dc.Resource(resource).Namespace(namespace).List(ctx, metav1.ListOptions{})
 	if err != nil {
 		return nil, err
 	}
@@ -86,56 +113,84 @@ func (cw *ClientWrapper) GetResourceList(namespace string, resource schema.Group
 	return resources.Items, nil
 }
 
-func (cw *ClientWrapper) GetPodByName(namespace, name string) (corev1.Pod, error) {
-	pods, err := cw.cs.CoreV1().Pods(namespace).List(context.Background(), metav1.ListOptions{LabelSelector: fmt.Sprintf("app.kubernetes.io/name=%s", name)})
+func (cw *ClientWrapper) GetResource(ctx context.Context, namespace, name string, resource schema.GroupVersionResource) (*unstructured.Unstructured, error) {
+	return cw.dc.Resource(resource).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+func (cw *ClientWrapper) GetPVByName(ctx context.Context, name string) (*corev1.PersistentVolume, error) {
+	return cw.cs.CoreV1().PersistentVolumes().Get(ctx, name, metav1.GetOptions{})
+}
+
+func (cw *ClientWrapper) GetPVCByName(ctx context.Context, namespace, name string) (*corev1.PersistentVolumeClaim, error) {
+	return cw.cs.CoreV1().PersistentVolumeClaims(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+// GetPVCsByResourceName returns the PVCs belonging to the resource, those mounted by or created from the templates of
+// its Deployments and StatefulSets included.
+func (cw *ClientWrapper) GetPVCsByResourceName(ctx context.Context, namespace, name string) ([]corev1.PersistentVolumeClaim, error) {
+	belongs, err := cw.resourceMatcher(name)
 	if err != nil {
-		return corev1.Pod{}, err
+		return nil, err
 	}
 
-	switch len(pods.Items) {
-	case 0:
-		return corev1.Pod{}, errors.New(fmt.Sprintf("pod %s not ready yet", name))
-	case 1:
-		return pods.Items[0], nil
-	default:
-		return corev1.Pod{}, errors.New(fmt.Sprintf("multiple pods for %s", name))
+	workloads, err := cw.getResourceWorkloads(ctx, namespace, name)
+	if err != nil {
+		return nil, err
 	}
-}
 
-func (cw *ClientWrapper) GetPVByName(name string) (*corev1.PersistentVolume, error) {
-	return cw.cs.CoreV1().PersistentVolumes().Get(context.Background(), name, metav1.GetOptions{})
-}
+	pvcs, err := cw.cs.CoreV1().PersistentVolumeClaims(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
 
-func (cw *ClientWrapper) GetPVCByName(namespace, name string) (*corev1.PersistentVolumeClaim, error) {
-	return cw.cs.CoreV1().PersistentVolumeClaims(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	return lo.Filter(pvcs.Items, func(pvc corev1.PersistentVolumeClaim, _ int) bool {
+		return belongs(pvc.ObjectMeta) || lo.SomeBy(workloads, func(w workloadSpec) bool {
+			return mountsClaim(w.template.Spec, pvc.Name) || claimTemplate(w.Name, w.claimTemplates, pvc.Name) != ""
+		})
+	}), nil
 }
 
-func (cw *ClientWrapper) GetPVCsByResourceName(namespace, name string) ([]corev1.PersistentVolumeClaim, error) {
-	pvcs, err := cw.cs.CoreV1().PersistentVolumeClaims(namespace).List(context.Background(), metav1.ListOptions{LabelSelector: fmt.Sprintf("app.kubernetes.io/name=%s", name)})
-	return pvcs.Items, err
+// resourceMatcher reports whether an object belongs to the resource, going by the selector override if set.
+// Otherwise objects the release was installed with, or labeled by app-template, belong to it.
+func (cw *ClientWrapper) resourceMatcher(name string) (func(metav1.ObjectMeta) bool, error) {
+	if cw.selector != "" {
+		selector, err := labels.Parse(strings.ReplaceAll(cw.selector, "{resource}", name))
+		if err != nil {
+			return nil, err
+		}
+		return func(meta metav1.ObjectMeta) bool {
+			return selector.Matches(labels.Set(meta.Labels))
+		}, nil
+	}
+
+	return func(meta metav1.ObjectMeta) bool {
+		return meta.Annotations["meta.helm.sh/release-name"] == name ||
+			meta.Labels["app.kubernetes.io/instance"] == name ||
+			meta.Labels["app.kubernetes.io/name"] == name
+	}, nil
 }
 
-func (cw *ClientWrapper) getJobByName(namespace, name string) (*batchv1.Job, error) {
-	return cw.cs.BatchV1().Jobs(namespace).Get(context.Background(), name, metav1.GetOptions{})
+func (cw *ClientWrapper) getJobByName(ctx context.Context, namespace, name string) (*batchv1.Job, error) {
+	return cw.cs.BatchV1().Jobs(namespace).Get(ctx, name, metav1.GetOptions{})
 }
 
-func (cw *ClientWrapper) CreateNamespace(name string) error {
-	_, err := cw.cs.CoreV1().Namespaces().Create(context.Background(), &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}, metav1.CreateOptions{})
+func (cw *ClientWrapper) CreateNamespace(ctx context.Context, name string) error {
+	_, err := cw.cs.CoreV1().Namespaces().Create(ctx, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}, metav1.CreateOptions{})
 	return err
 }
 
-func (cw *ClientWrapper) DeleteNamespace(name string) error {
-	return cw.cs.CoreV1().Namespaces().Delete(context.Background(), name, metav1.DeleteOptions{})
+func (cw *ClientWrapper) DeleteNamespace(ctx context.Context, name string) error {
+	return cw.cs.CoreV1().Namespaces().Delete(ctx, name, metav1.DeleteOptions{})
 }
 
-func (cw *ClientWrapper) CreateServiceAccount(namespace, name string) error {
+func (cw *ClientWrapper) CreateServiceAccount(ctx context.Context, namespace, name string) error {
 	sa := &corev1.ServiceAccount{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      name,
 			Namespace: namespace,
 		},
 	}
-	_, err := cw.cs.CoreV1().ServiceAccounts(namespace).Create(context.Background(), sa, metav1.CreateOptions{})
+	_, err := cw.cs.CoreV1().ServiceAccounts(namespace).Create(ctx, sa, metav1.CreateOptions{})
 	if err != nil {
 		return err
 	}
@@ -157,18 +212,18 @@ func (cw *ClientWrapper) CreateServiceAccount(namespace, name string) error {
 			},
 		},
 	}
-	_, err = cw.cs.RbacV1().ClusterRoleBindings().Create(context.Background(), crb, metav1.CreateOptions{})
+	_, err = cw.cs.RbacV1().ClusterRoleBindings().Create(ctx, crb, metav1.CreateOptions{})
 
 	return err
 }
 
-func (cw *ClientWrapper) DeleteCRB(name string) error {
-	return cw.cs.RbacV1().ClusterRoleBindings().Delete(context.Background(), name, metav1.DeleteOptions{})
+func (cw *ClientWrapper) DeleteCRB(ctx context.Context, name string) error {
+	return cw.cs.RbacV1().ClusterRoleBindings().Delete(ctx, name, metav1.DeleteOptions{})
 }
 
-func (cw *ClientWrapper) DeletePVC(namespace, name string) error {
+func (cw *ClientWrapper) DeletePVC(ctx context.Context, namespace, name string) error {
 	deletePolicy := metav1.DeletePropagationForeground
-	err := cw.cs.CoreV1().PersistentVolumeClaims(namespace).Delete(context.Background(), name, metav1.DeleteOptions{PropagationPolicy: &deletePolicy})
+	err := cw.cs.CoreV1().PersistentVolumeClaims(namespace).Delete(ctx, name, metav1.DeleteOptions{PropagationPolicy: &deletePolicy})
 
 	if err == nil {
 		log.Println("PVC", name, "deleted")
@@ -176,32 +231,10 @@ func (cw *ClientWrapper) DeletePVC(namespace, name string) error {
 	return err
 }
 
-func (cw *ClientWrapper) ScaleDeployment(namespace, name string, replicas int) error {
-	s, err := cw.cs.AppsV1().Deployments(namespace).GetScale(context.Background(), name, metav1.GetOptions{})
-	if err != nil {
-		return err
-	}
-	scale := *s
-	scale.Spec.Replicas = int32(replicas)
-
-	_, err = cw.cs.AppsV1().Deployments(namespace).UpdateScale(context.Background(), name, &scale, metav1.UpdateOptions{})
-	if err != nil {
-		return err
-	}
-
-	err = WaitFor(cw.isPodScaled(namespace, name))
-	if err != nil {
-		return err
-	}
-
-	log.Printf("%s deployment finished scaling\n", name)
-	return nil
-}
-
-func (cw *ClientWrapper) CreateJob(namespace string, job *batchv1.Job) (string, error) {
-	job, err := cw.cs.BatchV1().Jobs(namespace).Create(context.Background(), job, metav1.CreateOptions{})
+func (cw *ClientWrapper) CreateJob(ctx context.Context, namespace string, job *batchv1.Job) (string, error) {
+	job, err := cw.cs.BatchV1().Jobs(namespace).Create(ctx, job, metav1.CreateOptions{})
 	if err != nil {
-		return "", nil
+		return "", err
 	}
 	return job.Name, nil
 }
@@ -0,0 +1,258 @@
+package kube
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+var (
+	deploymentsResource = appsv1.SchemeGroupVersion.WithResource("deployments")
+	pvsResource         = corev1.SchemeGroupVersion.WithResource("persistentvolumes")
+)
+
+// fakeCluster fakes what the controllers of a cluster do during a conversion: the deployment app follows its scale,
+// jobs complete at once, a created PVC binds and a HelmRelease declares a PVC for every persistence entry.
+type fakeCluster struct {
+	cw ClientWrapper
+	cs *fake.Clientset
+	// migrations are the copies run by jobs, as "from -> to"
+	migrations []string
+	// failMigrationFrom fails the jobs copying from this PVC
+	failMigrationFrom string
+}
+
+func newFakeCluster(t *testing.T, replicas int32, charts []runtime.Object, objects ...runtime.Object) *fakeCluster {
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "app"}},
+		},
+		Status: appsv1.DeploymentStatus{Replicas: replicas, UpdatedReplicas: replicas, ReadyReplicas: replicas},
+	}
+	cs := fake.NewSimpleClientset(append(objects, deployment)...)
+	dc := newFakeDynamicClient(charts...)
+	cluster := &fakeCluster{cw: ClientWrapper{cs: cs, dc: dc}, cs: cs}
+
+	// the fake client does not serve the scale subresource
+	cs.PrependReactor("get", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		get := action.(k8stesting.GetAction)
+		if get.GetSubresource() != "scale" {
+			return false, nil, nil
+		}
+		obj, err := cs.Tracker().Get(deploymentsResource, get.GetNamespace(), get.GetName())
+		if err != nil {
+			return true, nil, err
+		}
+		d := obj.(*appsv1.Deployment)
+		return true, &autoscalingv1.Scale{ObjectMeta: d.ObjectMeta, Spec: autoscalingv1.ScaleSpec{Replicas: *d.Spec.Replicas}}, nil
+	})
+	cs.PrependReactor("update", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		update := action.(k8stesting.UpdateAction)
+		if update.GetSubresource() != "scale" {
+			return false, nil, nil
+		}
+		scale := update.GetObject().(*autoscalingv1.Scale)
+		obj, err := cs.Tracker().Get(deploymentsResource, update.GetNamespace(), scale.Name)
+		if err != nil {
+			return true, nil, err
+		}
+		d := obj.(*appsv1.Deployment)
+		n := scale.Spec.Replicas
+		d.Spec.Replicas = &n
+		d.Status = appsv1.DeploymentStatus{Replicas: n, UpdatedReplicas: n, ReadyReplicas: n}
+		return true, scale, cs.Tracker().Update(deploymentsResource, d, d.Namespace)
+	})
+
+	cs.PrependReactor("create", "jobs", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		job := action.(k8stesting.CreateAction).GetObject().(*batchv1.Job)
+		job.Name = fmt.Sprintf("%s%d", job.GenerateName, len(cluster.migrations))
+		volumes := job.Spec.Template.Spec.Volumes
+		from := volumes[0].PersistentVolumeClaim.ClaimName
+		cluster.migrations = append(cluster.migrations, fmt.Sprintf("%s -> %s", from, volumes[1].PersistentVolumeClaim.ClaimName))
+
+		condition, phase := batchv1.JobComplete, corev1.PodSucceeded
+		if from == cluster.failMigrationFrom {
+			condition, phase = batchv1.JobFailed, corev1.PodFailed
+		}
+		job.Status.Conditions = []batchv1.JobCondition{{Type: condition, Status: corev1.ConditionTrue}}
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: job.Name, Namespace: job.Namespace, Labels: map[string]string{"job-name": job.Name}},
+			Status:     corev1.PodStatus{Phase: phase},
+		}
+		return false, nil, cs.Tracker().Add(pod)
+	})
+
+	// a PVC binds to the PV pre-bound to it, or to a new local or host path PV depending on its volumeType
+	cs.PrependReactor("create", "persistentvolumeclaims", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		pvc := action.(k8stesting.CreateAction).GetObject().(*corev1.PersistentVolumeClaim)
+		if pvc.Spec.VolumeName == "" {
+			pvName, err := cluster.provision(pvc)
+			if err != nil {
+				return true, nil, err
+			}
+			pvc.Spec.VolumeName = pvName
+		}
+		pvc.Status.Phase = corev1.ClaimBound
+		return false, nil, nil
+	})
+
+	// the release declares a PVC for every persistence entry, the PVCs of removed entries are retained. Patching only
+	// the metadata of the release, like a checkpoint, does not upgrade it.
+	patch := k8stesting.ObjectReaction(dc.Tracker())
+	dc.PrependReactor("patch", "helmreleases", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		handled, obj, err := patch(action)
+		if err != nil || strings.HasPrefix(string(action.(k8stesting.PatchAction).GetPatch()), `{"metadata"`) {
+			return handled, obj, err
+		}
+		return handled, obj, cluster.declare(obj.(*unstructured.Unstructured))
+	})
+
+	return cluster
+}
+
+func (f *fakeCluster) provision(pvc *corev1.PersistentVolumeClaim) (string, error) {
+	pvs, err := f.cs.Tracker().List(pvsResource, corev1.SchemeGroupVersion.WithKind("PersistentVolume"), "")
+	if err != nil {
+		return "", err
+	}
+	for _, pv := range pvs.(*corev1.PersistentVolumeList).Items {
+		ref := pv.Spec.ClaimRef
+		if ref != nil && ref.Namespace == pvc.Namespace && ref.Name == pvc.Name && ref.UID == "" {
+			return pv.Name, nil
+		}
+	}
+
+	pv := fakePV(fmt.Sprintf("pvc-%s-%d", pvc.Name, len(pvs.(*corev1.PersistentVolumeList).Items)), pvc.Annotations["volumeType"] == "local")
+	return pv.Name, f.cs.Tracker().Add(pv)
+}
+
+func (f *fakeCluster) declare(chart *unstructured.Unstructured) error {
+	persistence, _, err := unstructured.NestedMap(chart.Object, "spec", "values", "persistence")
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	for key, value := range persistence {
+		name := fmt.Sprintf("%s-%s", chart.GetName(), key)
+		_, err := f.cs.CoreV1().PersistentVolumeClaims(chart.GetNamespace()).Get(ctx, name, metav1.GetOptions{})
+		if !apierrors.IsNotFound(err) {
+			continue
+		}
+
+		annotations, _, _ := unstructured.NestedStringMap(value.(map[string]interface{}), "annotations")
+		_, err = f.cs.CoreV1().PersistentVolumeClaims(chart.GetNamespace()).Create(ctx, &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: chart.GetNamespace(), Annotations: annotations},
+		}, metav1.CreateOptions{})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *fakeCluster) replicas(t *testing.T) int32 {
+	d, err := f.cs.AppsV1().Deployments("default").Get(context.Background(), "app", metav1.GetOptions{})
+	require.NoError(t, err)
+	return *d.Spec.Replicas
+}
+
+func (f *fakeCluster) pvc(t *testing.T, name string) *corev1.PersistentVolumeClaim {
+	pvc, err := f.cw.GetPVCByName(context.Background(), "default", name)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	require.NoError(t, err)
+	return pvc
+}
+
+// boundPV returns the PV the PVC is bound to.
+func (f *fakeCluster) boundPV(t *testing.T, pvcName string) *corev1.PersistentVolume {
+	pvc := f.pvc(t, pvcName)
+	require.NotNil(t, pvc, pvcName)
+	pv, err := f.cw.GetPVByName(context.Background(), pvc.Spec.VolumeName)
+	require.NoError(t, err)
+	return pv
+}
+
+func (f *fakeCluster) reclaimPolicy(t *testing.T, pvName string) corev1.PersistentVolumeReclaimPolicy {
+	pv, err := f.cw.GetPVByName(context.Background(), pvName)
+	require.NoError(t, err)
+	return pv.Spec.PersistentVolumeReclaimPolicy
+}
+
+func fakePV(name string, local bool) *corev1.PersistentVolume {
+	pv := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       corev1.PersistentVolumeSpec{PersistentVolumeReclaimPolicy: corev1.PersistentVolumeReclaimRetain},
+	}
+	if local {
+		pv.Spec.Local = &corev1.LocalVolumeSource{Path: "/var/lib/rancher/k3s/storage/" + name}
+	} else {
+		pv.Spec.HostPath = &corev1.HostPathVolumeSource{Path: "/var/lib/rancher/k3s/storage/" + name}
+	}
+	return pv
+}
+
+// fakeHostPathVolume returns the host path PV bound to the PVC of the persistence entry key of the release app.
+func fakeHostPathVolume(key string) *corev1.PersistentVolume {
+	pv := fakePV("pvc-"+key, false)
+	pv.Spec.PersistentVolumeReclaimPolicy = corev1.PersistentVolumeReclaimDelete
+	pv.Spec.ClaimRef = &corev1.ObjectReference{Namespace: "default", Name: "app-" + key, UID: "1234"}
+	pv.Spec.Capacity = corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("1Gi")}
+	return pv
+}
+
+func fakePVC(name, pvName string, local bool) *corev1.PersistentVolumeClaim {
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Annotations: map[string]string{}},
+		Spec:       corev1.PersistentVolumeClaimSpec{VolumeName: pvName},
+		Status:     corev1.PersistentVolumeClaimStatus{Phase: corev1.ClaimBound},
+	}
+	if local {
+		pvc.Annotations["volumeType"] = "local"
+	}
+	return pvc
+}
+
+// fakeDeployment returns a ready deployment with one replica mounting the PVC.
+func fakeDeployment(name, pvc string) *appsv1.Deployment {
+	replicas := int32(1)
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": name}},
+			Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{Volumes: []corev1.Volume{{
+				Name:         "data",
+				VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: pvc}},
+			}}}},
+		},
+		Status: appsv1.DeploymentStatus{Replicas: replicas, UpdatedReplicas: replicas, ReadyReplicas: replicas},
+	}
+}
+
+func fakeHelmRelease(persistence map[string]interface{}, annotations map[string]interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "helm.toolkit.fluxcd.io/v2beta1",
+		"kind":       "HelmRelease",
+		"metadata":   map[string]interface{}{"name": "app", "namespace": "default", "annotations": annotations},
+		"spec":       map[string]interface{}{"values": map[string]interface{}{"persistence": persistence}},
+	}}
+}
@@ -1,105 +1,857 @@
 package kube
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"os"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/samber/lo"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
 )
 
-func ConvertVolume(cw ClientWrapper, resourceNamespace, resourceName string, volume *corev1.PersistentVolume, patcher Patcher) (err error) {
-	pvcName := volume.Spec.ClaimRef.Name
-	volumeName := pvcName[strings.LastIndexByte(pvcName, '-')+1:]
-	pvcNamespace := volume.Spec.ClaimRef.Namespace
-	volumeSize := volume.Spec.Capacity.Storage().String()
+const (
+	StepRetainOriginalPV      = "retain-original-pv"
+	StepAddTempPVC            = "add-temp-pvc"
+	StepWaitTempPVCBound      = "wait-temp-pvc-bound"
+	StepWaitTempPVCPodReady   = "wait-temp-pvc-pod-ready"
+	StepScaleDownForTemp      = "scale-down-for-temp-migration"
+	StepMigrateToTempPVC      = "migrate-to-temp-pvc"
+	StepDeleteOriginalPVC     = "delete-original-pvc"
+	StepUpdateOriginalPVC     = "update-original-pvc"
+	StepWaitOriginalPVCBound  = "wait-original-pvc-bound"
+	StepWaitOriginalPodReady  = "wait-original-pvc-pod-ready"
+	StepScaleDownForOriginal  = "scale-down-for-original-migration"
+	StepMigrateToOriginalPVC  = "migrate-to-original-pvc"
+	StepUnbindTempPVC         = "unbind-temp-pvc"
+	StepDeleteTempPVC         = "delete-temp-pvc"
+	StepWaitConvertedPodReady = "wait-converted-pod-ready"
+)
 
-	log.Printf("\nConverting PVC %s from host path volume to local volume\n\n", pvcName)
+type ConvertOptions struct {
+	// Rollback returns the resource to its original state when a step fails, instead of leaving a checkpoint
+	// to resume from.
+	Rollback bool
+	// BindTimeout limits the wait for a PVC to bind, zero waits forever.
+	BindTimeout time.Duration
+	// JobTimeout limits the wait for a migration job to finish, zero waits forever.
+	JobTimeout time.Duration
+	// JobRetries is how many times a failed migration job is started again before the step fails.
+	JobRetries int
+	// Migrator builds the jobs copying the data, pv-migrate if nil.
+	Migrator Migrator
+	// Strategy is CopyStrategy, copying the data to a new local volume, or RebindStrategy, pointing a local volume at
+	// the existing directory. Copy if empty.
+	Strategy string
+	// Verify runs a job comparing both PVCs after every migration, failing the step if their data differs.
+	Verify bool
+	// VerifyImage provides the shell tools of the verification job, DefaultVerifyImage if empty.
+	VerifyImage string
+	// Velero backs up the namespaces of the resource with Velero before converting and adds the converted volume to
+	// the backup-volumes pod annotation afterwards.
+	Velero bool
+	// VeleroNamespace is where Velero runs, DefaultVeleroNamespace if empty.
+	VeleroNamespace string
+	// Snapshot takes a VolumeSnapshot of the original PVC before deleting it, if the cluster and the CSI driver of the
+	// volume support it, and restores from it on rollback.
+	Snapshot bool
+	// Revert converts local volumes back to host path volumes, with the copy strategy only.
+	Revert bool
+	// StorageClass migrates the volumes to this storage class instead of converting them to local volumes, with the
+	// copy strategy only.
+	StorageClass string
+	// SkipPreflight starts a conversion without running the pre-flight checks first.
+	SkipPreflight bool
+	// JobLog receives the streamed logs of the migration jobs in addition to stdout, if set.
+	JobLog io.Writer
+}
 
-	tempPVCName, err := cw.AddTempPVC(patcher, resourceNamespace, resourceName, volumeName, volumeSize)
-	if err != nil {
-		return
+func (o ConvertOptions) migrator() Migrator {
+	if o.Migrator == nil {
+		return PVMigrateMigrator{}
 	}
+	return o.Migrator
+}
 
-	err = WaitFor(cw.IsPVCBound(pvcNamespace, tempPVCName))
-	if err != nil {
-		return
+func (o ConvertOptions) veleroNamespace() string {
+	if o.VeleroNamespace == "" {
+		return DefaultVeleroNamespace
 	}
+	return o.VeleroNamespace
+}
 
-	err = WaitFor(cw.IsPodReady(pvcNamespace, resourceName))
-	if err != nil {
-		return
+func (o ConvertOptions) verifyImage() string {
+	if o.VerifyImage == "" {
+		return DefaultVerifyImage
 	}
+	return o.VerifyImage
+}
 
-	err = cw.ScaleDeployment(pvcNamespace, resourceName, 0)
-	if err != nil {
-		return
+// DefaultBindTimeout is the default of ConvertOptions.BindTimeout used by the command line.
+const DefaultBindTimeout = 10 * time.Minute
+
+// DefaultRolloutTimeout is how long a ClientWrapper waits for a workload to scale or roll out by default.
+const DefaultRolloutTimeout = 10 * time.Minute
+
+// conversion holds everything the steps of a single volume conversion act on.
+type conversion struct {
+	cw   ClientWrapper
+	opts ConvertOptions
+	// raw conversions replace a PVC not declared by a chart directly through the core API
+	raw               bool
+	patcher           Patcher
+	resourceNamespace string
+	resourceName      string
+	pvcName           string
+	pvcNamespace      string
+	workload          Workload
+	volumeName        string
+	volumeSize        string
+	tempPVCName       string
+	// checkpoint is the progress of the running conversion
+	checkpoint *Checkpoint
+	strategy   string
+	// pvName is the original host path PV, retained until purged or pointed at by the local PV of a rebind
+	pvName string
+	// revert converts a local volume back to a host path volume
+	revert bool
+	// storageClass is the class the volume is migrated to, empty when converting it to a local volume
+	storageClass string
+}
+
+type conversionStep struct {
+	name string
+	run  func(ctx context.Context, c *conversion) error
+	// group runs the step for the volumes of one workload at once instead of run, patching the chart a single time
+	group func(ctx context.Context, cs []*conversion) error
+	// workload steps act on the workload shared by the volumes and run once for all of them
+	workload bool
+	// parallel steps run for all volumes at the same time
+	parallel bool
+}
+
+// do runs the step for the conversions of volumes mounted by the same workload and returns the error of each.
+func (s conversionStep) do(ctx context.Context, cs []*conversion) []error {
+	errs := make([]error, len(cs))
+	switch {
+	case s.group != nil:
+		err := s.group(ctx, cs)
+		for i := range errs {
+			errs[i] = err
+		}
+	case s.workload:
+		err := s.run(ctx, cs[0])
+		for i := range errs {
+			errs[i] = err
+		}
+	case s.parallel && len(cs) > 1:
+		var wg sync.WaitGroup
+		for i, c := range cs {
+			wg.Add(1)
+			go func(i int, c *conversion) {
+				defer wg.Done()
+				errs[i] = s.run(ctx, c)
+			}(i, c)
+		}
+		wg.Wait()
+	default:
+		for i, c := range cs {
+			errs[i] = s.run(ctx, c)
+		}
 	}
+	return errs
+}
 
-	jobName, err := cw.MigrateJob(pvcNamespace, pvcName, tempPVCName)
-	if err != nil {
-		return
+// patchStep changes the values entry of every volume with a single patch of the chart.
+func patchStep(name string, entry func(c *conversion) entryPatch) conversionStep {
+	return conversionStep{
+		name: name,
+		group: func(ctx context.Context, cs []*conversion) error {
+			c := cs[0]
+			return c.cw.patchChartEntries(ctx, c.patcher, c.resourceNamespace, c.resourceName, c.workload, lo.Map(cs, func(c *conversion, _ int) entryPatch {
+				return entry(c)
+			}))
+		},
 	}
+}
 
-	err = WaitFor(cw.IsJobFinished(migrationNamespace, jobName))
-	if err != nil {
-		return
+var conversionSteps = []conversionStep{
+	{
+		name: StepRetainOriginalPV,
+		run: func(ctx context.Context, c *conversion) error {
+			return c.cw.retainPV(ctx, c.pvName, CopyStrategy)
+		},
+	},
+	patchStep(StepAddTempPVC, (*conversion).tempPVCEntry),
+	{
+		name: StepWaitTempPVCBound,
+		run: func(ctx context.Context, c *conversion) error {
+			return WaitFor(ctx, c.opts.BindTimeout, c.isTargetBound(c.tempPVCName))
+		},
+	},
+	{
+		name:     StepWaitTempPVCPodReady,
+		workload: true,
+		run: func(ctx context.Context, c *conversion) error {
+			return c.cw.waitForRollout(ctx, c.workload)
+		},
+	},
+	{
+		name:     StepScaleDownForTemp,
+		workload: true,
+		run: func(ctx context.Context, c *conversion) error {
+			return c.cw.ScaleWorkload(ctx, c.workload, 0)
+		},
+	},
+	{
+		name:     StepMigrateToTempPVC,
+		parallel: true,
+		run: func(ctx context.Context, c *conversion) error {
+			return c.migrate(ctx, c.pvcName, c.tempPVCName)
+		},
+	},
+	snapshotStep(StepSnapshotOriginalPVC),
+	{
+		name: StepDeleteOriginalPVC,
+		run: func(ctx context.Context, c *conversion) error {
+			return ignoreNotFound(c.cw.DeletePVC(ctx, c.pvcNamespace, c.pvcName))
+		},
+	},
+	patchStep(StepUpdateOriginalPVC, (*conversion).originalPVCEntry),
+	{
+		name: StepWaitOriginalPVCBound,
+		run: func(ctx context.Context, c *conversion) error {
+			return WaitFor(ctx, c.opts.BindTimeout, c.isTargetBound(c.pvcName))
+		},
+	},
+	{
+		name:     StepWaitOriginalPodReady,
+		workload: true,
+		run: func(ctx context.Context, c *conversion) error {
+			return c.cw.waitForRollout(ctx, c.workload)
+		},
+	},
+	{
+		name:     StepScaleDownForOriginal,
+		workload: true,
+		run: func(ctx context.Context, c *conversion) error {
+			return c.cw.ScaleWorkload(ctx, c.workload, 0)
+		},
+	},
+	{
+		name:     StepMigrateToOriginalPVC,
+		parallel: true,
+		run: func(ctx context.Context, c *conversion) error {
+			return c.migrate(ctx, c.tempPVCName, c.pvcName)
+		},
+	},
+	patchStep(StepUnbindTempPVC, func(c *conversion) entryPatch {
+		return unbindTempPVCEntry(c.volumeName)
+	}),
+	{
+		name: StepDeleteTempPVC,
+		run: func(ctx context.Context, c *conversion) error {
+			return ignoreNotFound(c.cw.DeletePVC(ctx, c.pvcNamespace, c.tempPVCName))
+		},
+	},
+	annotateBackupVolumesStep,
+	{
+		name:     StepWaitConvertedPodReady,
+		workload: true,
+		run: func(ctx context.Context, c *conversion) error {
+			return c.cw.waitForRollout(ctx, c.workload)
+		},
+	},
+}
+
+func (c *conversion) migrate(ctx context.Context, fromPVC, toPVC string) error {
+	migrator := c.opts.migrator()
+	for attempt := 0; ; attempt++ {
+		jobNamespace, jobName, err := c.cw.MigrateJob(ctx, migrator, c.pvcNamespace, fromPVC, toPVC)
+		if err != nil {
+			return err
+		}
+
+		err = c.waitForJob(ctx, jobNamespace, jobName, fmt.Sprintf("[%s -> %s]", fromPVC, toPVC))
+		var failed *JobFailedError
+		if errors.As(err, &failed) && attempt < c.opts.JobRetries {
+			log.Printf("Retrying migration from %s to %s, attempt %d of %d\n", fromPVC, toPVC, attempt+2, c.opts.JobRetries+1)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		// the migration namespace goes with its jobs, jobs next to the PVCs are removed one by one
+		if !migrator.NeedsMigrationObjects() {
+			err = ignoreNotFound(c.cw.deleteJob(ctx, jobNamespace, jobName))
+			if err != nil {
+				return err
+			}
+		}
+
+		if c.opts.Verify {
+			return c.verify(ctx, fromPVC, toPVC)
+		}
+		return nil
 	}
+}
 
-	err = cw.DeletePVC(pvcNamespace, pvcName)
-	if err != nil {
-		return
+// waitForJob waits for the migration job while streaming its logs.
+func (c *conversion) waitForJob(ctx context.Context, jobNamespace, jobName, prefix string) error {
+	out := io.Writer(os.Stdout)
+	if c.opts.JobLog != nil {
+		out = io.MultiWriter(os.Stdout, c.opts.JobLog)
 	}
 
-	err = cw.UpdateOriginalPVC(patcher, resourceNamespace, resourceName, volumeName)
+	logCtx, stopLogs := context.WithCancel(ctx)
+	defer stopLogs()
+	streamed := make(chan struct{})
+	go func() {
+		defer close(streamed)
+		err := c.cw.StreamJobLogs(logCtx, jobNamespace, jobName, prefix, out)
+		if err != nil && logCtx.Err() == nil {
+			log.Printf("Streaming logs of job %s failed: %s\n", jobName, err.Error())
+		}
+	}()
+
+	err := WaitFor(ctx, c.opts.JobTimeout, c.cw.IsJobFinished(jobNamespace, jobName))
 	if err != nil {
-		return
+		return err
 	}
 
-	err = WaitFor(cw.IsPVCBound(pvcNamespace, pvcName))
-	if err != nil {
-		return
+	// the stream ends with the pod, give it a moment to print the last lines
+	select {
+	case <-streamed:
+	case <-time.After(10 * time.Second):
 	}
+	return nil
+}
 
-	err = WaitFor(cw.IsPodReady(pvcNamespace, resourceName))
-	if err != nil {
-		return
+// tempPVCEntry adds the temp PVC entry provisioned the way the conversion moves the volume to.
+func (c *conversion) tempPVCEntry() entryPatch {
+	switch {
+	case c.storageClass != "":
+		return storageClassTempPVCEntry(c.workload, c.volumeName, c.volumeSize, c.storageClass)
+	case c.revert:
+		return revertTempPVCEntry(c.workload, c.volumeName, c.volumeSize)
+	default:
+		return addTempPVCEntry(c.workload, c.volumeName, c.volumeSize)
 	}
+}
 
-	err = cw.ScaleDeployment(pvcNamespace, resourceName, 0)
-	if err != nil {
-		return
+// originalPVCEntry changes the original PVC entry so the recreated PVC is provisioned the way the conversion moves the
+// volume to.
+func (c *conversion) originalPVCEntry() entryPatch {
+	switch {
+	case c.storageClass != "":
+		return storageClassOriginalPVCEntry(c.volumeName, c.storageClass)
+	case c.revert:
+		return revertOriginalPVCEntry(c.volumeName)
+	default:
+		return updateOriginalPVCEntry(c.volumeName)
 	}
+}
+
+// isTargetBound waits for pvcName to bind to a volume of the type the conversion moves to.
+func (c *conversion) isTargetBound(pvcName string) wait.ConditionWithContextFunc {
+	switch {
+	case c.storageClass != "":
+		return c.cw.IsStorageClassPVCBound(c.pvcNamespace, pvcName, c.storageClass)
+	case c.revert:
+		return c.cw.IsHostPathPVCBound(c.pvcNamespace, pvcName)
+	default:
+		return c.cw.IsPVCBound(c.pvcNamespace, pvcName)
+	}
+}
+
+// isSourceBound waits for pvcName to bind to a volume of the type the conversion moves from, as recreated by a
+// rollback.
+func (c *conversion) isSourceBound(pvcName string) wait.ConditionWithContextFunc {
+	switch {
+	case c.storageClass != "":
+		return c.cw.IsPVCBoundOutsideStorageClass(c.pvcNamespace, pvcName, c.storageClass)
+	case c.revert:
+		return c.cw.IsPVCBound(c.pvcNamespace, pvcName)
+	default:
+		return c.cw.IsHostPathPVCBound(c.pvcNamespace, pvcName)
+	}
+}
+
+// detach returns a context for the work that has to happen after ctx was cancelled, recording progress or rolling
+// back once Ctrl+C aborted a step.
+func detach(ctx context.Context) context.Context {
+	if ctx.Err() != nil {
+		return context.Background()
+	}
+	return ctx
+}
+
+func ignoreNotFound(err error) error {
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func persistenceKey(pvcName string) string {
+	return pvcName[strings.LastIndexByte(pvcName, '-')+1:]
+}
+
+// newConversion derives the values key and temp PVC name the chart uses for pvcName of workload.
+func newConversion(cw ClientWrapper, opts ConvertOptions, patcher Patcher, resourceNamespace, resourceName string, workload Workload, pvcName, pvcNamespace, volumeSize string) *conversion {
+	c := &conversion{
+		cw:                cw,
+		opts:              opts,
+		patcher:           patcher,
+		resourceNamespace: resourceNamespace,
+		resourceName:      resourceName,
+		pvcName:           pvcName,
+		pvcNamespace:      pvcNamespace,
+		workload:          workload,
+		volumeSize:        volumeSize,
+	}
+
+	c.volumeName = workload.valuesKey(pvcName)
+	if workload.VolumeClaimTemplate != "" {
+		c.tempPVCName = tempPVCKey(c.volumeName) + workload.claimSuffix(pvcName)
+	} else {
+		c.tempPVCName = fmt.Sprintf("%s-%s", resourceName, tempPVCKey(c.volumeName))
+	}
+
+	return c
+}
+
+// ConvertVolume converts the host path volume to a local volume. If an earlier conversion of the same volume
+// left a checkpoint on the resource, the conversion resumes after the last completed step.
+func ConvertVolume(ctx context.Context, cw ClientWrapper, resourceNamespace, resourceName string, volume *corev1.PersistentVolume, patcher Patcher, opts ConvertOptions) error {
+	return ConvertVolumes(ctx, cw, resourceNamespace, resourceName, []*corev1.PersistentVolume{volume}, patcher, opts)
+}
+
+// ConvertError is returned by ConvertVolumes when the volumes of a workload failed to convert. The volumes converted
+// before stay converted and those after are not started.
+type ConvertError struct {
+	// Errs holds the error of each volume, in the order of the volumes, nil for the converted ones.
+	Errs []error
+	err  error
+}
+
+func (e *ConvertError) Error() string {
+	return e.err.Error()
+}
+
+func (e *ConvertError) Unwrap() error {
+	return e.err
+}
+
+var errStopped = errors.New("not started as the conversion of another volume of the resource failed")
+
+// ConvertVolumes converts several host path volumes of one resource like ConvertVolume. The volumes mounted by the
+// same workload are converted together, so the chart is patched once per step for all of them, the workload is
+// scaled down once per migration and the migration jobs run side by side. A failure is returned as a ConvertError.
+func ConvertVolumes(ctx context.Context, cw ClientWrapper, resourceNamespace, resourceName string, volumes []*corev1.PersistentVolume, patcher Patcher, opts ConvertOptions) error {
+	// every volume is not started until its group ran
+	errs := lo.Times(len(volumes), func(_ int) error {
+		return errStopped
+	})
+
+	var groups [][]*conversion
+	// indices are the positions in volumes of the conversions of each group
+	var indices [][]int
+	for v, volume := range volumes {
+		c, err := prepareConversion(ctx, cw, resourceNamespace, resourceName, volume, patcher, opts)
+		if err != nil {
+			errs[v] = err
+			return &ConvertError{Errs: errs, err: err}
+		}
+
+		// PVCs of one volume claim template share the values entry and checkpoint, they are converted in turn
+		_, i, found := lo.FindIndexOf(groups, func(group []*conversion) bool {
+			return group[0].workload.String() == c.workload.String() && group[0].workload.section() == c.workload.section() &&
+				group[0].strategy == c.strategy && group[0].revert == c.revert && group[0].storageClass == c.storageClass &&
+				!lo.ContainsBy(group, func(other *conversion) bool {
+					return other.volumeName == c.volumeName
+				})
+		})
+		if found {
+			groups[i] = append(groups[i], c)
+			indices[i] = append(indices[i], v)
+		} else {
+			groups = append(groups, []*conversion{c})
+			indices = append(indices, []int{v})
+		}
+	}
+
+	// each volume was checked alone, the new copies of a group are made side by side on one node
+	if !opts.SkipPreflight {
+		for i, group := range groups {
+			var copied []*corev1.PersistentVolume
+			for j, c := range group {
+				if c.checkpoint.Step == "" && c.strategy != RebindStrategy && c.storageClass == "" {
+					copied = append(copied, volumes[indices[i][j]])
+				}
+			}
+			if len(copied) < 2 {
+				continue
+			}
+
+			// the warnings were logged by the checks of each volume
+			result := cw.checkNodeFreeSpace(ctx, copied...)
+			if result.failed() {
+				err := &PreflightError{Failures: []PreflightResult{result}}
+				for _, v := range indices[i] {
+					errs[v] = err
+				}
+				return &ConvertError{Errs: errs, err: err}
+			}
+		}
+	}
+
+	for i, group := range groups {
+		err := runConversions(ctx, group)
+		for _, v := range indices[i] {
+			errs[v] = err
+		}
+		if err != nil {
+			return &ConvertError{Errs: errs, err: err}
+		}
+	}
+	return nil
+}
+
+// prepareConversion looks up the workload and checkpoint of volume, running the pre-flight checks before a new
+// conversion.
+func prepareConversion(ctx context.Context, cw ClientWrapper, resourceNamespace, resourceName string, volume *corev1.PersistentVolume, patcher Patcher, opts ConvertOptions) (*conversion, error) {
+	pvcName := volume.Spec.ClaimRef.Name
+	pvcNamespace := volume.Spec.ClaimRef.Namespace
 
-	jobName, err = cw.MigrateJob(pvcNamespace, tempPVCName, pvcName)
+	workload, err := cw.GetPVCWorkload(ctx, pvcNamespace, pvcName, resourceName)
 	if err != nil {
-		return
+		return nil, err
 	}
 
-	err = WaitFor(cw.IsJobFinished(migrationNamespace, jobName))
+	c := newConversion(cw, opts, patcher, resourceNamespace, resourceName, workload, pvcName, pvcNamespace, volume.Spec.Capacity.Storage().String())
+
+	checkpoint, found, err := cw.GetCheckpoint(ctx, patcher, resourceNamespace, resourceName, c.volumeName)
 	if err != nil {
-		return
+		return nil, err
+	}
+	if found {
+		c = newConversion(cw, opts, patcher, resourceNamespace, resourceName, checkpoint.Workload, pvcName, pvcNamespace, checkpoint.Size)
+	} else {
+		checkpoint = Checkpoint{PVC: pvcName, PVCNamespace: pvcNamespace, Size: c.volumeSize, Workload: workload, Strategy: opts.Strategy, PV: volume.Name, Revert: opts.Revert, StorageClass: opts.StorageClass}
+
+		// a resumed conversion already changed the cluster, the checks only guard the first mutation
+		if !opts.SkipPreflight {
+			err = preflightError(cw.Preflight(ctx, resourceNamespace, resourceName, volume, patcher, workload, opts))
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
+	if checkpoint.Strategy != "" && checkpoint.Strategy != CopyStrategy && checkpoint.Strategy != RebindStrategy {
+		return nil, errors.New(fmt.Sprintf("unsupported conversion strategy %s", checkpoint.Strategy))
+	}
+	if checkpoint.Revert && checkpoint.Strategy == RebindStrategy {
+		return nil, errors.New("the rebind strategy is not supported for reverting a conversion")
+	}
+	if checkpoint.StorageClass != "" && (checkpoint.Strategy == RebindStrategy || checkpoint.Revert) {
+		return nil, errors.New("migrating to a storage class is not supported with the rebind strategy or when reverting")
+	}
+	c.strategy, c.pvName, c.revert, c.storageClass = checkpoint.Strategy, checkpoint.PV, checkpoint.Revert, checkpoint.StorageClass
+	c.checkpoint = &checkpoint
+
+	return c, nil
+}
 
-	err = cw.UnbindTempPVC(patcher, resourceNamespace, resourceName, volumeName)
+// ResumeConversion continues the conversion of pvcName from the checkpoint left on the resource, for when the
+// original host path volume no longer exists to start ConvertVolume from.
+func ResumeConversion(ctx context.Context, cw ClientWrapper, resourceNamespace, resourceName, pvcName string, patcher Patcher, opts ConvertOptions) error {
+	checkpoint, found, err := cw.GetPVCCheckpoint(ctx, patcher, resourceNamespace, resourceName, pvcName)
 	if err != nil {
-		return
+		return err
+	}
+	if !found {
+		return errors.New(fmt.Sprintf("no conversion of PVC %s to resume on resource %s", pvcName, resourceName))
+	}
+
+	c := newConversion(cw, opts, patcher, resourceNamespace, resourceName, checkpoint.Workload, checkpoint.PVC, checkpoint.PVCNamespace, checkpoint.Size)
+	c.strategy, c.pvName, c.revert, c.storageClass = checkpoint.Strategy, checkpoint.PV, checkpoint.Revert, checkpoint.StorageClass
+	return c.run(ctx, checkpoint)
+}
+
+func (c *conversion) steps() []conversionStep {
+	if c.raw {
+		return rawConversionSteps
+	}
+	if c.strategy == RebindStrategy {
+		return rebindConversionSteps
+	}
+	return conversionSteps
+}
+
+func (c *conversion) stepIndex(name string) int {
+	for i, step := range c.steps() {
+		if step.name == name {
+			return i
+		}
 	}
+	return -1
+}
+
+func (c *conversion) saveCheckpoint(ctx context.Context, checkpoint Checkpoint) error {
+	if c.raw {
+		return c.cw.setPVCCheckpoint(ctx, c.pvcNamespace, c.tempPVCName, checkpoint)
+	}
+	return c.cw.SetCheckpoint(ctx, c.patcher, c.resourceNamespace, c.resourceName, c.volumeName, checkpoint)
+}
+
+func (c *conversion) clearCheckpoint(ctx context.Context) error {
+	if c.raw {
+		// the checkpoint is removed together with the temp PVC
+		return nil
+	}
+	return c.cw.ClearCheckpoint(ctx, c.patcher, c.resourceNamespace, c.resourceName, c.volumeName)
+}
+
+func (c *conversion) run(ctx context.Context, checkpoint Checkpoint) error {
+	c.checkpoint = &checkpoint
+	return runConversions(ctx, []*conversion{c})
+}
+
+// runConversions runs the steps of conversions of volumes mounted by the same workload in lockstep. A conversion
+// resuming from a later checkpoint joins the others once they reach its step.
+func runConversions(ctx context.Context, cs []*conversion) error {
+	// restarting would redo steps a checkpoint of another strategy or version may have done differently
+	for _, c := range cs {
+		if c.checkpoint.Step != "" && c.stepIndex(c.checkpoint.Step) < 0 {
+			return errors.New(fmt.Sprintf("checkpoint of PVC %s names step %s, which this conversion does not have, it was left by another strategy or version", c.pvcName, c.checkpoint.Step))
+		}
+	}
+
+	steps := cs[0].steps()
+	next := make([]int, len(cs))
+	var started []*conversion
+	for i, c := range cs {
+		if c.checkpoint.Step != "" {
+			next[i] = c.stepIndex(c.checkpoint.Step) + 1
+			log.Printf("\nResuming conversion of PVC %s after step %s\n\n", c.pvcName, c.checkpoint.Step)
+			continue
+		}
+
+		if c.storageClass != "" {
+			log.Printf("\nMigrating PVC %s to storage class %s\n\n", c.pvcName, c.storageClass)
+		} else if c.revert {
+			log.Printf("\nReverting PVC %s from local volume to host path volume\n\n", c.pvcName)
+		} else {
+			log.Printf("\nConverting PVC %s from host path volume to local volume\n\n", c.pvcName)
+		}
+		err := c.recordOriginalState(ctx, c.checkpoint)
+		if err != nil {
+			return err
+		}
+		started = append(started, c)
+	}
+
+	if len(started) > 0 && started[0].opts.Velero {
+		err := backup(ctx, started)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i, step := range steps {
+		var pending []int
+		for j := range cs {
+			if next[j] <= i {
+				pending = append(pending, j)
+			}
+		}
+		if len(pending) == 0 {
+			continue
+		}
+
+		errs := step.do(ctx, lo.Map(pending, func(j int, _ int) *conversion {
+			return cs[j]
+		}))
+		failed := map[int]error{}
+		for k, j := range pending {
+			if errs[k] != nil {
+				failed[j] = errs[k]
+				continue
+			}
+
+			cs[j].checkpoint.Step = step.name
+			// the step is done even if it was interrupted right after
+			err := cs[j].saveCheckpoint(detach(ctx), *cs[j].checkpoint)
+			if err != nil {
+				return err
+			}
+			next[j] = i + 1
+		}
 
-	err = cw.DeletePVC(pvcNamespace, tempPVCName)
+		if len(failed) > 0 {
+			return stopConversions(ctx, cs, next, step.name, failed)
+		}
+	}
+
+	for _, c := range cs {
+		err := c.finish(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stopConversions ends the conversions after failedStep failed for some of them, rolling all of them back if
+// requested. The others are finished if they completed every step, or kept at their checkpoint to resume from.
+func stopConversions(ctx context.Context, cs []*conversion, next []int, failedStep string, failed map[int]error) error {
+	if len(cs) == 1 {
+		return cs[0].stop(ctx, failedStep, failed[0])
+	}
+
+	failedPVCs := lo.FilterMap(cs, func(c *conversion, j int) (string, bool) {
+		return c.pvcName, failed[j] != nil
+	})
+	var messages []string
+	for j, c := range cs {
+		var err error
+		switch {
+		case failed[j] != nil:
+			err = c.stop(ctx, failedStep, failed[j])
+		case next[j] >= len(c.steps()):
+			err = c.finish(ctx)
+		case c.opts.Rollback:
+			err = c.stop(ctx, c.steps()[next[j]].name, errors.New(fmt.Sprintf("conversion of PVC %s failed", strings.Join(failedPVCs, ", "))))
+		default:
+			err = errors.New(fmt.Sprintf("stopped after step %s as the conversion of PVC %s failed, rerun the conversion to resume", c.checkpoint.Step, strings.Join(failedPVCs, ", ")))
+		}
+		if err != nil {
+			messages = append(messages, fmt.Sprintf("PVC %s: %s", c.pvcName, err.Error()))
+		}
+	}
+	return errors.New(strings.Join(messages, "; "))
+}
+
+// stop ends the conversion after failedStep failed, rolling it back if requested.
+func (c *conversion) stop(ctx context.Context, failedStep string, err error) error {
+	if c.opts.Rollback {
+		return c.rollbackAfter(detach(ctx), failedStep, err, *c.checkpoint)
+	}
+	if errors.Is(err, context.Canceled) {
+		return errors.New(fmt.Sprintf("interrupted during step %s, rerun the conversion to resume", failedStep))
+	}
+	return errors.New(fmt.Sprintf("step %s failed, rerun the conversion to resume: %s", failedStep, err.Error()))
+}
+
+// finish removes the checkpoint of a conversion that completed every step and prints what is left to the user.
+func (c *conversion) finish(ctx context.Context) error {
+	err := c.clearCheckpoint(ctx)
 	if err != nil {
-		return
+		return err
+	}
+
+	if c.storageClass != "" {
+		log.Printf("PVC %s migrated to storage class %s\n\n", c.pvcName, c.storageClass)
+		fmt.Print("Make sure to set the storage class in the PVC declaration of your resource definition file if used.\n\n")
+		fmt.Printf("storageClass: %s\n\n", c.storageClass)
+	} else if c.revert {
+		log.Printf("PVC %s reverted to a host path volume\n\n", c.pvcName)
+		fmt.Print("Make sure to remove the volumeType: local annotation from the PVC declaration of your resource definition file if used.\n\n")
+	} else {
+		log.Printf("PVC %s converted\n\n", c.pvcName)
+
+		if c.raw {
+			fmt.Print("Make sure to add the following block to the metadata of the PVC in your manifests if used.\n\n")
+		} else {
+			fmt.Print("Make sure to add the following block to the PVC declaration of your resource definition file if used.\n\n")
+		}
+		fmt.Print("annotations: \n  volumeType: local\n\n")
+	}
+
+	if c.raw && c.opts.Velero {
+		fmt.Printf("Add PVC %s to the %s annotation of the pods mounting it for Velero to back it up.\n\n", c.pvcName, veleroBackupVolumesAnnotation)
 	}
 
-	err = WaitFor(cw.IsPodReady(pvcNamespace, resourceName))
+	if c.strategy != RebindStrategy && c.checkpoint.ReclaimPolicy != "" && c.checkpoint.ReclaimPolicy != corev1.PersistentVolumeReclaimRetain {
+		log.Printf("PV %s with the original data is retained, remove it with \"convert --purge-old-volumes\" once the converted volume is verified\n\n", c.pvName)
+	}
+
+	return nil
+}
+
+// recordOriginalState stores the replica count and persistence values, or the claim of a raw conversion, the
+// rollback restores.
+func (c *conversion) recordOriginalState(ctx context.Context, checkpoint *Checkpoint) error {
+	if c.workload.Kind != "" {
+		replicas, err := c.cw.GetWorkloadReplicas(ctx, c.workload)
+		if err != nil {
+			return err
+		}
+		checkpoint.Replicas = &replicas
+	}
+
+	if c.pvName != "" {
+		pv, err := c.cw.GetPVByName(ctx, c.pvName)
+		if err != nil {
+			return err
+		}
+		checkpoint.ReclaimPolicy = pv.Spec.PersistentVolumeReclaimPolicy
+	}
+
+	if c.raw {
+		pvc, err := c.cw.GetPVCByName(ctx, c.pvcNamespace, c.pvcName)
+		if err != nil {
+			return err
+		}
+		checkpoint.Claim = originalClaim(pvc)
+		return nil
+	}
+
+	persistence, found, err := c.cw.getPersistenceEntry(ctx, c.patcher, c.resourceNamespace, c.resourceName, c.workload, c.volumeName)
 	if err != nil {
-		return
+		return err
+	}
+	if !found {
+		return errors.New(fmt.Sprintf("persistence entry %s not found on resource %s", c.volumeName, c.resourceName))
 	}
+	checkpoint.Persistence = persistence
 
-	log.Printf("PVC %s converted\n\n", pvcName)
+	return nil
+}
 
-	fmt.Print("Make sure to add the following block to the PVC declaration of your resource definition file if used.\n\n")
-	fmt.Print("annotations: \n  volumeType: local\n\n")
+func (c *conversion) rollbackAfter(ctx context.Context, failedStep string, stepErr error, checkpoint Checkpoint) error {
+	log.Printf("\nStep %s failed: %s\n\n", failedStep, stepErr.Error())
+
+	var report RollbackReport
+	var err error
+	switch {
+	case c.raw:
+		report, err = c.rollbackRaw(ctx, failedStep, checkpoint)
+	case c.strategy == RebindStrategy:
+		report, err = c.rollbackRebind(ctx, failedStep, checkpoint)
+	default:
+		report, err = c.rollback(ctx, failedStep, checkpoint)
+	}
+	if err != nil {
+		return errors.New(fmt.Sprintf("step %s failed: %s; %s, rerun the conversion to resume", failedStep, stepErr.Error(), err.Error()))
+	}
+	log.Println(report.String())
+
+	if report.Restored {
+		err = c.clearCheckpoint(ctx)
+		if err != nil {
+			return err
+		}
+	}
 
-	return
+	return errors.New(fmt.Sprintf("step %s failed and the conversion was rolled back: %s", failedStep, stepErr.Error()))
 }
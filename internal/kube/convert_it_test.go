@@ -86,9 +86,9 @@ func TestConversion(t *testing.T) {
 	_, _, err = createResourceFromFile(cw.dc, "helmrepositories", "test_data/helm-repository.yaml")
 	require.NoError(t, err)
 
-	err = cw.CreateMigrationNamespaceAndServiceAccount()
+	err = cw.CreateMigrationNamespaceAndServiceAccount(context.Background())
 	require.NoError(t, err)
-	defer cw.CleanupMigrationObjects()
+	defer cw.CleanupMigrationObjects(context.Background())
 
 	tests := []struct {
 		resourceName string
@@ -116,28 +116,29 @@ func TestConversion(t *testing.T) {
 			_, resourceNamespace, err := createResourceFromFile(cw.dc, resourceType, fmt.Sprintf("test_data/%s.yaml", test.resourceName))
 			require.NoError(t, err)
 
-			err = WaitFor(cw.IsPodReady(test.pvcNamespace, test.resourceName))
+			workload := Workload{Kind: DeploymentKind, Namespace: test.pvcNamespace, Name: test.resourceName}
+			err = WaitFor(context.Background(), 0, cw.IsPodReady(workload))
 			if err != nil {
 				log.Fatalln(err.Error())
 			}
 
-			pod, err := cw.GetPodByName(test.pvcNamespace, test.resourceName)
+			pod, err := cw.GetWorkloadPod(context.Background(), workload)
 			require.NoError(t, err)
 
 			_, es, err := execInPod(cw.cs, restConfig, &pod, fmt.Sprintf("echo \"%s\" > %s", fileContents, file))
 			require.NoError(t, err)
 			require.Empty(t, es)
 
-			pvc, err := cw.GetPVCByName(test.pvcNamespace, fmt.Sprintf("%s-config", test.resourceName))
+			pvc, err := cw.GetPVCByName(context.Background(), test.pvcNamespace, fmt.Sprintf("%s-config", test.resourceName))
 			require.NoError(t, err)
 
-			volume, err := cw.GetPVByName(pvc.Spec.VolumeName)
+			volume, err := cw.GetPVByName(context.Background(), pvc.Spec.VolumeName)
 			require.NoError(t, err)
 
-			err = ConvertVolume(cw, resourceNamespace, test.resourceName, volume, test.patcher)
+			err = ConvertVolume(context.Background(), cw, resourceNamespace, test.resourceName, volume, test.patcher, ConvertOptions{})
 			require.NoError(t, err)
 
-			pod, err = cw.GetPodByName(test.pvcNamespace, test.resourceName)
+			pod, err = cw.GetWorkloadPod(context.Background(), workload)
 			require.NoError(t, err)
 
 			output, es, err := execInPod(cw.cs, restConfig, &pod, fmt.Sprintf("cat %s", file))
@@ -0,0 +1,190 @@
+package kube
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync/atomic"
+	"testing"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestConversionStepDo(t *testing.T) {
+	cs := []*conversion{{pvcName: "config"}, {pvcName: "data"}}
+	ctx := context.Background()
+
+	var runs int32
+	count := func(ctx context.Context, c *conversion) error {
+		atomic.AddInt32(&runs, 1)
+		if c.pvcName == "data" {
+			return errors.New("failed")
+		}
+		return nil
+	}
+
+	errs := conversionStep{run: count, workload: true}.do(ctx, cs)
+	assert.Equal(t, int32(1), runs)
+	assert.Equal(t, []error{nil, nil}, errs)
+
+	runs = 0
+	errs = conversionStep{run: count, parallel: true}.do(ctx, cs)
+	assert.Equal(t, int32(2), runs)
+	assert.NoError(t, errs[0])
+	assert.EqualError(t, errs[1], "failed")
+
+	var grouped []*conversion
+	errs = conversionStep{group: func(ctx context.Context, cs []*conversion) error {
+		grouped = cs
+		return errors.New("patch failed")
+	}}.do(ctx, cs)
+	assert.Equal(t, cs, grouped)
+	assert.EqualError(t, errs[0], "patch failed")
+	assert.EqualError(t, errs[1], "patch failed")
+}
+
+func TestStepIndex(t *testing.T) {
+	tests := []struct {
+		name     string
+		c        *conversion
+		step     string
+		expected int
+	}{
+		{name: "copy first step", c: &conversion{}, step: StepRetainOriginalPV, expected: 0},
+		{name: "copy last step", c: &conversion{}, step: StepWaitConvertedPodReady, expected: len(conversionSteps) - 1},
+		{name: "rebind step", c: &conversion{strategy: RebindStrategy}, step: StepCreateLocalPV, expected: 2},
+		{name: "raw step", c: &conversion{raw: true}, step: StepRawDeleteTempPVC, expected: len(rawConversionSteps) - 1},
+		{name: "step of another strategy", c: &conversion{strategy: RebindStrategy}, step: StepMigrateToTempPVC, expected: -1},
+		{name: "not started", c: &conversion{}, step: "", expected: -1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, test.c.stepIndex(test.step))
+		})
+	}
+}
+
+func TestConvertVolumesResume(t *testing.T) {
+	workload := Workload{Kind: DeploymentKind, Namespace: "default", Name: "app"}
+	original := func() map[string]interface{} {
+		return map[string]interface{}{"enabled": true}
+	}
+	converted := map[string]interface{}{"enabled": true, "annotations": map[string]interface{}{"volumeType": "local"}}
+	temp := map[string]interface{}{"enabled": true, "retain": true, "annotations": map[string]interface{}{"volumeType": "local"}}
+	checkpoint := func(step string) string {
+		replicas := int32(1)
+		value, err := json.Marshal(Checkpoint{
+			Step: step, PVC: "app-config", PVCNamespace: "default", Size: "1Gi", Workload: workload, PV: "pvc-config",
+			Replicas: &replicas, Persistence: original(), ReclaimPolicy: corev1.PersistentVolumeReclaimDelete,
+		})
+		require.NoError(t, err)
+		return string(value)
+	}
+
+	tests := []struct {
+		name string
+		// step is the saved step the conversion of config resumes after
+		step        string
+		volumes     []string
+		persistence map[string]interface{}
+		objects     []runtime.Object
+		failFrom    string
+		migrations  []string
+		errors      []string
+		// checkpoints are the steps saved afterwards, empty once a conversion finished
+		checkpoints map[string]string
+	}{
+		{
+			name:        "resume after a saved step",
+			step:        StepMigrateToOriginalPVC,
+			volumes:     []string{"config"},
+			persistence: map[string]interface{}{"config": converted, "config-temp": temp},
+			objects: []runtime.Object{
+				fakePVC("app-config", "pvc-config-local", true), fakePV("pvc-config-local", true),
+				fakePVC("app-config-temp", "pvc-config-temp", true), fakePV("pvc-config-temp", true),
+			},
+			checkpoints: map[string]string{"config": ""},
+		},
+		{
+			name:        "resumed conversion joins a new one",
+			step:        StepMigrateToOriginalPVC,
+			volumes:     []string{"config", "data"},
+			persistence: map[string]interface{}{"config": converted, "config-temp": temp, "data": original()},
+			objects: []runtime.Object{
+				fakePVC("app-config", "pvc-config-local", true), fakePV("pvc-config-local", true),
+				fakePVC("app-config-temp", "pvc-config-temp", true), fakePV("pvc-config-temp", true),
+				fakePVC("app-data", "pvc-data", false),
+			},
+			migrations:  []string{"app-data -> app-data-temp", "app-data-temp -> app-data"},
+			checkpoints: map[string]string{"config": "", "data": ""},
+		},
+		{
+			name:        "new conversion fails next to a resumed one",
+			step:        StepScaleDownForTemp,
+			volumes:     []string{"config", "data"},
+			persistence: map[string]interface{}{"config": original(), "config-temp": temp, "data": original()},
+			objects: []runtime.Object{
+				fakePVC("app-config", "pvc-config", false),
+				fakePVC("app-config-temp", "pvc-config-temp", true), fakePV("pvc-config-temp", true),
+				fakePVC("app-data", "pvc-data", false),
+			},
+			failFrom:   "app-data",
+			migrations: []string{"app-config -> app-config-temp", "app-data -> app-data-temp"},
+			errors: []string{
+				"PVC app-config: stopped after step migrate-to-temp-pvc",
+				"PVC app-data: step migrate-to-temp-pvc failed",
+			},
+			checkpoints: map[string]string{"config": StepMigrateToTempPVC, "data": StepScaleDownForTemp},
+		},
+		{
+			name:        "checkpoint of another strategy",
+			step:        StepCreateLocalPV,
+			volumes:     []string{"config", "data"},
+			persistence: map[string]interface{}{"config": original(), "data": original()},
+			objects:     []runtime.Object{fakePVC("app-config", "pvc-config", false), fakePVC("app-data", "pvc-data", false)},
+			errors:      []string{"checkpoint of PVC app-config names step create-local-pv, which this conversion does not have"},
+			checkpoints: map[string]string{"config": StepCreateLocalPV},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			objects := append([]runtime.Object{fakeHostPathVolume("config"), fakeHostPathVolume("data")}, test.objects...)
+			chart := fakeHelmRelease(test.persistence, map[string]interface{}{checkpointAnnotation("config"): checkpoint(test.step)})
+			cluster := newFakeCluster(t, 1, []runtime.Object{chart}, objects...)
+			cluster.failMigrationFrom = test.failFrom
+			volumes := lo.Map(test.volumes, func(volume string, _ int) *corev1.PersistentVolume {
+				return fakeHostPathVolume(volume)
+			})
+			ctx := context.Background()
+
+			err := ConvertVolumes(ctx, cluster.cw, "default", "app", volumes, HelmReleasePatcher{}, ConvertOptions{Migrator: RsyncMigrator{}, SkipPreflight: true})
+			if len(test.errors) == 0 {
+				require.NoError(t, err)
+			}
+			for _, message := range test.errors {
+				require.ErrorContains(t, err, message)
+			}
+			assert.ElementsMatch(t, test.migrations, cluster.migrations)
+
+			for volume, step := range test.checkpoints {
+				checkpoint, found, err := cluster.cw.GetCheckpoint(ctx, HelmReleasePatcher{}, "default", "app", volume)
+				require.NoError(t, err)
+				assert.Equal(t, step != "", found, volume)
+				assert.Equal(t, step, checkpoint.Step, volume)
+				if step != "" {
+					continue
+				}
+
+				assert.NotNil(t, cluster.boundPV(t, "app-"+volume).Spec.Local, volume)
+				assert.Nil(t, cluster.pvc(t, "app-"+tempPVCKey(volume)), volume)
+				_, found, err = cluster.cw.getPersistenceEntry(ctx, HelmReleasePatcher{}, "default", "app", workload, tempPVCKey(volume))
+				require.NoError(t, err)
+				assert.False(t, found, volume)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package kube
+
+import (
+	"context"
+	"sort"
+
+	"github.com/samber/lo"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// ResourceVolumes are the host path volumes of a single HelmRelease or HelmChart.
+type ResourceVolumes struct {
+	Namespace string
+	Name      string
+	Kind      string
+	Patcher   Patcher
+	Volumes   []*corev1.PersistentVolume
+}
+
+// GetResourcesByNamespace returns the supported resources keyed by the namespace they live in,
+// omitting namespaces without any.
+func (cw *ClientWrapper) GetResourcesByNamespace(ctx context.Context) (map[string][]unstructured.Unstructured, error) {
+	namespaces, err := cw.GetNamespaces(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resourcesByNamespace := lo.Associate(namespaces, func(n corev1.Namespace) (string, []unstructured.Unstructured) {
+		helmReleases, err := cw.GetResourceList(ctx, n.Name, FluxHelmReleaseResource)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return "", nil
+		}
+		helmCharts, err := cw.GetResourceList(ctx, n.Name, HelmChartResource)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return "", nil
+		}
+
+		helmCharts = append(helmCharts, helmReleases...)
+		if len(helmCharts) == 0 {
+			return "", nil
+		}
+
+		return n.Name, helmCharts
+	})
+
+	return lo.OmitByKeys(resourcesByNamespace, []string{""}), nil
+}
+
+// GetHostPathVolumesByResource returns the host path volumes of each resource keyed by resource name,
+// omitting resources without any.
+func (cw *ClientWrapper) GetHostPathVolumesByResource(ctx context.Context, resources []unstructured.Unstructured) map[string]ResourceVolumes {
+	pvsByResourceName := lo.Associate(resources, func(resource unstructured.Unstructured) (string, ResourceVolumes) {
+		name, found, err := unstructured.NestedString(resource.UnstructuredContent(), "metadata", "name")
+		if err != nil || !found {
+			return "", ResourceVolumes{}
+		}
+
+		patcher, err := NewPatcher(resource.GetKind())
+		if err != nil {
+			return "", ResourceVolumes{}
+		}
+
+		namespace, found, err := unstructured.NestedString(resource.UnstructuredContent(), patcher.GetNamespacePath()...)
+		if err != nil || !found {
+			return "", ResourceVolumes{}
+		}
+
+		pvcs, err := cw.GetPVCsByResourceName(ctx, namespace, name)
+		if err != nil {
+			return "", ResourceVolumes{}
+		}
+
+		volumesToUpdate := lo.FilterMap(pvcs, func(pvc corev1.PersistentVolumeClaim, _ int) (*corev1.PersistentVolume, bool) {
+			pv, err := cw.GetPVByName(ctx, pvc.Spec.VolumeName)
+			if err != nil {
+				return nil, false
+			}
+
+			if pv.Spec.PersistentVolumeSource.HostPath != nil {
+				return pv, true
+			}
+
+			return nil, false
+		})
+
+		if len(volumesToUpdate) == 0 {
+			return "", ResourceVolumes{}
+		}
+
+		return name, ResourceVolumes{
+			Namespace: resource.GetNamespace(),
+			Name:      name,
+			Kind:      resource.GetKind(),
+			Patcher:   patcher,
+			Volumes:   volumesToUpdate,
+		}
+	})
+
+	return lo.OmitByKeys(pvsByResourceName, []string{""})
+}
+
+// GetAllHostPathVolumes returns the host path volumes of every supported resource in the cluster.
+func (cw *ClientWrapper) GetAllHostPathVolumes(ctx context.Context) ([]ResourceVolumes, error) {
+	resourcesByNamespace, err := cw.GetResourcesByNamespace(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var all []ResourceVolumes
+	for _, resources := range resourcesByNamespace {
+		all = append(all, lo.Values(cw.GetHostPathVolumesByResource(ctx, resources))...)
+	}
+
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].Namespace != all[j].Namespace {
+			return all[i].Namespace < all[j].Namespace
+		}
+		return all[i].Name < all[j].Name
+	})
+
+	return all, nil
+}
@@ -0,0 +1,112 @@
+package kube
+
+import (
+	"context"
+	"time"
+
+	"github.com/samber/lo"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	// assumedCopyRate is the throughput in bytes per second the downtime estimate assumes for copying or hashing the
+	// data on a node.
+	assumedCopyRate = 50 << 20
+	// assumedRestart is how long the downtime estimate assumes scaling the workload down and up again takes.
+	assumedRestart = 30 * time.Second
+)
+
+// VolumeImpact describes what converting a volume touches, for the user to confirm before anything changes.
+type VolumeImpact struct {
+	PVCNamespace string
+	PVC          string
+	PV           string
+	HostPath     string
+	Capacity     resource.Quantity
+	// Node is the node holding the data, empty if the PV is not pinned to one.
+	Node     string
+	Workload Workload
+	Replicas int32
+	// Pods are the pods of the workload, restarted by the conversion.
+	Pods []string
+	// UsedBytes is the size of the data as reported by the kubelet, nil if unknown.
+	UsedBytes *uint64
+}
+
+func (cw *ClientWrapper) GetVolumeImpact(ctx context.Context, resourceName string, volume *corev1.PersistentVolume) (impact VolumeImpact, err error) {
+	impact = VolumeImpact{
+		PVCNamespace: volume.Spec.ClaimRef.Namespace,
+		PVC:          volume.Spec.ClaimRef.Name,
+		PV:           volume.Name,
+		Capacity:     *volume.Spec.Capacity.Storage(),
+		Node:         volumeNode(volume),
+	}
+	if volume.Spec.HostPath != nil {
+		impact.HostPath = volume.Spec.HostPath.Path
+	}
+
+	impact.Workload, err = cw.GetPVCWorkload(ctx, impact.PVCNamespace, impact.PVC, resourceName)
+	if err != nil {
+		return
+	}
+
+	// the workload guessed for an unmounted PVC may not exist
+	impact.Replicas, err = cw.GetWorkloadReplicas(ctx, impact.Workload)
+	err = ignoreNotFound(err)
+	if err != nil {
+		return
+	}
+
+	pods, err := cw.GetWorkloadPods(ctx, impact.Workload)
+	err = ignoreNotFound(err)
+	if err != nil {
+		return
+	}
+	impact.Pods = lo.FilterMap(pods, func(pod corev1.Pod, _ int) (string, bool) {
+		return pod.Name, pod.DeletionTimestamp == nil
+	})
+	return
+}
+
+// GetUsedBytes looks up the size of the data of the volume in the stats summary of its node. The kubelet only
+// reports volumes mounted by a running pod, and not every volume plugin measures its usage, so it returns nil when
+// the size is unknown.
+func (cw *ClientWrapper) GetUsedBytes(ctx context.Context, impact VolumeImpact) *uint64 {
+	if impact.Node == "" {
+		return nil
+	}
+
+	summary, err := cw.getNodeSummary(ctx, impact.Node)
+	if err != nil {
+		return nil
+	}
+	return summary.usedBytes(impact.PVCNamespace, impact.PVC)
+}
+
+// EstimateDowntime estimates how long the workload of volumes converted together is down. Their data is copied side
+// by side, so the largest volume decides, counting with its capacity if the used bytes are unknown. The copy
+// strategy scales the workload down for two migrations, each verified if requested, the rebind strategy only once
+// without copying.
+func EstimateDowntime(impacts []VolumeImpact, opts ConvertOptions) time.Duration {
+	if opts.Strategy == RebindStrategy {
+		return assumedRestart
+	}
+
+	var largest int64
+	for _, impact := range impacts {
+		size := impact.Capacity.Value()
+		if impact.UsedBytes != nil {
+			size = int64(*impact.UsedBytes)
+		}
+		largest = lo.Max([]int64{largest, size})
+	}
+
+	// verifying reads both PVCs again
+	passes := int64(1)
+	if opts.Verify {
+		passes = 3
+	}
+	migration := time.Duration(largest*passes/assumedCopyRate) * time.Second
+	return 2 * (migration + assumedRestart)
+}
@@ -0,0 +1,100 @@
+package kube
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestGetVolumeImpact(t *testing.T) {
+	labels := map[string]string{"app": "web"}
+	pod := func(name string, deleted bool) *corev1.Pod {
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Labels: labels}}
+		if deleted {
+			pod.DeletionTimestamp = &metav1.Time{}
+		}
+		return pod
+	}
+	cs := fake.NewSimpleClientset(
+		&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+			Spec: appsv1.DeploymentSpec{
+				Selector: &metav1.LabelSelector{MatchLabels: labels},
+				Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{Volumes: []corev1.Volume{{
+					Name:         "config",
+					VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "web-config"}},
+				}}}},
+			},
+		},
+		pod("web-1", false),
+		pod("web-0", true),
+	)
+	// the fake client does not serve the scale subresource
+	cs.PrependReactor("get", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		get := action.(k8stesting.GetAction)
+		if get.GetSubresource() != "scale" {
+			return false, nil, nil
+		}
+		if get.GetName() != "web" {
+			return true, nil, apierrors.NewNotFound(appsv1.Resource("deployments"), get.GetName())
+		}
+		return true, &autoscalingv1.Scale{Spec: autoscalingv1.ScaleSpec{Replicas: 2}}, nil
+	})
+	cw := ClientWrapper{cs: cs}
+	volume := func(pvc string) *corev1.PersistentVolume {
+		return &corev1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: "pvc-" + pvc}, Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{HostPath: &corev1.HostPathVolumeSource{Path: "/var/lib/local-path/" + pvc}},
+			ClaimRef:               &corev1.ObjectReference{Namespace: "default", Name: pvc},
+			Capacity:               corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("1Gi")},
+			NodeAffinity: &corev1.VolumeNodeAffinity{Required: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{{
+				MatchExpressions: []corev1.NodeSelectorRequirement{{Key: corev1.LabelHostname, Operator: corev1.NodeSelectorOpIn, Values: []string{"node-1"}}},
+			}}}},
+		}}
+	}
+	ctx := context.Background()
+
+	impact, err := cw.GetVolumeImpact(ctx, "web", volume("web-config"))
+	require.NoError(t, err)
+	assert.Equal(t, VolumeImpact{
+		PVCNamespace: "default",
+		PVC:          "web-config",
+		PV:           "pvc-web-config",
+		HostPath:     "/var/lib/local-path/web-config",
+		Capacity:     resource.MustParse("1Gi"),
+		Node:         "node-1",
+		Workload:     Workload{Kind: DeploymentKind, Namespace: "default", Name: "web"},
+		Replicas:     2,
+		Pods:         []string{"web-1"},
+	}, impact)
+
+	// the Deployment guessed for an unmounted PVC does not exist
+	impact, err = cw.GetVolumeImpact(ctx, "app", volume("app-config"))
+	require.NoError(t, err)
+	assert.Equal(t, Workload{Kind: DeploymentKind, Namespace: "default", Name: "app"}, impact.Workload)
+	assert.Empty(t, impact.Pods)
+}
+
+func TestEstimateDowntime(t *testing.T) {
+	impacts := []VolumeImpact{
+		{Capacity: resource.MustParse("1Gi"), UsedBytes: lo.ToPtr(uint64(500 << 20))},
+		{Capacity: resource.MustParse("100Mi")},
+	}
+
+	// 10s to copy the largest volume, twice, plus a restart each time
+	assert.Equal(t, 80*time.Second, EstimateDowntime(impacts, ConvertOptions{}))
+	assert.Equal(t, 120*time.Second, EstimateDowntime(impacts, ConvertOptions{Verify: true}))
+	assert.Equal(t, 30*time.Second, EstimateDowntime(impacts, ConvertOptions{Strategy: RebindStrategy}))
+}
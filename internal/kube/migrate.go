@@ -1,8 +1,19 @@
 package kube
 
 import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/samber/lo"
+
 	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -11,29 +22,131 @@ const (
 	migrationServiceAccount = "pv-migrate-edit-account"
 )
 
-func (cw *ClientWrapper) CreateMigrationNamespaceAndServiceAccount() error {
-	err := cw.CreateNamespace(migrationNamespace)
+func (cw *ClientWrapper) CreateMigrationNamespaceAndServiceAccount(ctx context.Context) error {
+	err := cw.CreateNamespace(ctx, migrationNamespace)
 	if err != nil {
 		return err
 	}
 
-	return cw.CreateServiceAccount(migrationNamespace, migrationServiceAccount)
+	return cw.CreateServiceAccount(ctx, migrationNamespace, migrationServiceAccount)
 }
 
-func (cw *ClientWrapper) CleanupMigrationObjects() error {
-	err := cw.DeleteNamespace(migrationNamespace)
+func (cw *ClientWrapper) CleanupMigrationObjects(ctx context.Context) error {
+	err := cw.DeleteNamespace(ctx, migrationNamespace)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	err = cw.DeleteCRB(ctx, migrationServiceAccount)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	jobs, err := cw.getManagedJobs(ctx)
 	if err != nil {
 		return err
 	}
+	for _, job := range jobs {
+		err = cw.deleteJob(ctx, job.Namespace, job.Name)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getManagedJobs returns the jobs the rsync engine left in the namespaces of the PVCs.
+func (cw *ClientWrapper) getManagedJobs(ctx context.Context) ([]batchv1.Job, error) {
+	jobs, err := cw.cs.BatchV1().Jobs("").List(ctx, metav1.ListOptions{LabelSelector: fmt.Sprintf("%s=%s", managedByLabel, managedBy)})
+	if err != nil {
+		return nil, err
+	}
+	return jobs.Items, nil
+}
+
+type MigrationStatus struct {
+	Namespace          string
+	NamespaceExists    bool
+	ClusterRoleBinding string
+	CRBExists          bool
+	Jobs               []batchv1.Job
+}
+
+// GetMigrationStatus reports which migration objects are currently present in the cluster.
+func (cw *ClientWrapper) GetMigrationStatus(ctx context.Context) (status MigrationStatus, err error) {
+	status.Namespace = migrationNamespace
+	status.ClusterRoleBinding = migrationServiceAccount
+
+	_, err = cw.cs.CoreV1().Namespaces().Get(ctx, migrationNamespace, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return
+	}
+	status.NamespaceExists = err == nil
+
+	_, err = cw.cs.RbacV1().ClusterRoleBindings().Get(ctx, migrationServiceAccount, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return
+	}
+	status.CRBExists = err == nil
+	err = nil
+
+	if status.NamespaceExists {
+		jobs, err := cw.cs.BatchV1().Jobs(migrationNamespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return status, err
+		}
+		status.Jobs = jobs.Items
+	}
+
+	rsyncJobs, err := cw.getManagedJobs(ctx)
+	if err != nil {
+		return
+	}
+	status.Jobs = append(status.Jobs, rsyncJobs...)
+
+	return
+}
 
-	return cw.DeleteCRB(migrationServiceAccount)
+// Migrator builds the job copying the data of one PVC to another.
+type Migrator interface {
+	// Job returns the job copying fromPVC to toPVC, both in namespace.
+	Job(namespace, fromPVC, toPVC string) *batchv1.Job
+	// NeedsMigrationObjects reports whether the job runs in the migration namespace with its service account.
+	NeedsMigrationObjects() bool
 }
 
+const (
+	PVMigrateEngine = "pv-migrate"
+	RsyncEngine     = "rsync"
+
+	DefaultRsyncImage = "instrumentisto/rsync-ssh:alpine"
+
+	managedByLabel = "app.kubernetes.io/managed-by"
+	managedBy      = "local-path-provisioner-volume-converter"
+)
+
+// NewMigrator returns the migrator of the engine, the image is used by the rsync engine only.
+func NewMigrator(engine, rsyncImage string) (Migrator, error) {
+	switch engine {
+	case PVMigrateEngine:
+		return PVMigrateMigrator{}, nil
+	case RsyncEngine:
+		return RsyncMigrator{Image: rsyncImage}, nil
+	default:
+		return nil, errors.New(fmt.Sprintf("unsupported migration engine %s", engine))
+	}
+}
+
+// PVMigrateMigrator runs pv-migrate from the migration namespace, which deploys its own rsync and ssh pods and so
+// needs cluster wide edit rights.
+type PVMigrateMigrator struct{}
+
 // TODO need -d on second write? https://github.com/utkuozdemir/pv-migrate/blob/master/USAGE.md
-func (cw *ClientWrapper) MigrateJob(namespace, fromPVC, toPVC string) (string, error) {
+func (m PVMigrateMigrator) Job(namespace, fromPVC, toPVC string) *batchv1.Job {
 	var backOffLimit int32 = 0
 
-	jobSpec := &batchv1.Job{
+	return &batchv1.Job{
 		ObjectMeta: metav1.ObjectMeta{
 			GenerateName: "pv-migrater-",
 			Namespace:    migrationNamespace,
@@ -56,6 +169,149 @@ func (cw *ClientWrapper) MigrateJob(namespace, fromPVC, toPVC string) (string, e
 			BackoffLimit: &backOffLimit,
 		},
 	}
+}
+
+func (m PVMigrateMigrator) NeedsMigrationObjects() bool {
+	return true
+}
+
+// RsyncMigrator runs rsync in a single pod mounting both PVCs. The node affinity of the volumes schedules it to the
+// node holding the data, so nothing is copied over the network and no extra rights are needed.
+type RsyncMigrator struct {
+	Image string
+}
+
+func (m RsyncMigrator) Job(namespace, fromPVC, toPVC string) *batchv1.Job {
+	var backOffLimit int32 = 0
+
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: "volume-converter-rsync-",
+			Namespace:    namespace,
+			Labels:       map[string]string{managedByLabel: managedBy},
+		},
+		Spec: batchv1.JobSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name:    "rsync",
+							Image:   m.Image,
+							Command: []string{"rsync"},
+							Args:    []string{"-aHAX", "--numeric-ids", "--verbose", "/source/", "/destination/"},
+							VolumeMounts: []corev1.VolumeMount{
+								{Name: "source", MountPath: "/source", ReadOnly: true},
+								{Name: "destination", MountPath: "/destination"},
+							},
+						},
+					},
+					Volumes: []corev1.Volume{
+						{
+							Name:         "source",
+							VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: fromPVC, ReadOnly: true}},
+						},
+						{
+							Name:         "destination",
+							VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: toPVC}},
+						},
+					},
+					RestartPolicy: corev1.RestartPolicyNever,
+				},
+			},
+			BackoffLimit: &backOffLimit,
+		},
+	}
+}
+
+func (m RsyncMigrator) NeedsMigrationObjects() bool {
+	return false
+}
+
+// MigrateJob starts the job of migrator copying fromPVC to toPVC and returns where it runs.
+func (cw *ClientWrapper) MigrateJob(ctx context.Context, migrator Migrator, namespace, fromPVC, toPVC string) (jobNamespace, jobName string, err error) {
+	job := migrator.Job(namespace, fromPVC, toPVC)
+	jobName, err = cw.CreateJob(ctx, job.Namespace, job)
+	return job.Namespace, jobName, err
+}
+
+// deleteJob removes a finished job and its pods.
+func (cw *ClientWrapper) deleteJob(ctx context.Context, namespace, name string) error {
+	background := metav1.DeletePropagationBackground
+	return cw.cs.BatchV1().Jobs(namespace).Delete(ctx, name, metav1.DeleteOptions{PropagationPolicy: &background})
+}
+
+// JobFailedError is returned when a migration job fails, carrying the logs of its pods.
+type JobFailedError struct {
+	Job     string
+	Reason  string
+	Message string
+	Logs    string
+}
+
+func (e *JobFailedError) Error() string {
+	return fmt.Sprintf("job %s failed: %s %s", e.Job, e.Reason, e.Message)
+}
+
+// jobFailed prints the logs of the failed job and returns them as a JobFailedError.
+func (cw *ClientWrapper) jobFailed(ctx context.Context, job *batchv1.Job, cond batchv1.JobCondition) error {
+	logs, err := cw.GetJobLogs(ctx, job.Namespace, job.Name)
+	if err != nil {
+		logs = fmt.Sprintf("logs unavailable: %s", err.Error())
+	}
+
+	log.Printf("\n%s job failed, pod logs:\n%s\n", job.Name, logs)
+	return &JobFailedError{Job: job.Name, Reason: cond.Reason, Message: cond.Message, Logs: logs}
+}
+
+// GetJobLogs returns the logs of every pod the job started.
+func (cw *ClientWrapper) GetJobLogs(ctx context.Context, namespace, name string) (string, error) {
+	pods, err := cw.cs.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: fmt.Sprintf("job-name=%s", name)})
+	if err != nil {
+		return "", err
+	}
+
+	var logs strings.Builder
+	for _, pod := range pods.Items {
+		raw, err := cw.cs.CoreV1().Pods(namespace).GetLogs(pod.Name, &corev1.PodLogOptions{}).DoRaw(ctx)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&logs, "--- %s\n%s", pod.Name, raw)
+	}
+
+	return logs.String(), nil
+}
+
+// StreamJobLogs follows the logs of the pod of the job once it started, writing every line prefixed with prefix to
+// out until the pod exits or ctx is done.
+func (cw *ClientWrapper) StreamJobLogs(ctx context.Context, namespace, name, prefix string, out io.Writer) error {
+	var pod corev1.Pod
+	err := WaitFor(ctx, 0, func(ctx context.Context) (bool, error) {
+		pods, err := cw.cs.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: fmt.Sprintf("job-name=%s", name)})
+		if err != nil {
+			return false, nil
+		}
+
+		started, found := lo.Find(pods.Items, func(p corev1.Pod) bool {
+			return p.Status.Phase != corev1.PodPending
+		})
+		pod = started
+		return found, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	stream, err := cw.cs.CoreV1().Pods(namespace).GetLogs(pod.Name, &corev1.PodLogOptions{Follow: true}).Stream(ctx)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	scanner := bufio.NewScanner(stream)
+	for scanner.Scan() {
+		fmt.Fprintf(out, "%s %s\n", prefix, scanner.Text())
+	}
 
-	return cw.CreateJob(migrationNamespace, jobSpec)
+	return scanner.Err()
 }
@@ -0,0 +1,57 @@
+package kube
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewMigrator(t *testing.T) {
+	migrator, err := NewMigrator(RsyncEngine, DefaultRsyncImage)
+	require.NoError(t, err)
+	assert.False(t, migrator.NeedsMigrationObjects())
+
+	job := migrator.Job("default", "app-config", "app-config-temp")
+	assert.Equal(t, "default", job.Namespace)
+	volumes := job.Spec.Template.Spec.Volumes
+	require.Len(t, volumes, 2)
+	assert.Equal(t, "app-config", volumes[0].PersistentVolumeClaim.ClaimName)
+	assert.True(t, volumes[0].PersistentVolumeClaim.ReadOnly)
+	assert.Equal(t, "app-config-temp", volumes[1].PersistentVolumeClaim.ClaimName)
+
+	migrator, err = NewMigrator(PVMigrateEngine, "")
+	require.NoError(t, err)
+	assert.True(t, migrator.NeedsMigrationObjects())
+	assert.Equal(t, migrationNamespace, migrator.Job("default", "app-config", "app-config-temp").Namespace)
+
+	_, err = NewMigrator("scp", "")
+	assert.Error(t, err)
+}
+
+func TestVerifyJob(t *testing.T) {
+	job := VerifyJob("default", "app-config", "app-config-temp", DefaultVerifyImage)
+	assert.Equal(t, "default", job.Namespace)
+	assert.Equal(t, managedBy, job.Labels[managedByLabel])
+
+	volumes := job.Spec.Template.Spec.Volumes
+	require.Len(t, volumes, 2)
+	assert.Equal(t, "app-config", volumes[0].PersistentVolumeClaim.ClaimName)
+	assert.Equal(t, "app-config-temp", volumes[1].PersistentVolumeClaim.ClaimName)
+	for _, mount := range job.Spec.Template.Spec.Containers[0].VolumeMounts {
+		assert.True(t, mount.ReadOnly, mount.Name)
+	}
+}
+
+func TestVerifyMismatch(t *testing.T) {
+	cluster := newFakeCluster(t, 1, nil)
+	cluster.failMigrationFrom = "app-config"
+	workload := Workload{Kind: DeploymentKind, Namespace: "default", Name: "app"}
+	c := newConversion(cluster.cw, ConvertOptions{Migrator: RsyncMigrator{}, Verify: true}, HelmReleasePatcher{}, "default", "app", workload, "app-config", "default", "1Gi")
+
+	err := c.verify(context.Background(), "app-config", "app-config-temp")
+	require.Error(t, err)
+	// the fake client answers every log request with "fake logs"
+	assert.Equal(t, "data in PVC app-config-temp does not match app-config:\n--- volume-converter-verify-0\nfake logs", err.Error())
+}
@@ -6,21 +6,28 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"sort"
 	"strings"
 
+	"github.com/samber/lo"
 	"gopkg.in/yaml.v3"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
-	"k8s.io/client-go/dynamic"
 )
 
 type Patcher interface {
 	GetNamespacePath() []string
 	getResource() schema.GroupVersionResource
-	getValues(map[string]interface{}, string) (valuesMap, persistence map[string]interface{}, err error)
-	getPayload(map[string]interface{}, string) (payload []byte, patchType types.PatchType, err error)
+	getValues(map[string]interface{}, string) (valuesMap map[string]interface{}, err error)
+	getPayload(map[string]interface{}, valuesSection, []string) (payload []byte, patchType types.PatchType, err error)
+	// getValuesPayload returns the payload setting the top level key of the values.
+	getValuesPayload(map[string]interface{}, string) (payload []byte, patchType types.PatchType, err error)
+	// getReplacePayload returns the payload replacing the entries as a whole, instead of merging them into the
+	// current ones.
+	getReplacePayload(map[string]interface{}, valuesSection, []string) (payload []byte, patchType types.PatchType, err error)
+	setValues(map[string]interface{}, map[string]interface{}) error
 }
 
 type HelmChartPatcher struct{}
@@ -33,7 +40,7 @@ func (hcp HelmChartPatcher) getResource() schema.GroupVersionResource {
 	return HelmChartResource
 }
 
-func (hcp HelmChartPatcher) getValues(uc map[string]interface{}, chartName string) (valuesMap, persistence map[string]interface{}, err error) {
+func (hcp HelmChartPatcher) getValues(uc map[string]interface{}, chartName string) (valuesMap map[string]interface{}, err error) {
 	valuesContent, found, err := unstructured.NestedString(uc, "spec", "valuesContent")
 	if err != nil {
 		return
@@ -44,21 +51,42 @@ func (hcp HelmChartPatcher) getValues(uc map[string]interface{}, chartName strin
 	}
 
 	err = yaml.Unmarshal([]byte(valuesContent), &valuesMap)
+	return
+}
+
+func (hcp HelmChartPatcher) setValues(uc map[string]interface{}, vals map[string]interface{}) error {
+	yaml, err := yaml.Marshal(vals)
 	if err != nil {
-		return
+		return err
 	}
 
-	if val, ok := valuesMap["persistence"]; ok {
-		persistence = val.(map[string]interface{})
-	} else {
-		err = errors.New(fmt.Sprintf("persistence values not found on resource %s", chartName))
-		return
+	return unstructured.SetNestedField(uc, string(yaml), "spec", "valuesContent")
+}
+
+func (hcp HelmChartPatcher) getPayload(vals map[string]interface{}, section valuesSection, _ []string) (payload []byte, patchType types.PatchType, err error) {
+	// the whole document is replaced, so keys nulled for merge patches can be left out
+	if entries, ok := vals[string(section)].(map[string]interface{}); ok {
+		for _, entry := range entries {
+			if entry, ok := entry.(map[string]interface{}); ok {
+				dropNulls(entry)
+			}
+		}
 	}
 
-	return
+	return hcp.getValuesPayload(vals, string(section))
+}
+
+// getReplacePayload is getPayload, the whole document is replaced anyway.
+func (hcp HelmChartPatcher) getReplacePayload(vals map[string]interface{}, section valuesSection, pvcNames []string) (payload []byte, patchType types.PatchType, err error) {
+	return hcp.getPayload(vals, section, pvcNames)
 }
 
-func (hcp HelmChartPatcher) getPayload(vals map[string]interface{}, _ string) (payload []byte, patchType types.PatchType, err error) {
+// getValuesPayload replaces the whole values document, valuesContent is a single string.
+func (hcp HelmChartPatcher) getValuesPayload(vals map[string]interface{}, key string) (payload []byte, patchType types.PatchType, err error) {
+	if m, ok := vals[key].(map[string]interface{}); ok {
+		dropNulls(m)
+	}
+
 	yaml, err := yaml.Marshal(vals)
 	if err != nil {
 		return
@@ -90,7 +118,7 @@ func (hrp HelmReleasePatcher) getResource() schema.GroupVersionResource {
 	return FluxHelmReleaseResource
 }
 
-func (hrp HelmReleasePatcher) getValues(uc map[string]interface{}, chartName string) (valuesMap, persistence map[string]interface{}, err error) {
+func (hrp HelmReleasePatcher) getValues(uc map[string]interface{}, chartName string) (valuesMap map[string]interface{}, err error) {
 	valuesMap, found, err := unstructured.NestedMap(uc, "spec", "values")
 	if err != nil {
 		return
@@ -100,17 +128,33 @@ func (hrp HelmReleasePatcher) getValues(uc map[string]interface{}, chartName str
 		return
 	}
 
-	if val, ok := valuesMap["persistence"]; ok {
-		persistence = val.(map[string]interface{})
-	} else {
-		err = errors.New(fmt.Sprintf("persistence values not found on resource %s", chartName))
+	return
+}
+
+func (hrp HelmReleasePatcher) setValues(uc map[string]interface{}, vals map[string]interface{}) error {
+	return unstructured.SetNestedMap(uc, vals, "spec", "values")
+}
+
+func (hrp HelmReleasePatcher) getValuesPayload(vals map[string]interface{}, key string) (payload []byte, patchType types.PatchType, err error) {
+	json, err := json.Marshal(vals[key])
+	if err != nil {
 		return
 	}
 
-	return
+	return []byte(fmt.Sprintf(`{"spec": {"values":{"%s": %s}}}`, key, json)), types.MergePatchType, nil
 }
 
-func (hrp HelmReleasePatcher) getPayload(vals map[string]interface{}, pvcName string) (payload []byte, patchType types.PatchType, err error) {
+func (hrp HelmReleasePatcher) getPayload(vals map[string]interface{}, section valuesSection, pvcNames []string) (payload []byte, patchType types.PatchType, err error) {
+	// lists are replaced as a whole by a merge patch, which covers removing templates too
+	if section == volumeClaimTemplatesSection {
+		json, err := json.Marshal(vals[string(section)])
+		if err != nil {
+			return nil, "", err
+		}
+
+		return []byte(fmt.Sprintf(`{"spec": {"values":{"%s": %s}}}`, section, json)), types.MergePatchType, nil
+	}
+
 	persistence, found, err := unstructured.NestedMap(vals, "persistence")
 	if err != nil {
 		return
@@ -121,7 +165,7 @@ func (hrp HelmReleasePatcher) getPayload(vals map[string]interface{}, pvcName st
 	}
 
 	// use json patch for delete op of temp pvc
-	if !strings.Contains(pvcName, "-temp") {
+	if !strings.Contains(pvcNames[0], "-temp") {
 		json, err := json.Marshal(persistence)
 		if err != nil {
 			return nil, "", err
@@ -130,12 +174,12 @@ func (hrp HelmReleasePatcher) getPayload(vals map[string]interface{}, pvcName st
 		payload = []byte(fmt.Sprintf(`{"spec": {"values":{"persistence": %s}}}`, json))
 		patchType = types.MergePatchType
 	} else {
-		patch := []interface{}{
-			map[string]interface{}{
+		patch := lo.Map(pvcNames, func(pvcName string, _ int) interface{} {
+			return map[string]interface{}{
 				"op":   "remove",
 				"path": fmt.Sprintf("/spec/values/persistence/%s", pvcName),
-			},
-		}
+			}
+		})
 
 		payload, err = json.Marshal(patch)
 		if err != nil {
@@ -147,6 +191,38 @@ func (hrp HelmReleasePatcher) getPayload(vals map[string]interface{}, pvcName st
 	return
 }
 
+// getReplacePayload replaces the persistence entries with a JSON patch, a merge patch would keep nested keys missing
+// from them.
+func (hrp HelmReleasePatcher) getReplacePayload(vals map[string]interface{}, section valuesSection, pvcNames []string) (payload []byte, patchType types.PatchType, err error) {
+	// lists are replaced as a whole by a merge patch anyway
+	if section == volumeClaimTemplatesSection {
+		return hrp.getPayload(vals, section, pvcNames)
+	}
+
+	persistence, found, err := unstructured.NestedMap(vals, "persistence")
+	if err != nil {
+		return
+	}
+	if !found {
+		err = errors.New("persistence values not found on resource")
+		return
+	}
+
+	patch := lo.Map(pvcNames, func(pvcName string, _ int) interface{} {
+		return map[string]interface{}{
+			"op":    "replace",
+			"path":  fmt.Sprintf("/spec/values/persistence/%s", pvcName),
+			"value": persistence[pvcName],
+		}
+	})
+
+	payload, err = json.Marshal(patch)
+	if err != nil {
+		return
+	}
+	return payload, types.JSONPatchType, nil
+}
+
 func NewPatcher(resourceType string) (Patcher, error) {
 	switch resourceType {
 	case "HelmChart":
@@ -154,27 +230,165 @@ func NewPatcher(resourceType string) (Patcher, error) {
 	case "HelmRelease":
 		return HelmReleasePatcher{}, nil
 	default:
-		return nil, nil
+		return nil, errors.New(fmt.Sprintf("unsupported resource kind %s", resourceType))
+	}
+}
+
+// valuesSection is the key of the chart values declaring the volumes of a workload.
+type valuesSection string
+
+const (
+	persistenceSection          valuesSection = "persistence"
+	volumeClaimTemplatesSection valuesSection = "volumeClaimTemplates"
+)
+
+// getEntries returns the volume entries of section keyed by name. Persistence entries are returned as stored in
+// values, volume claim templates are a list and have to be written back with setEntries.
+func getEntries(values map[string]interface{}, section valuesSection, chartName string) (map[string]interface{}, error) {
+	switch section {
+	case volumeClaimTemplatesSection:
+		templates, ok := values[string(section)].([]interface{})
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("volumeClaimTemplates values not found on resource %s", chartName))
+		}
+
+		entries := map[string]interface{}{}
+		for _, t := range templates {
+			if template, ok := t.(map[string]interface{}); ok {
+				if name, ok := template["name"].(string); ok {
+					entries[name] = template
+				}
+			}
+		}
+		return entries, nil
+	default:
+		persistence, ok := values[string(section)].(map[string]interface{})
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("persistence values not found on resource %s", chartName))
+		}
+		return persistence, nil
 	}
 }
 
-func patchChart(patcher Patcher, dynamicClient dynamic.Interface, namespace, chartName, pvcName string, patchFunc func(map[string]interface{}, string)) error {
-	chartsClient := dynamicClient.Resource(patcher.getResource()).Namespace(namespace)
-	chart, err := chartsClient.Get(context.Background(), chartName, metav1.GetOptions{})
+// setEntries writes entries back to a list section, keeping the order of existing templates.
+func setEntries(values map[string]interface{}, section valuesSection, entries map[string]interface{}) {
+	if section != volumeClaimTemplatesSection {
+		return
+	}
+
+	var templates []interface{}
+	seen := map[string]bool{}
+	for _, t := range values[string(section)].([]interface{}) {
+		name, _ := t.(map[string]interface{})["name"].(string)
+		seen[name] = true
+		if entry, ok := entries[name].(map[string]interface{}); ok {
+			templates = append(templates, entry)
+		}
+	}
+
+	names := lo.Keys(entries)
+	sort.Strings(names)
+	for _, name := range names {
+		if !seen[name] {
+			entry := entries[name].(map[string]interface{})
+			entry["name"] = name
+			templates = append(templates, entry)
+		}
+	}
+
+	for _, t := range templates {
+		dropNulls(t.(map[string]interface{}))
+	}
+	values[string(section)] = templates
+}
+
+func dropNulls(entry map[string]interface{}) {
+	for k, v := range entry {
+		switch v := v.(type) {
+		case nil:
+			delete(entry, k)
+		case map[string]interface{}:
+			dropNulls(v)
+		}
+	}
+}
+
+type patchFunc func(entries map[string]interface{}, pvcName string)
+
+// entryPatch is a change of the volume entry key.
+type entryPatch struct {
+	key   string
+	patch patchFunc
+	// replace sends the patched entry as a whole instead of merging it into the current one.
+	replace bool
+}
+
+// buildPatch applies patch to the volume entries of chart and returns the payload that sends the change.
+// The values of chart are updated in place so consecutive patches can be built without a round trip.
+func buildPatch(patcher Patcher, chart *unstructured.Unstructured, section valuesSection, pvcName string, patch patchFunc) (payload []byte, patchType types.PatchType, err error) {
+	return buildPatches(patcher, chart, section, []entryPatch{{key: pvcName, patch: patch}})
+}
+
+// buildPatches is buildPatch for the same kind of change to several entries, sent as a single payload.
+func buildPatches(patcher Patcher, chart *unstructured.Unstructured, section valuesSection, patches []entryPatch) (payload []byte, patchType types.PatchType, err error) {
+	values, err := patcher.getValues(chart.UnstructuredContent(), chart.GetName())
 	if err != nil {
-		return err
+		return
 	}
 
-	values, persistence, err := patcher.getValues(chart.UnstructuredContent(), chartName)
+	entries, err := getEntries(values, section, chart.GetName())
+	if err != nil {
+		return
+	}
 
-	patchFunc(persistence, pvcName)
+	for _, p := range patches {
+		p.patch(entries, p.key)
+	}
+	setEntries(values, section, entries)
 
-	payload, patchType, err := patcher.getPayload(values, pvcName)
+	keys := lo.Map(patches, func(p entryPatch, _ int) string {
+		return p.key
+	})
+	if lo.SomeBy(patches, func(p entryPatch) bool { return p.replace }) {
+		payload, patchType, err = patcher.getReplacePayload(values, section, keys)
+	} else {
+		payload, patchType, err = patcher.getPayload(values, section, keys)
+	}
+	if err != nil {
+		return
+	}
+
+	err = patcher.setValues(chart.UnstructuredContent(), values)
+	return
+}
+
+// patchChart patches the values declaring the volumes of workload. Volume claim templates are immutable, so a
+// StatefulSet using them is deleted while orphaning its pods and recreated by the release with the new templates.
+func (cw *ClientWrapper) patchChart(ctx context.Context, patcher Patcher, namespace, chartName string, workload Workload, pvcName string, patch patchFunc) error {
+	return cw.patchChartEntries(ctx, patcher, namespace, chartName, workload, []entryPatch{{key: pvcName, patch: patch}})
+}
+
+// patchChartEntries is patchChart for several entries of workload, changed with a single patch.
+func (cw *ClientWrapper) patchChartEntries(ctx context.Context, patcher Patcher, namespace, chartName string, workload Workload, patches []entryPatch) error {
+	chartsClient := cw.dc.Resource(patcher.getResource()).Namespace(namespace)
+	chart, err := chartsClient.Get(ctx, chartName, metav1.GetOptions{})
 	if err != nil {
 		return err
 	}
 
-	_, err = chartsClient.Patch(context.Background(), chartName, patchType, payload, metav1.PatchOptions{})
+	payload, patchType, err := buildPatches(patcher, chart, workload.section(), patches)
+	if err != nil {
+		return err
+	}
+
+	if workload.VolumeClaimTemplate != "" {
+		err = cw.OrphanDeleteStatefulSet(ctx, workload.Namespace, workload.Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = chartsClient.Patch(ctx, chartName, patchType, payload, metav1.PatchOptions{})
 	if err != nil {
 		return err
 	}
@@ -183,9 +397,30 @@ func patchChart(patcher Patcher, dynamicClient dynamic.Interface, namespace, cha
 	return nil
 }
 
-func (cw *ClientWrapper) AddTempPVC(patcher Patcher, namespace, chartName, pvcName, volumeSize string) (string, error) {
-	tempPVCName := fmt.Sprint(pvcName, "-temp")
-	patch := func(p map[string]interface{}, pvcName string) {
+func tempPVCKey(pvcName string) string {
+	return fmt.Sprint(pvcName, "-temp")
+}
+
+func addTempPVCPatch(tempPVCName, volumeSize string, section valuesSection) patchFunc {
+	return func(p map[string]interface{}, pvcName string) {
+		if section == volumeClaimTemplatesSection {
+			accessMode := "ReadWriteOnce"
+			if original, ok := p[pvcName].(map[string]interface{}); ok {
+				if mode, ok := original["accessMode"].(string); ok {
+					accessMode = mode
+				}
+			}
+			p[tempPVCName] = map[string]interface{}{
+				"mountPath":  fmt.Sprint("/", tempPVCName),
+				"accessMode": accessMode,
+				"size":       volumeSize,
+				"annotations": map[string]interface{}{
+					"volumeType": "local",
+				},
+			}
+			return
+		}
+
 		p[tempPVCName] = map[string]interface{}{
 			"enabled":    true,
 			"retain":     true,
@@ -196,28 +431,129 @@ func (cw *ClientWrapper) AddTempPVC(patcher Patcher, namespace, chartName, pvcNa
 			},
 		}
 	}
-	err := patchChart(patcher, cw.dc, namespace, chartName, pvcName, patch)
-	if err != nil {
-		return "", err
+}
+
+func updateOriginalPVCPatch(p map[string]interface{}, pvcName string) {
+	if entry, ok := p[pvcName].(map[string]interface{}); ok {
+		entry["annotations"] = map[string]interface{}{
+			"volumeType": "local",
+		}
 	}
+}
 
-	return fmt.Sprintf("%s-%s", chartName, tempPVCName), nil
+// revertTempPVCPatch adds a temp PVC entry without the volumeType annotation, provisioned as a host path volume.
+func revertTempPVCPatch(tempPVCName, volumeSize string, section valuesSection) patchFunc {
+	return func(p map[string]interface{}, pvcName string) {
+		addTempPVCPatch(tempPVCName, volumeSize, section)(p, pvcName)
+		delete(p[tempPVCName].(map[string]interface{}), "annotations")
+	}
 }
 
-func (cw *ClientWrapper) UpdateOriginalPVC(patcher Patcher, namespace, chartName, pvcName string) error {
-	patch := func(p map[string]interface{}, pvcName string) {
-		p[pvcName].(map[string]interface{})["annotations"] = map[string]interface{}{
-			"volumeType": "local",
+// revertOriginalPVCPatch removes the volumeType annotation, keeping the other annotations of the entry. The key is
+// set to nil so a merge patch removes it.
+func revertOriginalPVCPatch(p map[string]interface{}, pvcName string) {
+	entry, ok := p[pvcName].(map[string]interface{})
+	if !ok {
+		return
+	}
+	if annotations, ok := entry["annotations"].(map[string]interface{}); ok {
+		annotations["volumeType"] = nil
+	}
+}
+
+// storageClassTempPVCPatch adds a temp PVC entry provisioned by storageClass instead of as a local volume.
+func storageClassTempPVCPatch(tempPVCName, volumeSize, storageClass string, section valuesSection) patchFunc {
+	return func(p map[string]interface{}, pvcName string) {
+		revertTempPVCPatch(tempPVCName, volumeSize, section)(p, pvcName)
+		p[tempPVCName].(map[string]interface{})["storageClass"] = storageClass
+	}
+}
+
+func storageClassOriginalPVCPatch(storageClass string) patchFunc {
+	return func(p map[string]interface{}, pvcName string) {
+		if entry, ok := p[pvcName].(map[string]interface{}); ok {
+			entry["storageClass"] = storageClass
 		}
 	}
+}
 
-	return patchChart(patcher, cw.dc, namespace, chartName, pvcName, patch)
+func unbindTempPVCPatch(p map[string]interface{}, pvcName string) {
+	delete(p, pvcName)
 }
 
-func (cw *ClientWrapper) UnbindTempPVC(patcher Patcher, namespace, chartName, pvcName string) error {
-	patch := func(p map[string]interface{}, pvcName string) {
-		delete(p, pvcName)
+// restorePersistencePatch replaces the persistence entry with original.
+func restorePersistencePatch(original map[string]interface{}) patchFunc {
+	return func(p map[string]interface{}, pvcName string) {
+		p[pvcName] = original
 	}
+}
+
+// restorePersistenceEntry replaces the entry as a whole, so nothing the conversion added to it survives.
+func restorePersistenceEntry(pvcName string, original map[string]interface{}) entryPatch {
+	return entryPatch{key: pvcName, patch: restorePersistencePatch(original), replace: true}
+}
+
+// getPersistenceEntry returns the values declaring pvcName for workload on the resource.
+func (cw *ClientWrapper) getPersistenceEntry(ctx context.Context, patcher Patcher, namespace, chartName string, workload Workload, pvcName string) (map[string]interface{}, bool, error) {
+	chart, err := cw.GetResource(ctx, namespace, chartName, patcher.getResource())
+	if err != nil {
+		return nil, false, err
+	}
+
+	values, err := patcher.getValues(chart.UnstructuredContent(), chartName)
+	if err != nil {
+		return nil, false, err
+	}
+
+	entries, err := getEntries(values, workload.section(), chartName)
+	if err != nil {
+		return nil, false, err
+	}
+
+	entry, found := entries[pvcName].(map[string]interface{})
+	return entry, found, nil
+}
+
+func (cw *ClientWrapper) RestorePersistence(ctx context.Context, patcher Patcher, namespace, chartName string, workload Workload, pvcName string, original map[string]interface{}) error {
+	return cw.patchChartEntries(ctx, patcher, namespace, chartName, workload, []entryPatch{restorePersistenceEntry(pvcName, original)})
+}
+
+func (cw *ClientWrapper) AddTempPVC(ctx context.Context, patcher Patcher, namespace, chartName string, workload Workload, pvcName, volumeSize string) error {
+	return cw.patchChartEntries(ctx, patcher, namespace, chartName, workload, []entryPatch{addTempPVCEntry(workload, pvcName, volumeSize)})
+}
+
+func (cw *ClientWrapper) UpdateOriginalPVC(ctx context.Context, patcher Patcher, namespace, chartName string, workload Workload, pvcName string) error {
+	return cw.patchChartEntries(ctx, patcher, namespace, chartName, workload, []entryPatch{updateOriginalPVCEntry(pvcName)})
+}
+
+func (cw *ClientWrapper) UnbindTempPVC(ctx context.Context, patcher Patcher, namespace, chartName string, workload Workload, pvcName string) error {
+	return cw.patchChartEntries(ctx, patcher, namespace, chartName, workload, []entryPatch{unbindTempPVCEntry(pvcName)})
+}
+
+func addTempPVCEntry(workload Workload, pvcName, volumeSize string) entryPatch {
+	return entryPatch{key: pvcName, patch: addTempPVCPatch(tempPVCKey(pvcName), volumeSize, workload.section())}
+}
+
+func updateOriginalPVCEntry(pvcName string) entryPatch {
+	return entryPatch{key: pvcName, patch: updateOriginalPVCPatch}
+}
+
+func revertTempPVCEntry(workload Workload, pvcName, volumeSize string) entryPatch {
+	return entryPatch{key: pvcName, patch: revertTempPVCPatch(tempPVCKey(pvcName), volumeSize, workload.section())}
+}
+
+func revertOriginalPVCEntry(pvcName string) entryPatch {
+	return entryPatch{key: pvcName, patch: revertOriginalPVCPatch}
+}
+
+func storageClassTempPVCEntry(workload Workload, pvcName, volumeSize, storageClass string) entryPatch {
+	return entryPatch{key: pvcName, patch: storageClassTempPVCPatch(tempPVCKey(pvcName), volumeSize, storageClass, workload.section())}
+}
+
+func storageClassOriginalPVCEntry(pvcName, storageClass string) entryPatch {
+	return entryPatch{key: pvcName, patch: storageClassOriginalPVCPatch(storageClass)}
+}
 
-	return patchChart(patcher, cw.dc, namespace, chartName, fmt.Sprint(pvcName, "-temp"), patch)
+func unbindTempPVCEntry(pvcName string) entryPatch {
+	return entryPatch{key: tempPVCKey(pvcName), patch: unbindTempPVCPatch}
 }
@@ -0,0 +1,252 @@
+package kube
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestBuildPatch(t *testing.T) {
+	helmRelease := &unstructured.Unstructured{Object: map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "helm-release"},
+		"spec": map[string]interface{}{
+			"values": map[string]interface{}{
+				"persistence": map[string]interface{}{
+					"config": map[string]interface{}{"enabled": true},
+				},
+			},
+		},
+	}}
+	helmChart := &unstructured.Unstructured{Object: map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "helm-chart"},
+		"spec": map[string]interface{}{
+			"valuesContent": "persistence:\n  config:\n    enabled: true\n",
+		},
+	}}
+
+	tests := []struct {
+		patcher  Patcher
+		chart    *unstructured.Unstructured
+		expected []string
+		types    []types.PatchType
+	}{
+		{
+			patcher: HelmReleasePatcher{},
+			chart:   helmRelease,
+			expected: []string{
+				`{"spec": {"values":{"persistence": {"config":{"enabled":true},"config-temp":{"accessMode":"ReadWriteOnce","annotations":{"volumeType":"local"},"enabled":true,"retain":true,"size":"1Gi"}}}}}`,
+				`{"spec": {"values":{"persistence": {"config":{"annotations":{"volumeType":"local"},"enabled":true},"config-temp":{"accessMode":"ReadWriteOnce","annotations":{"volumeType":"local"},"enabled":true,"retain":true,"size":"1Gi"}}}}}`,
+				`[{"op":"remove","path":"/spec/values/persistence/config-temp"}]`,
+			},
+			types: []types.PatchType{types.MergePatchType, types.MergePatchType, types.JSONPatchType},
+		},
+		{
+			patcher: HelmChartPatcher{},
+			chart:   helmChart,
+			expected: []string{
+				`[{"op":"replace","path":"/spec/valuesContent","value":"persistence:\n    config:\n        enabled: true\n    config-temp:\n        accessMode: ReadWriteOnce\n        annotations:\n            volumeType: local\n        enabled: true\n        retain: true\n        size: 1Gi\n"}]`,
+				`[{"op":"replace","path":"/spec/valuesContent","value":"persistence:\n    config:\n        annotations:\n            volumeType: local\n        enabled: true\n    config-temp:\n        accessMode: ReadWriteOnce\n        annotations:\n            volumeType: local\n        enabled: true\n        retain: true\n        size: 1Gi\n"}]`,
+				`[{"op":"replace","path":"/spec/valuesContent","value":"persistence:\n    config:\n        annotations:\n            volumeType: local\n        enabled: true\n"}]`,
+			},
+			types: []types.PatchType{types.JSONPatchType, types.JSONPatchType, types.JSONPatchType},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.patcher.getResource().Resource, func(t *testing.T) {
+			steps := []struct {
+				key   string
+				patch patchFunc
+			}{
+				{key: "config", patch: addTempPVCPatch("config-temp", "1Gi", persistenceSection)},
+				{key: "config", patch: updateOriginalPVCPatch},
+				{key: "config-temp", patch: unbindTempPVCPatch},
+			}
+
+			for i, step := range steps {
+				payload, patchType, err := buildPatch(test.patcher, test.chart, persistenceSection, step.key, step.patch)
+				require.NoError(t, err)
+
+				assert.Equal(t, test.types[i], patchType)
+				assert.Equal(t, test.expected[i], string(payload))
+			}
+		})
+	}
+}
+
+func TestBuildPatchVolumeClaimTemplates(t *testing.T) {
+	helmRelease := &unstructured.Unstructured{Object: map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "helm-release"},
+		"spec": map[string]interface{}{
+			"values": map[string]interface{}{
+				"volumeClaimTemplates": []interface{}{
+					map[string]interface{}{"name": "data", "mountPath": "/data", "accessMode": "ReadWriteOnce", "size": "1Gi"},
+				},
+			},
+		},
+	}}
+
+	steps := []struct {
+		key      string
+		patch    patchFunc
+		expected string
+	}{
+		{
+			key:      "data",
+			patch:    addTempPVCPatch("data-temp", "1Gi", volumeClaimTemplatesSection),
+			expected: `{"spec": {"values":{"volumeClaimTemplates": [{"accessMode":"ReadWriteOnce","mountPath":"/data","name":"data","size":"1Gi"},{"accessMode":"ReadWriteOnce","annotations":{"volumeType":"local"},"mountPath":"/data-temp","name":"data-temp","size":"1Gi"}]}}}`,
+		},
+		{
+			key:      "data",
+			patch:    updateOriginalPVCPatch,
+			expected: `{"spec": {"values":{"volumeClaimTemplates": [{"accessMode":"ReadWriteOnce","annotations":{"volumeType":"local"},"mountPath":"/data","name":"data","size":"1Gi"},{"accessMode":"ReadWriteOnce","annotations":{"volumeType":"local"},"mountPath":"/data-temp","name":"data-temp","size":"1Gi"}]}}}`,
+		},
+		{
+			key:      "data-temp",
+			patch:    unbindTempPVCPatch,
+			expected: `{"spec": {"values":{"volumeClaimTemplates": [{"accessMode":"ReadWriteOnce","annotations":{"volumeType":"local"},"mountPath":"/data","name":"data","size":"1Gi"}]}}}`,
+		},
+		{
+			key:      "data",
+			patch:    restorePersistencePatch(map[string]interface{}{"name": "data", "mountPath": "/data", "accessMode": "ReadWriteOnce", "size": "1Gi"}),
+			expected: `{"spec": {"values":{"volumeClaimTemplates": [{"accessMode":"ReadWriteOnce","mountPath":"/data","name":"data","size":"1Gi"}]}}}`,
+		},
+	}
+
+	for _, step := range steps {
+		payload, patchType, err := buildPatch(HelmReleasePatcher{}, helmRelease, volumeClaimTemplatesSection, step.key, step.patch)
+		require.NoError(t, err)
+
+		assert.Equal(t, types.MergePatchType, patchType)
+		assert.Equal(t, step.expected, string(payload))
+	}
+}
+
+func TestBuildPatches(t *testing.T) {
+	helmRelease := &unstructured.Unstructured{Object: map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "helm-release"},
+		"spec": map[string]interface{}{
+			"values": map[string]interface{}{
+				"persistence": map[string]interface{}{
+					"config": map[string]interface{}{"enabled": true},
+					"data":   map[string]interface{}{"enabled": true},
+				},
+			},
+		},
+	}}
+	workload := Workload{Kind: DeploymentKind, Namespace: "default", Name: "app"}
+
+	payload, patchType, err := buildPatches(HelmReleasePatcher{}, helmRelease, persistenceSection, []entryPatch{
+		addTempPVCEntry(workload, "config", "1Gi"),
+		addTempPVCEntry(workload, "data", "2Gi"),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, types.MergePatchType, patchType)
+	assert.Equal(t, `{"spec": {"values":{"persistence": {"config":{"enabled":true},"config-temp":{"accessMode":"ReadWriteOnce","annotations":{"volumeType":"local"},"enabled":true,"retain":true,"size":"1Gi"},"data":{"enabled":true},"data-temp":{"accessMode":"ReadWriteOnce","annotations":{"volumeType":"local"},"enabled":true,"retain":true,"size":"2Gi"}}}}}`, string(payload))
+
+	payload, patchType, err = buildPatches(HelmReleasePatcher{}, helmRelease, persistenceSection, []entryPatch{
+		unbindTempPVCEntry("config"),
+		unbindTempPVCEntry("data"),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, types.JSONPatchType, patchType)
+	assert.Equal(t, `[{"op":"remove","path":"/spec/values/persistence/config-temp"},{"op":"remove","path":"/spec/values/persistence/data-temp"}]`, string(payload))
+}
+
+func TestBuildPatchRevert(t *testing.T) {
+	helmRelease := &unstructured.Unstructured{Object: map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "helm-release"},
+		"spec": map[string]interface{}{
+			"values": map[string]interface{}{
+				"persistence": map[string]interface{}{
+					"config": map[string]interface{}{"enabled": true, "annotations": map[string]interface{}{"volumeType": "local", "team": "a"}},
+				},
+			},
+		},
+	}}
+	helmChart := &unstructured.Unstructured{Object: map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "helm-chart"},
+		"spec": map[string]interface{}{
+			"valuesContent": "persistence:\n  config:\n    annotations:\n      volumeType: local\n    enabled: true\n",
+		},
+	}}
+	workload := Workload{Kind: DeploymentKind, Namespace: "default", Name: "app"}
+
+	payload, _, err := buildPatches(HelmReleasePatcher{}, helmRelease, persistenceSection, []entryPatch{revertTempPVCEntry(workload, "config", "1Gi")})
+	require.NoError(t, err)
+	assert.Equal(t, `{"spec": {"values":{"persistence": {"config":{"annotations":{"team":"a","volumeType":"local"},"enabled":true},"config-temp":{"accessMode":"ReadWriteOnce","enabled":true,"retain":true,"size":"1Gi"}}}}}`, string(payload))
+
+	payload, _, err = buildPatches(HelmReleasePatcher{}, helmRelease, persistenceSection, []entryPatch{revertOriginalPVCEntry("config")})
+	require.NoError(t, err)
+	assert.Equal(t, `{"spec": {"values":{"persistence": {"config":{"annotations":{"team":"a","volumeType":null},"enabled":true},"config-temp":{"accessMode":"ReadWriteOnce","enabled":true,"retain":true,"size":"1Gi"}}}}}`, string(payload))
+
+	payload, _, err = buildPatches(HelmChartPatcher{}, helmChart, persistenceSection, []entryPatch{revertOriginalPVCEntry("config")})
+	require.NoError(t, err)
+	assert.Equal(t, `[{"op":"replace","path":"/spec/valuesContent","value":"persistence:\n    config:\n        annotations: {}\n        enabled: true\n"}]`, string(payload))
+}
+
+func TestBuildPatchesStorageClass(t *testing.T) {
+	helmRelease := &unstructured.Unstructured{Object: map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "helm-release"},
+		"spec": map[string]interface{}{
+			"values": map[string]interface{}{
+				"persistence": map[string]interface{}{
+					"config": map[string]interface{}{"enabled": true},
+				},
+			},
+		},
+	}}
+	workload := Workload{Kind: DeploymentKind, Namespace: "default", Name: "app"}
+
+	payload, _, err := buildPatches(HelmReleasePatcher{}, helmRelease, persistenceSection, []entryPatch{storageClassTempPVCEntry(workload, "config", "1Gi", "nfs")})
+	require.NoError(t, err)
+	assert.Equal(t, `{"spec": {"values":{"persistence": {"config":{"enabled":true},"config-temp":{"accessMode":"ReadWriteOnce","enabled":true,"retain":true,"size":"1Gi","storageClass":"nfs"}}}}}`, string(payload))
+
+	payload, _, err = buildPatches(HelmReleasePatcher{}, helmRelease, persistenceSection, []entryPatch{storageClassOriginalPVCEntry("config", "nfs")})
+	require.NoError(t, err)
+	assert.Equal(t, `{"spec": {"values":{"persistence": {"config":{"enabled":true,"storageClass":"nfs"},"config-temp":{"accessMode":"ReadWriteOnce","enabled":true,"retain":true,"size":"1Gi","storageClass":"nfs"}}}}}`, string(payload))
+}
+
+func TestBuildPatchesRestorePersistence(t *testing.T) {
+	helmRelease := &unstructured.Unstructured{Object: map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "helm-release"},
+		"spec": map[string]interface{}{
+			"values": map[string]interface{}{
+				"persistence": map[string]interface{}{
+					"config":      map[string]interface{}{"enabled": true, "annotations": map[string]interface{}{"volumeType": "local", "team": "a"}},
+					"config-temp": map[string]interface{}{"enabled": true},
+				},
+			},
+		},
+	}}
+	helmChart := &unstructured.Unstructured{Object: map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "helm-chart"},
+		"spec": map[string]interface{}{
+			"valuesContent": "persistence:\n  config:\n    annotations:\n      team: a\n      volumeType: local\n    enabled: true\n",
+		},
+	}}
+	original := map[string]interface{}{"enabled": true, "annotations": map[string]interface{}{"team": "a"}}
+
+	// a merge patch would keep the volumeType annotation, the entry is replaced as a whole
+	payload, patchType, err := buildPatches(HelmReleasePatcher{}, helmRelease, persistenceSection, []entryPatch{restorePersistenceEntry("config", original)})
+	require.NoError(t, err)
+	assert.Equal(t, types.JSONPatchType, patchType)
+	assert.Equal(t, `[{"op":"replace","path":"/spec/values/persistence/config","value":{"annotations":{"team":"a"},"enabled":true}}]`, string(payload))
+
+	payload, patchType, err = buildPatches(HelmChartPatcher{}, helmChart, persistenceSection, []entryPatch{restorePersistenceEntry("config", original)})
+	require.NoError(t, err)
+	assert.Equal(t, types.JSONPatchType, patchType)
+	assert.Equal(t, `[{"op":"replace","path":"/spec/valuesContent","value":"persistence:\n    config:\n        annotations:\n            team: a\n        enabled: true\n"}]`, string(payload))
+}
+
+func TestBuildPatchMissingEntry(t *testing.T) {
+	helmRelease := fakeHelmRelease(map[string]interface{}{"config": map[string]interface{}{"enabled": true}}, nil)
+
+	for _, patch := range []patchFunc{updateOriginalPVCPatch, revertOriginalPVCPatch, storageClassOriginalPVCPatch("nfs"), unbindTempPVCPatch} {
+		payload, _, err := buildPatch(HelmReleasePatcher{}, helmRelease, persistenceSection, "other", patch)
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"spec":{"values":{"persistence":{"config":{"enabled":true}}}}}`, string(payload))
+	}
+}
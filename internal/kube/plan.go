@@ -0,0 +1,339 @@
+package kube
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/samber/lo"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Plan is every mutation ConvertVolume would make for a volume, in order.
+type Plan struct {
+	Resource     string   `json:"resource"`
+	Kind         string   `json:"kind"`
+	PVC          string   `json:"pvc"`
+	PVCNamespace string   `json:"pvcNamespace"`
+	PV           string   `json:"pv"`
+	Workload     Workload `json:"workload"`
+	HostPath     string   `json:"hostPath"`
+	Strategy     string   `json:"strategy"`
+	StorageClass string   `json:"storageClass,omitempty"`
+	// VeleroBackup describes the backup taken before the first step, if any.
+	VeleroBackup string `json:"veleroBackup,omitempty"`
+	// Preflight holds the results of the checks ConvertVolume runs before changing anything.
+	Preflight []PreflightResult `json:"preflight"`
+	Steps     []PlanStep        `json:"steps"`
+}
+
+type PlanStep struct {
+	Name         string                   `json:"name"`
+	Description  string                   `json:"description"`
+	Patch        *PlanPatch               `json:"patch,omitempty"`
+	OrphanDelete string                   `json:"orphanDelete,omitempty"`
+	Job          *batchv1.Job             `json:"job,omitempty"`
+	VerifyJob    *batchv1.Job             `json:"verifyJob,omitempty"`
+	CreatePV     *corev1.PersistentVolume `json:"createPV,omitempty"`
+	DeletePVC    string                   `json:"deletePVC,omitempty"`
+	Scale        *PlanScale               `json:"scale,omitempty"`
+	ServerDryRun string                   `json:"serverDryRun,omitempty"`
+}
+
+type PlanPatch struct {
+	Type    types.PatchType `json:"type"`
+	Payload string          `json:"payload"`
+}
+
+type PlanScale struct {
+	Workload string `json:"workload"`
+	Replicas int32  `json:"replicas"`
+}
+
+const dryRunAccepted = "accepted"
+
+// PlanConversion computes the patches, jobs and deletions ConvertVolume would perform without changing anything.
+// Steps that act on the current cluster state are validated with a server side dry run, the result of which is
+// recorded on the step. Steps depending on earlier mutations can not be validated this way.
+func (cw *ClientWrapper) PlanConversion(ctx context.Context, resourceNamespace, resourceName string, volume *corev1.PersistentVolume, patcher Patcher, opts ConvertOptions) (plan Plan, err error) {
+	pvcName := volume.Spec.ClaimRef.Name
+	pvcNamespace := volume.Spec.ClaimRef.Namespace
+	volumeSize := volume.Spec.Capacity.Storage().String()
+
+	workload, err := cw.GetPVCWorkload(ctx, pvcNamespace, pvcName, resourceName)
+	if err != nil {
+		return
+	}
+
+	c := newConversion(*cw, opts, patcher, resourceNamespace, resourceName, workload, pvcName, pvcNamespace, volumeSize)
+	c.storageClass = opts.StorageClass
+	volumeName, tempPVCName := c.volumeName, c.tempPVCName
+	section := workload.section()
+
+	_, found, err := cw.getPersistenceEntry(ctx, patcher, resourceNamespace, resourceName, workload, volumeName)
+	if err != nil {
+		return
+	}
+	if !found {
+		err = errors.New(fmt.Sprintf("persistence entry %s not found on resource %s", volumeName, resourceName))
+		return
+	}
+
+	chart, err := cw.GetResource(ctx, resourceNamespace, resourceName, patcher.getResource())
+	if err != nil {
+		return
+	}
+
+	plan = Plan{
+		Resource:     fmt.Sprintf("%s/%s", resourceNamespace, resourceName),
+		Kind:         chart.GetKind(),
+		PVC:          pvcName,
+		PVCNamespace: pvcNamespace,
+		PV:           volume.Name,
+		Workload:     workload,
+		Strategy:     CopyStrategy,
+		StorageClass: opts.StorageClass,
+	}
+	if volume.Spec.HostPath != nil {
+		plan.HostPath = volume.Spec.HostPath.Path
+	}
+	if opts.Strategy == RebindStrategy {
+		plan.Strategy = RebindStrategy
+	}
+	plan.Preflight = cw.Preflight(ctx, resourceNamespace, resourceName, volume, patcher, workload, opts)
+
+	patchStep := func(name, description, key string, patch patchFunc, dryRun bool) (PlanStep, error) {
+		payload, patchType, err := buildPatch(patcher, chart, section, key, patch)
+		if err != nil {
+			return PlanStep{}, err
+		}
+
+		step := PlanStep{
+			Name:        name,
+			Description: description,
+			Patch:       &PlanPatch{Type: patchType, Payload: string(payload)},
+		}
+		if workload.VolumeClaimTemplate != "" {
+			step.OrphanDelete = workload.String()
+		}
+		if dryRun {
+			step.ServerDryRun = dryRunResult(cw.dryRunPatch(ctx, patcher, resourceNamespace, resourceName, patchType, payload))
+		}
+		return step, nil
+	}
+
+	// the Velero backup runs before the first step and is only listed in the description of the plan
+	var annotateStep PlanStep
+	if opts.Velero {
+		annotateStep = PlanStep{
+			Name:        StepAnnotateBackupVolumes,
+			Description: fmt.Sprintf("Add %s to the %s pod annotation of %s %s", volumeName, veleroBackupVolumesAnnotation, plan.Kind, plan.Resource),
+		}
+		plan.VeleroBackup = fmt.Sprintf("Back up namespaces %s with Velero in namespace %s", strings.Join(lo.Uniq([]string{resourceNamespace, pvcNamespace}), ", "), opts.veleroNamespace())
+	}
+
+	var snapshotStep PlanStep
+	if opts.Snapshot {
+		snapshotStep = PlanStep{
+			Name:        StepSnapshotOriginalPVC,
+			Description: fmt.Sprintf("Take VolumeSnapshot %s of PVC %s/%s, if PV %s is a CSI volume with a snapshot class", snapshotName(pvcName), pvcNamespace, pvcName, volume.Name),
+		}
+	}
+
+	if plan.Strategy == RebindStrategy {
+		var local *corev1.PersistentVolume
+		local, err = localVolume(volume, pvcNamespace, pvcName)
+		if err != nil {
+			return
+		}
+
+		var updateOriginal PlanStep
+		updateOriginal, err = patchStep(
+			StepUpdatePVCForRebind,
+			fmt.Sprintf("Annotate %s entry %s with volumeType local", section, volumeName),
+			volumeName, updateOriginalPVCPatch, false,
+		)
+		if err != nil {
+			return
+		}
+
+		plan.Steps = planSteps([]PlanStep{
+			{Name: StepRetainHostPathPV, Description: fmt.Sprintf("Set the reclaim policy of PV %s to Retain", volume.Name)},
+			{
+				Name:         StepScaleDownForRebind,
+				Description:  fmt.Sprintf("Scale %s to 0", workload),
+				Scale:        &PlanScale{Workload: workload.String(), Replicas: 0},
+				ServerDryRun: dryRunResult(cw.updateWorkloadScale(ctx, workload, 0, metav1.UpdateOptions{DryRun: []string{metav1.DryRunAll}})),
+			},
+			{
+				Name:         StepCreateLocalPV,
+				Description:  fmt.Sprintf("Create local PV %s for %s pre-bound to PVC %s/%s", local.Name, plan.HostPath, pvcNamespace, pvcName),
+				CreatePV:     withPVTypeMeta(local),
+				ServerDryRun: dryRunResult(cw.dryRunCreatePV(ctx, local)),
+			},
+			{
+				Name:         StepDeleteHostPathPVC,
+				Description:  fmt.Sprintf("Delete PVC %s/%s, PV %s is retained", pvcNamespace, pvcName, volume.Name),
+				DeletePVC:    fmt.Sprintf("%s/%s", pvcNamespace, pvcName),
+				ServerDryRun: dryRunResult(cw.dryRunDeletePVC(ctx, pvcNamespace, pvcName)),
+			},
+			updateOriginal,
+			annotateStep,
+			{
+				Name:        StepScaleUpAfterRebind,
+				Description: fmt.Sprintf("Scale %s back to its original replicas", workload),
+			},
+			{Name: StepWaitReboundPVCBound, Description: fmt.Sprintf("Wait for PVC %s/%s to bind to PV %s", pvcNamespace, pvcName, local.Name)},
+			{
+				Name:        StepRestoreReclaimPolicy,
+				Description: fmt.Sprintf("Set the reclaim policy of PV %s to %s", local.Name, volume.Spec.PersistentVolumeReclaimPolicy),
+			},
+		})
+		return
+	}
+
+	provisionedAs, target := "volumeType local", "a local volume"
+	updateDescription := fmt.Sprintf("Annotate %s entry %s with volumeType local", section, volumeName)
+	if opts.StorageClass != "" {
+		provisionedAs, target = fmt.Sprintf("storageClass %s", opts.StorageClass), fmt.Sprintf("a volume of storage class %s", opts.StorageClass)
+		updateDescription = fmt.Sprintf("Set the storageClass of %s entry %s to %s", section, volumeName, opts.StorageClass)
+	}
+
+	addTemp, err := patchStep(
+		StepAddTempPVC,
+		fmt.Sprintf("Add %s entry %s with %s to %s %s", section, tempPVCKey(volumeName), provisionedAs, plan.Kind, plan.Resource),
+		volumeName, c.tempPVCEntry().patch, true,
+	)
+	if err != nil {
+		return
+	}
+
+	updateOriginal, err := patchStep(
+		StepUpdateOriginalPVC,
+		updateDescription,
+		volumeName, c.originalPVCEntry().patch, false,
+	)
+	if err != nil {
+		return
+	}
+
+	unbindTemp, err := patchStep(
+		StepUnbindTempPVC,
+		fmt.Sprintf("Remove %s entry %s", section, tempPVCKey(volumeName)),
+		tempPVCKey(volumeName), unbindTempPVCPatch, false,
+	)
+	if err != nil {
+		return
+	}
+
+	verifyJob := func(fromPVC, toPVC string) *batchv1.Job {
+		if !opts.Verify {
+			return nil
+		}
+		return withTypeMeta(VerifyJob(pvcNamespace, fromPVC, toPVC, opts.verifyImage()))
+	}
+	toTemp := withTypeMeta(opts.migrator().Job(pvcNamespace, pvcName, tempPVCName))
+	fromTemp := withTypeMeta(opts.migrator().Job(pvcNamespace, tempPVCName, pvcName))
+
+	plan.Steps = planSteps([]PlanStep{
+		{Name: StepRetainOriginalPV, Description: fmt.Sprintf("Set the reclaim policy of PV %s to Retain, keeping the original data until purged", volume.Name)},
+		addTemp,
+		{Name: StepWaitTempPVCBound, Description: fmt.Sprintf("Wait for PVC %s/%s to bind to %s", pvcNamespace, tempPVCName, target)},
+		{Name: StepWaitTempPVCPodReady, Description: fmt.Sprintf("Wait for %s pod to be ready", workload)},
+		{
+			Name:         StepScaleDownForTemp,
+			Description:  fmt.Sprintf("Scale %s to 0", workload),
+			Scale:        &PlanScale{Workload: workload.String(), Replicas: 0},
+			ServerDryRun: dryRunResult(cw.updateWorkloadScale(ctx, workload, 0, metav1.UpdateOptions{DryRun: []string{metav1.DryRunAll}})),
+		},
+		{
+			Name:         StepMigrateToTempPVC,
+			Description:  fmt.Sprintf("Migrate data from PVC %s to %s", pvcName, tempPVCName),
+			Job:          toTemp,
+			VerifyJob:    verifyJob(pvcName, tempPVCName),
+			ServerDryRun: dryRunResult(cw.dryRunCreateJob(ctx, toTemp)),
+		},
+		snapshotStep,
+		{
+			Name:         StepDeleteOriginalPVC,
+			Description:  fmt.Sprintf("Delete PVC %s/%s", pvcNamespace, pvcName),
+			DeletePVC:    fmt.Sprintf("%s/%s", pvcNamespace, pvcName),
+			ServerDryRun: dryRunResult(cw.dryRunDeletePVC(ctx, pvcNamespace, pvcName)),
+		},
+		updateOriginal,
+		{Name: StepWaitOriginalPVCBound, Description: fmt.Sprintf("Wait for PVC %s/%s to bind to %s", pvcNamespace, pvcName, target)},
+		{Name: StepWaitOriginalPodReady, Description: fmt.Sprintf("Wait for %s pod to be ready", workload)},
+		{
+			Name:        StepScaleDownForOriginal,
+			Description: fmt.Sprintf("Scale %s to 0", workload),
+			Scale:       &PlanScale{Workload: workload.String(), Replicas: 0},
+		},
+		{
+			Name:        StepMigrateToOriginalPVC,
+			Description: fmt.Sprintf("Migrate data from PVC %s to %s", tempPVCName, pvcName),
+			Job:         fromTemp,
+			VerifyJob:   verifyJob(tempPVCName, pvcName),
+		},
+		unbindTemp,
+		{
+			Name:        StepDeleteTempPVC,
+			Description: fmt.Sprintf("Delete PVC %s/%s", pvcNamespace, tempPVCName),
+			DeletePVC:   fmt.Sprintf("%s/%s", pvcNamespace, tempPVCName),
+		},
+		annotateStep,
+		{Name: StepWaitConvertedPodReady, Description: fmt.Sprintf("Wait for %s pod to be ready", workload)},
+	})
+
+	return
+}
+
+// planSteps drops the steps left empty because the options disable them.
+func planSteps(steps []PlanStep) []PlanStep {
+	return lo.Filter(steps, func(step PlanStep, _ int) bool {
+		return step.Name != ""
+	})
+}
+
+func withTypeMeta(job *batchv1.Job) *batchv1.Job {
+	job.TypeMeta = metav1.TypeMeta{APIVersion: batchv1.SchemeGroupVersion.String(), Kind: "Job"}
+	return job
+}
+
+func withPVTypeMeta(pv *corev1.PersistentVolume) *corev1.PersistentVolume {
+	pv.TypeMeta = metav1.TypeMeta{APIVersion: corev1.SchemeGroupVersion.String(), Kind: "PersistentVolume"}
+	return pv
+}
+
+func dryRunResult(err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return dryRunAccepted
+}
+
+func (cw *ClientWrapper) dryRunPatch(ctx context.Context, patcher Patcher, namespace, name string, patchType types.PatchType, payload []byte) error {
+	_, err := cw.dc.Resource(patcher.getResource()).Namespace(namespace).Patch(ctx, name, patchType, payload, metav1.PatchOptions{DryRun: []string{metav1.DryRunAll}})
+	return err
+}
+
+func (cw *ClientWrapper) dryRunCreateJob(ctx context.Context, job *batchv1.Job) error {
+	_, err := cw.cs.BatchV1().Jobs(job.Namespace).Create(ctx, job, metav1.CreateOptions{DryRun: []string{metav1.DryRunAll}})
+	if apierrors.IsNotFound(err) {
+		return errors.New(fmt.Sprintf("skipped, namespace %s is created when the conversion starts", job.Namespace))
+	}
+	return err
+}
+
+func (cw *ClientWrapper) dryRunCreatePV(ctx context.Context, pv *corev1.PersistentVolume) error {
+	_, err := cw.cs.CoreV1().PersistentVolumes().Create(ctx, pv, metav1.CreateOptions{DryRun: []string{metav1.DryRunAll}})
+	return err
+}
+
+func (cw *ClientWrapper) dryRunDeletePVC(ctx context.Context, namespace, name string) error {
+	return cw.cs.CoreV1().PersistentVolumeClaims(namespace).Delete(ctx, name, metav1.DeleteOptions{DryRun: []string{metav1.DryRunAll}})
+}
@@ -0,0 +1,19 @@
+package kube
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestPlanConversionUndeclaredPVC(t *testing.T) {
+	persistence := map[string]interface{}{"config": map[string]interface{}{"enabled": true}}
+	cluster := newFakeCluster(t, 1, []runtime.Object{fakeHelmRelease(persistence, nil)},
+		fakeHostPathVolume("other"), fakePVC("app-other", "pvc-other", false), fakeDeployment("worker", "app-other"),
+	)
+
+	_, err := cluster.cw.PlanConversion(context.Background(), "default", "app", fakeHostPathVolume("other"), HelmReleasePatcher{}, ConvertOptions{Migrator: RsyncMigrator{}})
+	require.EqualError(t, err, "persistence entry other not found on resource app")
+}
@@ -0,0 +1,494 @@
+package kube
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/samber/lo"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/version"
+)
+
+const (
+	CheckReclaimPolicy      = "reclaim-policy"
+	CheckProvisionerVersion = "provisioner-version"
+	CheckNodeFreeSpace      = "node-free-space"
+	CheckResourceReady      = "resource-ready"
+	CheckStorageClass       = "storage-class"
+	CheckPermissions        = "permissions"
+	CheckSnapshot           = "snapshot"
+)
+
+// minProvisionerVersion is the first local-path-provisioner release honouring the volumeType PVC annotation.
+var minProvisionerVersion = version.MustParseGeneric("v0.0.23")
+
+// PreflightResult is the outcome of a single pre-flight check, passed if Problem is empty.
+type PreflightResult struct {
+	Check   string `json:"check"`
+	Problem string `json:"problem,omitempty"`
+	// Warning problems are reported without stopping the conversion.
+	Warning bool `json:"warning,omitempty"`
+}
+
+func (r PreflightResult) failed() bool {
+	return r.Problem != "" && !r.Warning
+}
+
+// PreflightError reports every failed pre-flight check at once.
+type PreflightError struct {
+	Failures []PreflightResult
+}
+
+func (e *PreflightError) Error() string {
+	var sb strings.Builder
+	sb.WriteString("pre-flight checks failed, nothing was changed:")
+	for _, f := range e.Failures {
+		fmt.Fprintf(&sb, "\n  - %s: %s", f.Check, f.Problem)
+	}
+	return sb.String()
+}
+
+// Preflight checks everything converting the volume relies on before anything is changed. All checks run, even
+// after one failed, so every problem is reported together.
+func (cw *ClientWrapper) Preflight(ctx context.Context, resourceNamespace, resourceName string, volume *corev1.PersistentVolume, patcher Patcher, workload Workload, opts ConvertOptions) []PreflightResult {
+	pvcNamespace, pvcName := volume.Spec.ClaimRef.Namespace, volume.Spec.ClaimRef.Name
+
+	results := []PreflightResult{checkReclaimPolicy(volume, opts)}
+	// another storage class provisions the new volumes, neither the annotation nor the node of the data matter
+	if opts.StorageClass == "" {
+		results = append(results, cw.checkProvisionerVersion(ctx))
+		// rebinding reuses the directory, only copying needs room for more copies of the data
+		if opts.Strategy != RebindStrategy {
+			results = append(results, cw.checkNodeFreeSpace(ctx, volume))
+		}
+	}
+	results = append(results, cw.checkResourceReady(ctx, resourceNamespace, resourceName, patcher))
+	if opts.StorageClass != "" {
+		results = append(results, cw.checkTargetStorageClass(ctx, opts.StorageClass))
+	} else {
+		results = append(results, cw.checkStorageClass(ctx, pvcNamespace, pvcName))
+	}
+	results = append(results, cw.checkPermissions(ctx, resourceNamespace, pvcNamespace, patcher, workload, opts))
+	if opts.Snapshot {
+		results = append(results, cw.checkSnapshot(ctx, volume))
+	}
+	return results
+}
+
+// PreflightRaw checks everything a raw conversion of the volume relies on, the PVC of which is replaced directly
+// instead of through a chart.
+func (cw *ClientWrapper) PreflightRaw(ctx context.Context, volume *corev1.PersistentVolume, workload Workload, opts ConvertOptions) []PreflightResult {
+	pvcNamespace, pvcName := volume.Spec.ClaimRef.Namespace, volume.Spec.ClaimRef.Name
+
+	results := []PreflightResult{
+		checkReclaimPolicy(volume, opts),
+		cw.checkProvisionerVersion(ctx),
+		cw.checkNodeFreeSpace(ctx, volume),
+		cw.checkStorageClass(ctx, pvcNamespace, pvcName),
+		cw.checkRawPermissions(ctx, pvcNamespace, workload, opts),
+	}
+	if opts.Snapshot {
+		results = append(results, cw.checkSnapshot(ctx, volume))
+	}
+	return results
+}
+
+// preflightError logs the warnings and returns the failures of results, if any.
+func preflightError(results []PreflightResult) error {
+	for _, r := range results {
+		if r.Problem != "" && r.Warning {
+			log.Printf("Pre-flight warning %s: %s\n", r.Check, r.Problem)
+		}
+	}
+
+	failures := lo.Filter(results, func(r PreflightResult, _ int) bool {
+		return r.failed()
+	})
+	if len(failures) > 0 {
+		return &PreflightError{Failures: failures}
+	}
+	return nil
+}
+
+func checkReclaimPolicy(volume *corev1.PersistentVolume, opts ConvertOptions) PreflightResult {
+	result := PreflightResult{Check: CheckReclaimPolicy, Warning: true}
+	if volume.Spec.PersistentVolumeReclaimPolicy == corev1.PersistentVolumeReclaimDelete {
+		result.Problem = fmt.Sprintf("PV %s would delete its data together with PVC %s, it is switched to Retain and kept until purged with --purge-old-volumes", volume.Name, volume.Spec.ClaimRef.Name)
+		if opts.Strategy != RebindStrategy && !opts.Verify {
+			result.Problem += ", pass --verify to check the copies"
+		}
+	}
+	return result
+}
+
+func (cw *ClientWrapper) checkProvisionerVersion(ctx context.Context) PreflightResult {
+	result := PreflightResult{Check: CheckProvisionerVersion}
+
+	deployments, err := cw.cs.AppsV1().Deployments("").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		result.Problem, result.Warning = fmt.Sprintf("can not list deployments to find local-path-provisioner: %s", err.Error()), true
+		return result
+	}
+
+	var images []string
+	for _, d := range deployments.Items {
+		for _, c := range d.Spec.Template.Spec.Containers {
+			if strings.Contains(c.Image, "local-path-provisioner") {
+				images = append(images, c.Image)
+			}
+		}
+	}
+	if len(images) == 0 {
+		result.Problem, result.Warning = "no local-path-provisioner deployment found", true
+		return result
+	}
+
+	for _, image := range images {
+		tag := image[strings.LastIndex(image, ":")+1:]
+		v, err := version.ParseGeneric(tag)
+		if err != nil {
+			result.Problem, result.Warning = fmt.Sprintf("can not tell the version of image %s, volumeType needs %s or later", image, minProvisionerVersion), true
+			continue
+		}
+		if v.LessThan(minProvisionerVersion) {
+			result.Problem, result.Warning = fmt.Sprintf("image %s does not support the volumeType annotation, upgrade to %s or later", image, minProvisionerVersion), false
+			return result
+		}
+	}
+	return result
+}
+
+// nodeSummary is the part of the kubelet stats summary holding the free space of the node and the usage of the
+// volumes of its pods.
+type nodeSummary struct {
+	Node struct {
+		Fs struct {
+			AvailableBytes *uint64 `json:"availableBytes"`
+		} `json:"fs"`
+	} `json:"node"`
+	Pods []struct {
+		Volumes []struct {
+			UsedBytes *uint64 `json:"usedBytes"`
+			PVCRef    *struct {
+				Name      string `json:"name"`
+				Namespace string `json:"namespace"`
+			} `json:"pvcRef"`
+		} `json:"volume"`
+	} `json:"pods"`
+}
+
+func (cw *ClientWrapper) getNodeSummary(ctx context.Context, node string) (summary nodeSummary, err error) {
+	raw, err := cw.cs.CoreV1().RESTClient().Get().AbsPath("/api/v1/nodes", node, "proxy", "stats", "summary").DoRaw(ctx)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(raw, &summary)
+	return
+}
+
+// usedBytes returns the size of the data of the PVC, nil if the kubelet does not report it.
+func (s nodeSummary) usedBytes(namespace, pvcName string) *uint64 {
+	for _, pod := range s.Pods {
+		for _, volume := range pod.Volumes {
+			if volume.PVCRef != nil && volume.PVCRef.Namespace == namespace && volume.PVCRef.Name == pvcName && volume.UsedBytes != nil {
+				return volume.UsedBytes
+			}
+		}
+	}
+	return nil
+}
+
+// freeSpaceProblem tells whether the node lacks the room for copying the volumes side by side. The original PVs are
+// retained until they are purged, so the temp PVCs and the recreated PVCs hold the data twice more. The capacity is
+// only requested, local-path does not enforce it, so the used bytes count when the kubelet reports them.
+func (s nodeSummary) freeSpaceProblem(node string, volumes []*corev1.PersistentVolume) string {
+	var size int64
+	for _, volume := range volumes {
+		used := s.usedBytes(volume.Spec.ClaimRef.Namespace, volume.Spec.ClaimRef.Name)
+		if used != nil {
+			size += int64(*used)
+		} else {
+			size += volume.Spec.Capacity.Storage().Value()
+		}
+	}
+
+	available := resource.NewQuantity(int64(*s.Node.Fs.AvailableBytes), resource.BinarySI)
+	needed := resource.NewQuantity(2*size, resource.BinarySI)
+	if available.Cmp(*needed) >= 0 {
+		return ""
+	}
+	names := lo.Map(volumes, func(volume *corev1.PersistentVolume, _ int) string {
+		return volume.Name
+	})
+	return fmt.Sprintf("node %s has %s free, two more copies of PV %s need %s", node, available, strings.Join(names, ", "), needed)
+}
+
+// checkNodeFreeSpace checks the nodes of the volumes have room for copying them side by side.
+func (cw *ClientWrapper) checkNodeFreeSpace(ctx context.Context, volumes ...*corev1.PersistentVolume) PreflightResult {
+	result := PreflightResult{Check: CheckNodeFreeSpace}
+
+	var nodes []string
+	volumesByNode := map[string][]*corev1.PersistentVolume{}
+	for _, volume := range volumes {
+		node := volumeNode(volume)
+		if node == "" {
+			result.Problem, result.Warning = fmt.Sprintf("PV %s is not pinned to a node", volume.Name), true
+			continue
+		}
+		if _, found := volumesByNode[node]; !found {
+			nodes = append(nodes, node)
+		}
+		volumesByNode[node] = append(volumesByNode[node], volume)
+	}
+
+	for _, node := range nodes {
+		summary, err := cw.getNodeSummary(ctx, node)
+		if err == nil && summary.Node.Fs.AvailableBytes == nil {
+			err = errors.New("no free space reported")
+		}
+		if err != nil {
+			result.Problem, result.Warning = fmt.Sprintf("can not read the free space of node %s: %s", node, err.Error()), true
+			continue
+		}
+
+		problem := summary.freeSpaceProblem(node, volumesByNode[node])
+		if problem != "" {
+			result.Problem, result.Warning = problem, false
+			return result
+		}
+	}
+	return result
+}
+
+// volumeNode returns the node a local-path PV is pinned to by its node affinity.
+func volumeNode(volume *corev1.PersistentVolume) string {
+	if volume.Spec.NodeAffinity == nil || volume.Spec.NodeAffinity.Required == nil {
+		return ""
+	}
+	for _, term := range volume.Spec.NodeAffinity.Required.NodeSelectorTerms {
+		for _, expr := range term.MatchExpressions {
+			if expr.Key == corev1.LabelHostname && expr.Operator == corev1.NodeSelectorOpIn && len(expr.Values) == 1 {
+				return expr.Values[0]
+			}
+		}
+	}
+	return ""
+}
+
+// checkResourceReady refuses suspended or reconciling HelmReleases, which would not apply the patched values or
+// apply them at an unexpected time.
+func (cw *ClientWrapper) checkResourceReady(ctx context.Context, namespace, name string, patcher Patcher) PreflightResult {
+	result := PreflightResult{Check: CheckResourceReady}
+
+	chart, err := cw.GetResource(ctx, namespace, name, patcher.getResource())
+	if err != nil {
+		result.Problem = err.Error()
+		return result
+	}
+	if chart.GetKind() != "HelmRelease" {
+		return result
+	}
+
+	suspended, _, _ := unstructured.NestedBool(chart.Object, "spec", "suspend")
+	if suspended {
+		result.Problem = fmt.Sprintf("HelmRelease %s/%s is suspended", namespace, name)
+		return result
+	}
+
+	conditions, _, _ := unstructured.NestedSlice(chart.Object, "status", "conditions")
+	for _, c := range conditions {
+		condition, ok := c.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if (condition["type"] == "Reconciling" && condition["status"] == string(metav1.ConditionTrue)) ||
+			(condition["type"] == "Ready" && condition["status"] == string(metav1.ConditionUnknown)) {
+			result.Problem = fmt.Sprintf("HelmRelease %s/%s is reconciling, wait for it to finish", namespace, name)
+			return result
+		}
+	}
+	return result
+}
+
+func (cw *ClientWrapper) checkStorageClass(ctx context.Context, pvcNamespace, pvcName string) PreflightResult {
+	result := PreflightResult{Check: CheckStorageClass}
+
+	pvc, err := cw.GetPVCByName(ctx, pvcNamespace, pvcName)
+	if err != nil {
+		result.Problem = err.Error()
+		return result
+	}
+
+	if pvc.Spec.StorageClassName == nil || *pvc.Spec.StorageClassName == "" {
+		classes, err := cw.cs.StorageV1().StorageClasses().List(ctx, metav1.ListOptions{})
+		if err != nil {
+			result.Problem = err.Error()
+			return result
+		}
+		_, found := lo.Find(classes.Items, func(sc storagev1.StorageClass) bool {
+			return sc.Annotations["storageclass.kubernetes.io/is-default-class"] == "true" && sc.Provisioner == localPathProvisioner
+		})
+		if !found {
+			result.Problem = fmt.Sprintf("PVC %s has no storage class and there is no default %s storage class to provision it again", pvcName, localPathProvisioner)
+		}
+		return result
+	}
+
+	sc, err := cw.cs.StorageV1().StorageClasses().Get(ctx, *pvc.Spec.StorageClassName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		result.Problem = fmt.Sprintf("storage class %s of PVC %s does not exist", *pvc.Spec.StorageClassName, pvcName)
+		return result
+	}
+	if err != nil {
+		result.Problem = err.Error()
+		return result
+	}
+	if sc.Provisioner != localPathProvisioner {
+		result.Problem = fmt.Sprintf("storage class %s is provisioned by %s, not %s", sc.Name, sc.Provisioner, localPathProvisioner)
+	}
+	return result
+}
+
+// checkSnapshot warns when --snapshot can not snapshot the volume, so the rollback falls back to the temp PVC.
+func (cw *ClientWrapper) checkSnapshot(ctx context.Context, volume *corev1.PersistentVolume) PreflightResult {
+	result := PreflightResult{Check: CheckSnapshot, Warning: true}
+
+	_, reason, err := cw.findSnapshotClass(ctx, volume.Name)
+	if err != nil {
+		result.Problem = err.Error()
+	} else if reason != "" {
+		result.Problem = fmt.Sprintf("%s, no snapshot is taken and a rollback restores from the temp PVC", reason)
+	}
+	return result
+}
+
+// checkTargetStorageClass refuses migrating to a storage class that does not exist.
+func (cw *ClientWrapper) checkTargetStorageClass(ctx context.Context, storageClass string) PreflightResult {
+	result := PreflightResult{Check: CheckStorageClass}
+
+	_, err := cw.cs.StorageV1().StorageClasses().Get(ctx, storageClass, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		result.Problem = fmt.Sprintf("target storage class %s does not exist", storageClass)
+	} else if err != nil {
+		result.Problem = err.Error()
+	}
+	return result
+}
+
+// checkPermissions asks the API server whether the current user may perform every request of the conversion.
+func (cw *ClientWrapper) checkPermissions(ctx context.Context, resourceNamespace, pvcNamespace string, patcher Patcher, workload Workload, opts ConvertOptions) PreflightResult {
+	chart := patcher.getResource()
+	needed := []authorizationv1.ResourceAttributes{
+		{Namespace: resourceNamespace, Verb: "get", Group: chart.Group, Resource: chart.Resource},
+		{Namespace: resourceNamespace, Verb: "patch", Group: chart.Group, Resource: chart.Resource},
+	}
+	if workload.VolumeClaimTemplate != "" {
+		needed = append(needed, authorizationv1.ResourceAttributes{Namespace: workload.Namespace, Verb: "delete", Group: "apps", Resource: workload.resource()})
+	}
+	return cw.checkAccess(ctx, pvcNamespace, workload, opts, needed)
+}
+
+// checkRawPermissions asks the API server whether the current user may perform every request of a raw conversion,
+// which creates and annotates PVCs itself.
+func (cw *ClientWrapper) checkRawPermissions(ctx context.Context, pvcNamespace string, workload Workload, opts ConvertOptions) PreflightResult {
+	return cw.checkAccess(ctx, pvcNamespace, workload, opts, []authorizationv1.ResourceAttributes{
+		{Namespace: pvcNamespace, Verb: "create", Resource: "persistentvolumeclaims"},
+		{Namespace: pvcNamespace, Verb: "patch", Resource: "persistentvolumeclaims"},
+	})
+}
+
+// checkAccess asks the API server whether the current user may perform the needed requests and those every
+// conversion makes.
+func (cw *ClientWrapper) checkAccess(ctx context.Context, pvcNamespace string, workload Workload, opts ConvertOptions, needed []authorizationv1.ResourceAttributes) PreflightResult {
+	result := PreflightResult{Check: CheckPermissions}
+
+	needed = append(needed,
+		authorizationv1.ResourceAttributes{Namespace: pvcNamespace, Verb: "get", Resource: "persistentvolumeclaims"},
+		authorizationv1.ResourceAttributes{Namespace: pvcNamespace, Verb: "delete", Resource: "persistentvolumeclaims"},
+		authorizationv1.ResourceAttributes{Verb: "get", Resource: "persistentvolumes"},
+		authorizationv1.ResourceAttributes{Verb: "patch", Resource: "persistentvolumes"},
+		authorizationv1.ResourceAttributes{Namespace: pvcNamespace, Verb: "list", Resource: "pods"},
+	)
+	// a raw PVC may be mounted by a pod without a workload, which is not scaled
+	if workload.Kind != "" {
+		needed = append(needed,
+			authorizationv1.ResourceAttributes{Namespace: workload.Namespace, Verb: "get", Group: "apps", Resource: workload.resource()},
+			authorizationv1.ResourceAttributes{Namespace: workload.Namespace, Verb: "update", Group: "apps", Resource: workload.resource(), Subresource: "scale"},
+		)
+	}
+
+	if opts.Strategy == RebindStrategy {
+		needed = append(needed, authorizationv1.ResourceAttributes{Verb: "create", Resource: "persistentvolumes"})
+	} else {
+		jobNamespace := opts.migrator().Job(pvcNamespace, "", "").Namespace
+		needed = append(needed,
+			authorizationv1.ResourceAttributes{Namespace: jobNamespace, Verb: "create", Group: "batch", Resource: "jobs"},
+			authorizationv1.ResourceAttributes{Namespace: jobNamespace, Verb: "delete", Group: "batch", Resource: "jobs"},
+			authorizationv1.ResourceAttributes{Namespace: jobNamespace, Verb: "get", Resource: "pods", Subresource: "log"},
+		)
+		if opts.migrator().NeedsMigrationObjects() {
+			needed = append(needed,
+				authorizationv1.ResourceAttributes{Verb: "create", Resource: "namespaces"},
+				authorizationv1.ResourceAttributes{Verb: "delete", Resource: "namespaces"},
+				authorizationv1.ResourceAttributes{Namespace: migrationNamespace, Verb: "create", Resource: "serviceaccounts"},
+				authorizationv1.ResourceAttributes{Verb: "create", Group: "rbac.authorization.k8s.io", Resource: "clusterrolebindings"},
+				authorizationv1.ResourceAttributes{Verb: "delete", Group: "rbac.authorization.k8s.io", Resource: "clusterrolebindings"},
+			)
+		}
+	}
+
+	if opts.Velero {
+		needed = append(needed,
+			authorizationv1.ResourceAttributes{Namespace: opts.veleroNamespace(), Verb: "create", Group: VeleroBackupResource.Group, Resource: VeleroBackupResource.Resource},
+			authorizationv1.ResourceAttributes{Namespace: opts.veleroNamespace(), Verb: "get", Group: VeleroBackupResource.Group, Resource: VeleroBackupResource.Resource},
+		)
+	}
+
+	if opts.Snapshot && cw.hasSnapshotAPI() {
+		needed = append(needed, authorizationv1.ResourceAttributes{Namespace: pvcNamespace, Verb: "create", Group: VolumeSnapshotResource.Group, Resource: VolumeSnapshotResource.Resource})
+	}
+
+	var denied []string
+	for _, attributes := range needed {
+		attributes := attributes
+		review, err := cw.cs.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, &authorizationv1.SelfSubjectAccessReview{
+			Spec: authorizationv1.SelfSubjectAccessReviewSpec{ResourceAttributes: &attributes},
+		}, metav1.CreateOptions{})
+		if err != nil {
+			result.Problem, result.Warning = fmt.Sprintf("can not review access: %s", err.Error()), true
+			return result
+		}
+		if !review.Status.Allowed {
+			denied = append(denied, describeAttributes(attributes))
+		}
+	}
+
+	if len(denied) > 0 {
+		result.Problem = fmt.Sprintf("not allowed to %s", strings.Join(denied, ", "))
+	}
+	return result
+}
+
+func describeAttributes(a authorizationv1.ResourceAttributes) string {
+	resource := a.Resource
+	if a.Group != "" {
+		resource += "." + a.Group
+	}
+	if a.Subresource != "" {
+		resource += "/" + a.Subresource
+	}
+	if a.Namespace != "" {
+		return fmt.Sprintf("%s %s in %s", a.Verb, resource, a.Namespace)
+	}
+	return fmt.Sprintf("%s %s", a.Verb, resource)
+}
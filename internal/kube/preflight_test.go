@@ -0,0 +1,178 @@
+package kube
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestCheckProvisionerVersion(t *testing.T) {
+	provisioner := func(image string) *appsv1.Deployment {
+		return &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "local-path-provisioner", Namespace: "kube-system"},
+			Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "local-path-provisioner", Image: image}},
+			}}},
+		}
+	}
+
+	tests := []struct {
+		image   string
+		failed  bool
+		warning bool
+	}{
+		{image: "rancher/local-path-provisioner:v0.0.24"},
+		{image: "rancher/local-path-provisioner:v0.0.21", failed: true},
+		{image: "rancher/local-path-provisioner:master-head", warning: true},
+	}
+	for _, test := range tests {
+		t.Run(test.image, func(t *testing.T) {
+			cw := ClientWrapper{cs: fake.NewSimpleClientset(provisioner(test.image))}
+			result := cw.checkProvisionerVersion(context.Background())
+			assert.Equal(t, test.failed, result.failed(), result.Problem)
+			assert.Equal(t, test.warning, result.Warning, result.Problem)
+		})
+	}
+}
+
+func TestCheckStorageClass(t *testing.T) {
+	pvc := func(name, storageClass string) *corev1.PersistentVolumeClaim {
+		return &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec:       corev1.PersistentVolumeClaimSpec{StorageClassName: &storageClass},
+		}
+	}
+	cw := ClientWrapper{cs: fake.NewSimpleClientset(
+		&storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: "local-path"}, Provisioner: localPathProvisioner},
+		&storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: "nfs"}, Provisioner: "nfs.csi.k8s.io"},
+		pvc("app-config", "local-path"),
+		pvc("app-data", "local-path-retain"),
+		pvc("app-cache", "nfs"),
+	)}
+
+	assert.Empty(t, cw.checkStorageClass(context.Background(), "default", "app-config").Problem)
+	assert.Contains(t, cw.checkStorageClass(context.Background(), "default", "app-data").Problem, "does not exist")
+	assert.Contains(t, cw.checkStorageClass(context.Background(), "default", "app-cache").Problem, "nfs.csi.k8s.io")
+}
+
+func TestCheckTargetStorageClass(t *testing.T) {
+	cw := ClientWrapper{cs: fake.NewSimpleClientset(
+		&storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: "nfs"}, Provisioner: "nfs.csi.k8s.io"},
+	)}
+
+	assert.Empty(t, cw.checkTargetStorageClass(context.Background(), "nfs").Problem)
+	assert.Contains(t, cw.checkTargetStorageClass(context.Background(), "longhorn").Problem, "does not exist")
+}
+
+func TestCheckPermissions(t *testing.T) {
+	cs := fake.NewSimpleClientset()
+	cs.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+		attributes := review.Spec.ResourceAttributes
+		review.Status.Allowed = !(attributes.Verb == "delete" && attributes.Resource == "persistentvolumeclaims")
+		return true, review, nil
+	})
+	cw := ClientWrapper{cs: cs}
+
+	patcher, err := NewPatcher("HelmRelease")
+	require.NoError(t, err)
+	workload := Workload{Kind: DeploymentKind, Namespace: "default", Name: "app"}
+
+	result := cw.checkPermissions(context.Background(), "flux-system", "default", patcher, workload, ConvertOptions{Migrator: RsyncMigrator{}})
+	assert.True(t, result.failed())
+	assert.Equal(t, "not allowed to delete persistentvolumeclaims in default", result.Problem)
+
+	err = preflightError([]PreflightResult{result, {Check: CheckReclaimPolicy, Problem: "deleted", Warning: true}})
+	var preflight *PreflightError
+	require.ErrorAs(t, err, &preflight)
+	assert.Equal(t, []PreflightResult{result}, preflight.Failures)
+}
+
+func TestResumeRawConversionRunsPreflight(t *testing.T) {
+	storageClass := "local-path"
+	cs := fake.NewSimpleClientset(
+		&corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: "data", Namespace: "default"},
+			Spec:       corev1.PersistentVolumeClaimSpec{VolumeName: "pvc-data", StorageClassName: &storageClass},
+		},
+		&corev1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "pvc-data"},
+			Spec: corev1.PersistentVolumeSpec{
+				PersistentVolumeReclaimPolicy: corev1.PersistentVolumeReclaimDelete,
+				PersistentVolumeSource: corev1.PersistentVolumeSource{
+					HostPath: &corev1.HostPathVolumeSource{Path: "/var/lib/rancher/k3s/storage/pvc-data"},
+				},
+				ClaimRef: &corev1.ObjectReference{Namespace: "default", Name: "data"},
+			},
+		},
+	)
+	cw := ClientWrapper{cs: cs}
+	ctx := context.Background()
+
+	err := ResumeRawConversion(ctx, cw, "default", "data", ConvertOptions{Migrator: RsyncMigrator{}})
+	var preflight *PreflightError
+	require.ErrorAs(t, err, &preflight)
+	checks := lo.Map(preflight.Failures, func(r PreflightResult, _ int) string {
+		return r.Check
+	})
+	assert.Equal(t, []string{CheckStorageClass}, checks)
+
+	// nothing was changed
+	_, err = cw.GetPVCByName(ctx, "default", rawTempPVCName("data"))
+	assert.True(t, apierrors.IsNotFound(err))
+}
+
+func TestFreeSpaceProblem(t *testing.T) {
+	volume := func(pvc, capacity string) *corev1.PersistentVolume {
+		return &corev1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: "pvc-" + pvc}, Spec: corev1.PersistentVolumeSpec{
+			ClaimRef: &corev1.ObjectReference{Namespace: "default", Name: pvc},
+			Capacity: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse(capacity)},
+		}}
+	}
+	// 10Gi free, large holds 1Gi, grown 6Gi, config and data 3Gi each
+	var summary nodeSummary
+	err := json.Unmarshal([]byte(`{
+		"node": {"fs": {"availableBytes": 10737418240}},
+		"pods": [
+			{"volume": [{"usedBytes": 1073741824, "pvcRef": {"name": "large", "namespace": "default"}}]},
+			{"volume": [{"usedBytes": 6442450944, "pvcRef": {"name": "grown", "namespace": "default"}}]},
+			{"volume": [
+				{"usedBytes": 3221225472, "pvcRef": {"name": "config", "namespace": "default"}},
+				{"usedBytes": 3221225472, "pvcRef": {"name": "data", "namespace": "default"}}
+			]}
+		]
+	}`), &summary)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		volumes  []*corev1.PersistentVolume
+		expected string
+	}{
+		{name: "large request with little data", volumes: []*corev1.PersistentVolume{volume("large", "100Gi")}},
+		{name: "data grown past the request", volumes: []*corev1.PersistentVolume{volume("grown", "1Gi")}, expected: "node node-1 has 10Gi free, two more copies of PV pvc-grown need 12Gi"},
+		{name: "unknown usage fits", volumes: []*corev1.PersistentVolume{volume("cache", "5Gi")}},
+		{name: "unknown usage does not fit", volumes: []*corev1.PersistentVolume{volume("cache", "6Gi")}, expected: "node node-1 has 10Gi free, two more copies of PV pvc-cache need 12Gi"},
+		{name: "single volume of a group", volumes: []*corev1.PersistentVolume{volume("config", "1Gi")}},
+		{name: "group", volumes: []*corev1.PersistentVolume{volume("config", "1Gi"), volume("data", "1Gi")}, expected: "node node-1 has 10Gi free, two more copies of PV pvc-config, pvc-data need 12Gi"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, summary.freeSpaceProblem("node-1", test.volumes))
+		})
+	}
+}
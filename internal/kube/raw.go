@@ -0,0 +1,426 @@
+package kube
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	StepRawCreateTempPVC        = "raw-create-temp-pvc"
+	StepRawRetainOriginalPV     = "raw-retain-original-pv"
+	StepRawScaleDown            = "raw-scale-down"
+	StepRawMigrateToTempPVC     = "raw-migrate-to-temp-pvc"
+	StepRawDeleteOriginalPVC    = "raw-delete-original-pvc"
+	StepRawRecreateOriginalPVC  = "raw-recreate-original-pvc"
+	StepRawMigrateToOriginalPVC = "raw-migrate-to-original-pvc"
+	StepRawScaleUp              = "raw-scale-up"
+	StepRawDeleteTempPVC        = "raw-delete-temp-pvc"
+
+	localPathProvisioner = "rancher.io/local-path"
+	rawCheckpointKey     = "local-path-provisioner-volume-converter/checkpoint"
+)
+
+// rawConversionSteps replace the PVC through the core API. Nothing mounts the temp PVC, so it binds when the
+// migration job first uses it.
+var rawConversionSteps = []conversionStep{
+	{
+		name: StepRawCreateTempPVC,
+		run: func(ctx context.Context, c *conversion) error {
+			return ignoreAlreadyExists(c.cw.CreatePVC(ctx, localClaim(c.tempPVCName, c.checkpoint.Claim, false)))
+		},
+	},
+	{
+		// the checkpoint of a raw conversion lives on the temp PVC, so nothing can change before it exists
+		name: StepRawRetainOriginalPV,
+		run: func(ctx context.Context, c *conversion) error {
+			return c.cw.retainPV(ctx, c.pvName, CopyStrategy)
+		},
+	},
+	{
+		name: StepRawScaleDown,
+		run: func(ctx context.Context, c *conversion) error {
+			if c.workload.Kind == "" {
+				return nil
+			}
+			return c.cw.ScaleWorkload(ctx, c.workload, 0)
+		},
+	},
+	{
+		name: StepRawMigrateToTempPVC,
+		run: func(ctx context.Context, c *conversion) error {
+			err := c.migrate(ctx, c.pvcName, c.tempPVCName)
+			if err != nil {
+				return err
+			}
+			return WaitFor(ctx, c.opts.BindTimeout, c.cw.IsPVCBound(c.pvcNamespace, c.tempPVCName))
+		},
+	},
+	snapshotStep(StepRawSnapshotOriginalPVC),
+	{
+		name: StepRawDeleteOriginalPVC,
+		run: func(ctx context.Context, c *conversion) error {
+			err := ignoreNotFound(c.cw.DeletePVC(ctx, c.pvcNamespace, c.pvcName))
+			if err != nil {
+				return err
+			}
+			return WaitFor(ctx, 0, c.cw.IsPVCDeleted(c.pvcNamespace, c.pvcName))
+		},
+	},
+	{
+		name: StepRawRecreateOriginalPVC,
+		run: func(ctx context.Context, c *conversion) error {
+			return ignoreAlreadyExists(c.cw.CreatePVC(ctx, localClaim(c.pvcName, c.checkpoint.Claim, true)))
+		},
+	},
+	{
+		name: StepRawMigrateToOriginalPVC,
+		run: func(ctx context.Context, c *conversion) error {
+			err := c.migrate(ctx, c.tempPVCName, c.pvcName)
+			if err != nil {
+				return err
+			}
+			return WaitFor(ctx, c.opts.BindTimeout, c.cw.IsPVCBound(c.pvcNamespace, c.pvcName))
+		},
+	},
+	{
+		name: StepRawScaleUp,
+		run: func(ctx context.Context, c *conversion) error {
+			if c.workload.Kind == "" || c.checkpoint.Replicas == nil {
+				return nil
+			}
+			return c.cw.ScaleWorkload(ctx, c.workload, int(*c.checkpoint.Replicas))
+		},
+	},
+	{
+		name: StepRawDeleteTempPVC,
+		run: func(ctx context.Context, c *conversion) error {
+			return ignoreNotFound(c.cw.DeletePVC(ctx, c.pvcNamespace, c.tempPVCName))
+		},
+	},
+}
+
+func rawTempPVCName(pvcName string) string {
+	return tempPVCKey(pvcName)
+}
+
+// originalClaim keeps what is needed to recreate pvc, dropping the binding state.
+func originalClaim(pvc *corev1.PersistentVolumeClaim) *corev1.PersistentVolumeClaim {
+	annotations := map[string]string{}
+	for k, v := range pvc.Annotations {
+		if strings.HasPrefix(k, "pv.kubernetes.io/") || strings.HasPrefix(k, "volume.kubernetes.io/") ||
+			strings.HasPrefix(k, "volume.beta.kubernetes.io/") || k == corev1.LastAppliedConfigAnnotation {
+			continue
+		}
+		annotations[k] = v
+	}
+
+	spec := *pvc.Spec.DeepCopy()
+	spec.VolumeName = ""
+
+	return &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        pvc.Name,
+			Namespace:   pvc.Namespace,
+			Labels:      pvc.Labels,
+			Annotations: annotations,
+		},
+		Spec: spec,
+	}
+}
+
+// localClaim returns a claim named name for a local volume with the spec of original. The replacement keeps the
+// metadata of the original, the temp PVC only its spec.
+func localClaim(name string, original *corev1.PersistentVolumeClaim, keepMetadata bool) *corev1.PersistentVolumeClaim {
+	claim := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   original.Namespace,
+			Annotations: map[string]string{},
+		},
+		Spec: *original.Spec.DeepCopy(),
+	}
+
+	if keepMetadata {
+		claim.Labels = original.Labels
+		for k, v := range original.Annotations {
+			claim.Annotations[k] = v
+		}
+	}
+	claim.Annotations["volumeType"] = "local"
+
+	return claim
+}
+
+func ignoreAlreadyExists(err error) error {
+	if apierrors.IsAlreadyExists(err) {
+		return nil
+	}
+	return err
+}
+
+func (cw *ClientWrapper) CreatePVC(ctx context.Context, pvc *corev1.PersistentVolumeClaim) error {
+	_, err := cw.cs.CoreV1().PersistentVolumeClaims(pvc.Namespace).Create(ctx, pvc, metav1.CreateOptions{})
+	if err == nil {
+		log.Println("PVC", pvc.Name, "created")
+	}
+	return err
+}
+
+// GetRawHostPathVolumes returns every bound host path volume provisioned by the local-path-provisioner whose PVC
+// is not declared by a HelmRelease or HelmChart.
+func (cw *ClientWrapper) GetRawHostPathVolumes(ctx context.Context) ([]*corev1.PersistentVolume, error) {
+	resources, err := cw.GetAllHostPathVolumes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	declared := map[string]bool{}
+	for _, r := range resources {
+		for _, v := range r.Volumes {
+			declared[v.Name] = true
+		}
+	}
+
+	pvs, err := cw.cs.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	var volumes []*corev1.PersistentVolume
+	for i := range pvs.Items {
+		pv := &pvs.Items[i]
+		if pv.Spec.HostPath == nil || pv.Spec.ClaimRef == nil || pv.Status.Phase != corev1.VolumeBound {
+			continue
+		}
+		if declared[pv.Name] || pv.Annotations["pv.kubernetes.io/provisioned-by"] != localPathProvisioner {
+			continue
+		}
+		volumes = append(volumes, pv)
+	}
+
+	return volumes, nil
+}
+
+// GetRawHostPathVolume resolves the local-path host path PV bound to the PVC.
+func (cw *ClientWrapper) GetRawHostPathVolume(ctx context.Context, pvcNamespace, pvcName string) (*corev1.PersistentVolume, error) {
+	pvc, err := cw.GetPVCByName(ctx, pvcNamespace, pvcName)
+	if err != nil {
+		return nil, err
+	}
+
+	pv, err := cw.GetPVByName(ctx, pvc.Spec.VolumeName)
+	if err != nil {
+		return nil, err
+	}
+
+	if pv.Spec.PersistentVolumeSource.HostPath == nil {
+		return nil, errors.New(fmt.Sprintf("PVC %s is not bound to a host path volume", pvcName))
+	}
+
+	return pv, nil
+}
+
+// GetRawCheckpoint returns the checkpoint of a raw conversion of pvcName, stored on its temp PVC.
+func (cw *ClientWrapper) GetRawCheckpoint(ctx context.Context, pvcNamespace, pvcName string) (checkpoint Checkpoint, found bool, err error) {
+	pvc, err := cw.GetPVCByName(ctx, pvcNamespace, rawTempPVCName(pvcName))
+	if err != nil {
+		return checkpoint, false, ignoreNotFound(err)
+	}
+
+	value, found := pvc.Annotations[rawCheckpointKey]
+	if !found {
+		return
+	}
+
+	err = json.Unmarshal([]byte(value), &checkpoint)
+	return
+}
+
+func (cw *ClientWrapper) setPVCCheckpoint(ctx context.Context, namespace, name string, checkpoint Checkpoint) error {
+	value, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{
+				rawCheckpointKey: string(value),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = cw.cs.CoreV1().PersistentVolumeClaims(namespace).Patch(ctx, name, types.MergePatchType, payload, metav1.PatchOptions{})
+	// the temp PVC, and the checkpoint with it, is gone after the last step
+	return ignoreNotFound(err)
+}
+
+func newRawConversion(cw ClientWrapper, opts ConvertOptions, workload Workload, pvcName, pvcNamespace, volumeSize string) *conversion {
+	return &conversion{
+		cw:           cw,
+		opts:         opts,
+		raw:          true,
+		pvcName:      pvcName,
+		pvcNamespace: pvcNamespace,
+		workload:     workload,
+		volumeName:   pvcName,
+		volumeSize:   volumeSize,
+		tempPVCName:  rawTempPVCName(pvcName),
+	}
+}
+
+// ConvertRawVolume converts a host path volume whose PVC is not declared by a chart, replacing the PVC directly.
+// If an earlier conversion left a checkpoint on the temp PVC, the conversion resumes after the last completed step.
+func ConvertRawVolume(ctx context.Context, cw ClientWrapper, volume *corev1.PersistentVolume, opts ConvertOptions) error {
+	return ResumeRawConversion(ctx, cw, volume.Spec.ClaimRef.Namespace, volume.Spec.ClaimRef.Name, opts)
+}
+
+// ResumeRawConversion converts or continues converting the PVC, for when the original host path volume no longer
+// exists to start ConvertRawVolume from.
+func ResumeRawConversion(ctx context.Context, cw ClientWrapper, pvcNamespace, pvcName string, opts ConvertOptions) error {
+	if opts.Strategy == RebindStrategy {
+		return errors.New("the rebind strategy is not supported for raw conversions")
+	}
+	if opts.StorageClass != "" {
+		return errors.New("migrating to a storage class is not supported for raw conversions")
+	}
+
+	checkpoint, found, err := cw.GetRawCheckpoint(ctx, pvcNamespace, pvcName)
+	if err != nil {
+		return err
+	}
+	if found {
+		c := newRawConversion(cw, opts, checkpoint.Workload, pvcName, pvcNamespace, checkpoint.Size)
+		c.pvName = checkpoint.PV
+		return c.run(ctx, checkpoint)
+	}
+
+	volume, err := cw.GetRawHostPathVolume(ctx, pvcNamespace, pvcName)
+	if err != nil {
+		return err
+	}
+
+	workload, err := cw.GetPVCConsumer(ctx, pvcNamespace, pvcName)
+	if err != nil {
+		return err
+	}
+
+	if !opts.SkipPreflight {
+		err = preflightError(cw.PreflightRaw(ctx, volume, workload, opts))
+		if err != nil {
+			return err
+		}
+	}
+
+	size := volume.Spec.Capacity.Storage().String()
+	checkpoint = Checkpoint{PVC: pvcName, PVCNamespace: pvcNamespace, Size: size, Workload: workload, PV: volume.Name}
+	c := newRawConversion(cw, opts, workload, pvcName, pvcNamespace, size)
+	c.pvName = volume.Name
+	return c.run(ctx, checkpoint)
+}
+
+// rollbackRaw returns the PVC to its original host path volume. Until the original PVC is deleted only the temp
+// PVC has to go, afterwards the original is recreated and the data copied back from the temp PVC.
+func (c *conversion) rollbackRaw(ctx context.Context, failedStep string, checkpoint Checkpoint) (report RollbackReport, err error) {
+	report.FailedStep = failedStep
+
+	failed := c.stepIndex(failedStep)
+	if failed > c.stepIndex(StepRawMigrateToOriginalPVC) {
+		report.State = fmt.Sprintf("PVC %s already holds the converted data, rerun the conversion to finish the cleanup", c.pvcName)
+		return
+	}
+	if checkpoint.Claim == nil {
+		err = errors.New(fmt.Sprintf("original claim of %s was not recorded, can not roll back", c.pvcName))
+		return
+	}
+
+	originalKept := true
+	if failed >= c.stepIndex(StepRawDeleteOriginalPVC) {
+		var pvc *corev1.PersistentVolumeClaim
+		pvc, err = c.cw.GetPVCByName(ctx, c.pvcNamespace, c.pvcName)
+		originalExists := err == nil
+		err = ignoreNotFound(err)
+		if err != nil {
+			return
+		}
+
+		recreated := originalExists && pvc.Annotations["volumeType"] == "local"
+		originalKept = originalExists && !recreated
+		if recreated {
+			err = report.do(fmt.Sprintf("delete recreated PVC %s", c.pvcName), func() error {
+				err := ignoreNotFound(c.cw.DeletePVC(ctx, c.pvcNamespace, c.pvcName))
+				if err != nil {
+					return err
+				}
+				return WaitFor(ctx, 0, c.cw.IsPVCDeleted(c.pvcNamespace, c.pvcName))
+			})
+			if err != nil {
+				return
+			}
+		}
+
+		if !originalExists || recreated {
+			source := c.tempPVCName
+			if checkpoint.Snapshot != nil {
+				source = fmt.Sprintf("VolumeSnapshot %s", checkpoint.Snapshot.Name)
+			}
+			err = report.do(fmt.Sprintf("recreate host path PVC %s and copy data back from %s", c.pvcName, source), func() error {
+				err := c.cw.CreatePVC(ctx, checkpoint.Claim)
+				if err != nil {
+					return err
+				}
+				err = c.migrateBack(ctx, checkpoint)
+				if err != nil {
+					return err
+				}
+				return WaitFor(ctx, c.opts.BindTimeout, c.cw.IsHostPathPVCBound(c.pvcNamespace, c.pvcName))
+			})
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	// the original PV stays bound to the original PVC, retaining it would let a purge remove it once the PVC is gone
+	if originalKept && checkpoint.ReclaimPolicy != "" {
+		err = report.do(fmt.Sprintf("restore reclaim policy %s of PV %s", checkpoint.ReclaimPolicy, c.pvName), func() error {
+			return c.cw.restoreReclaimPolicy(ctx, c.pvName, checkpoint.ReclaimPolicy)
+		})
+		if err != nil {
+			return
+		}
+	}
+
+	replicas := "nothing"
+	if c.workload.Kind != "" && checkpoint.Replicas != nil {
+		replicas = fmt.Sprintf("%s at %d replicas", c.workload, *checkpoint.Replicas)
+		err = report.do(fmt.Sprintf("scale %s to %d", c.workload, *checkpoint.Replicas), func() error {
+			return c.cw.ScaleWorkload(ctx, c.workload, int(*checkpoint.Replicas))
+		})
+		if err != nil {
+			return
+		}
+	}
+
+	err = report.do(fmt.Sprintf("delete PVC %s", c.tempPVCName), func() error {
+		return ignoreNotFound(c.cw.DeletePVC(ctx, c.pvcNamespace, c.tempPVCName))
+	})
+	if err != nil {
+		return
+	}
+
+	report.Restored = true
+	report.State = fmt.Sprintf("PVC %s is bound to a host path volume, no temp PVC exists and it is mounted by %s", c.pvcName, replicas)
+	return
+}
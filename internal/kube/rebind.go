@@ -0,0 +1,289 @@
+package kube
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	CopyStrategy   = "copy"
+	RebindStrategy = "rebind"
+
+	StepRetainHostPathPV     = "retain-host-path-pv"
+	StepScaleDownForRebind   = "scale-down-for-rebind"
+	StepCreateLocalPV        = "create-local-pv"
+	StepDeleteHostPathPVC    = "delete-host-path-pvc"
+	StepUpdatePVCForRebind   = "update-pvc-for-rebind"
+	StepScaleUpAfterRebind   = "scale-up-after-rebind"
+	StepWaitReboundPVCBound  = "wait-rebound-pvc-bound"
+	StepRestoreReclaimPolicy = "restore-reclaim-policy"
+)
+
+// rebindConversionSteps convert without copying any data. The directory of the host path PV is already on the
+// node, so a local PV pointing at the same path and pinned to the same node is pre-bound to the PVC, which is then
+// recreated to bind to it. Both PVs are retained while they share the directory, so deleting either can not remove
+// the data.
+var rebindConversionSteps = []conversionStep{
+	{
+		name: StepRetainHostPathPV,
+		run: func(ctx context.Context, c *conversion) error {
+			return c.cw.retainPV(ctx, c.pvName, RebindStrategy)
+		},
+	},
+	{
+		name:     StepScaleDownForRebind,
+		workload: true,
+		run: func(ctx context.Context, c *conversion) error {
+			return c.cw.ScaleWorkload(ctx, c.workload, 0)
+		},
+	},
+	{
+		name: StepCreateLocalPV,
+		run: func(ctx context.Context, c *conversion) error {
+			hostPath, err := c.cw.GetPVByName(ctx, c.pvName)
+			if err != nil {
+				return err
+			}
+			local, err := localVolume(hostPath, c.pvcNamespace, c.pvcName)
+			if err != nil {
+				return err
+			}
+			return ignoreAlreadyExists(c.cw.CreatePV(ctx, local))
+		},
+	},
+	{
+		name: StepDeleteHostPathPVC,
+		run: func(ctx context.Context, c *conversion) error {
+			err := ignoreNotFound(c.cw.DeletePVC(ctx, c.pvcNamespace, c.pvcName))
+			if err != nil {
+				return err
+			}
+			return WaitFor(ctx, 0, c.cw.IsPVCDeleted(c.pvcNamespace, c.pvcName))
+		},
+	},
+	patchStep(StepUpdatePVCForRebind, func(c *conversion) entryPatch {
+		return updateOriginalPVCEntry(c.volumeName)
+	}),
+	annotateBackupVolumesStep,
+	{
+		name:     StepScaleUpAfterRebind,
+		workload: true,
+		run: func(ctx context.Context, c *conversion) error {
+			if c.checkpoint.Replicas == nil {
+				return nil
+			}
+			return c.cw.ScaleWorkload(ctx, c.workload, int(*c.checkpoint.Replicas))
+		},
+	},
+	{
+		name: StepWaitReboundPVCBound,
+		run: func(ctx context.Context, c *conversion) error {
+			return WaitFor(ctx, c.opts.BindTimeout, c.cw.IsPVCBound(c.pvcNamespace, c.pvcName))
+		},
+	},
+	{
+		name: StepRestoreReclaimPolicy,
+		run: func(ctx context.Context, c *conversion) error {
+			if c.checkpoint.ReclaimPolicy == "" {
+				return nil
+			}
+			err := c.cw.setReclaimPolicy(ctx, localPVName(c.pvName), c.checkpoint.ReclaimPolicy)
+			if err != nil {
+				return err
+			}
+			log.Printf("Host path PV %s is retained and points at the data of %s now, remove it with \"convert --purge-old-volumes\" or delete it without changing its reclaim policy\n", c.pvName, localPVName(c.pvName))
+			return nil
+		},
+	},
+}
+
+func localPVName(hostPathPVName string) string {
+	return hostPathPVName + "-local"
+}
+
+// localVolume returns a local PV for the directory of the host path PV, pre-bound to the PVC. It is created
+// retained, the original reclaim policy is only restored once the host path PV no longer claims the directory.
+func localVolume(hostPath *corev1.PersistentVolume, pvcNamespace, pvcName string) (*corev1.PersistentVolume, error) {
+	if hostPath.Spec.HostPath == nil {
+		return nil, errors.New(fmt.Sprintf("PV %s is not a host path volume", hostPath.Name))
+	}
+	if hostPath.Spec.NodeAffinity == nil {
+		return nil, errors.New(fmt.Sprintf("PV %s has no node affinity to pin the local volume to", hostPath.Name))
+	}
+
+	annotations := map[string]string{}
+	for k, v := range hostPath.Annotations {
+		if k != "pv.kubernetes.io/bound-by-controller" {
+			annotations[k] = v
+		}
+	}
+
+	return &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        localPVName(hostPath.Name),
+			Labels:      hostPath.Labels,
+			Annotations: annotations,
+		},
+		Spec: corev1.PersistentVolumeSpec{
+			Capacity:                      hostPath.Spec.Capacity,
+			AccessModes:                   hostPath.Spec.AccessModes,
+			VolumeMode:                    hostPath.Spec.VolumeMode,
+			StorageClassName:              hostPath.Spec.StorageClassName,
+			MountOptions:                  hostPath.Spec.MountOptions,
+			NodeAffinity:                  hostPath.Spec.NodeAffinity,
+			PersistentVolumeReclaimPolicy: corev1.PersistentVolumeReclaimRetain,
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				Local: &corev1.LocalVolumeSource{Path: hostPath.Spec.HostPath.Path},
+			},
+			ClaimRef: &corev1.ObjectReference{Namespace: pvcNamespace, Name: pvcName},
+		},
+	}, nil
+}
+
+func (cw *ClientWrapper) CreatePV(ctx context.Context, pv *corev1.PersistentVolume) error {
+	_, err := cw.cs.CoreV1().PersistentVolumes().Create(ctx, pv, metav1.CreateOptions{})
+	if err == nil {
+		log.Println("PV", pv.Name, "created")
+	}
+	return err
+}
+
+func (cw *ClientWrapper) DeletePV(ctx context.Context, name string) error {
+	err := cw.cs.CoreV1().PersistentVolumes().Delete(ctx, name, metav1.DeleteOptions{})
+	if err == nil {
+		log.Println("PV", name, "deleted")
+	}
+	return err
+}
+
+func (cw *ClientWrapper) setReclaimPolicy(ctx context.Context, pvName string, policy corev1.PersistentVolumeReclaimPolicy) error {
+	return cw.patchPV(ctx, pvName, map[string]interface{}{
+		"spec": map[string]interface{}{"persistentVolumeReclaimPolicy": policy},
+	})
+}
+
+// prebindPV makes a released PV available to a new PVC of the same name again.
+func (cw *ClientWrapper) prebindPV(ctx context.Context, pvName, pvcNamespace, pvcName string) error {
+	return cw.patchPV(ctx, pvName, map[string]interface{}{
+		"spec": map[string]interface{}{
+			"claimRef": map[string]interface{}{
+				"namespace":       pvcNamespace,
+				"name":            pvcName,
+				"uid":             nil,
+				"resourceVersion": nil,
+			},
+		},
+	})
+}
+
+func (cw *ClientWrapper) patchPV(ctx context.Context, name string, patch map[string]interface{}) error {
+	payload, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+
+	_, err = cw.cs.CoreV1().PersistentVolumes().Patch(ctx, name, types.MergePatchType, payload, metav1.PatchOptions{})
+	return err
+}
+
+// rollbackRebind binds the PVC to its host path PV again. Until the PVC is deleted only the local PV has to go,
+// afterwards the host path PV is pre-bound to the PVC and the chart values restored so the release recreates it.
+func (c *conversion) rollbackRebind(ctx context.Context, failedStep string, checkpoint Checkpoint) (report RollbackReport, err error) {
+	report.FailedStep = failedStep
+
+	failed := c.stepIndex(failedStep)
+	if failed >= c.stepIndex(StepRestoreReclaimPolicy) {
+		report.State = fmt.Sprintf("PVC %s is bound to the local PV %s, rerun the conversion to restore its reclaim policy", c.pvcName, localPVName(c.pvName))
+		return
+	}
+	if checkpoint.Persistence == nil {
+		err = errors.New(fmt.Sprintf("original persistence values of %s were not recorded, can not roll back", c.volumeName))
+		return
+	}
+
+	if c.opts.Velero && failed > c.stepIndex(StepAnnotateBackupVolumes) {
+		err = report.do(fmt.Sprintf("remove %s from the Velero backup volumes", c.volumeName), func() error {
+			return c.cw.RemoveBackupVolume(ctx, c.patcher, c.resourceNamespace, c.resourceName, c.volumeName)
+		})
+		if err != nil {
+			return
+		}
+	}
+
+	pvcDeleted := failed >= c.stepIndex(StepDeleteHostPathPVC)
+	if pvcDeleted {
+		err = report.do(fmt.Sprintf("scale %s to 0", c.workload), func() error {
+			return c.cw.ScaleWorkload(ctx, c.workload, 0)
+		})
+		if err != nil {
+			return
+		}
+
+		err = report.do(fmt.Sprintf("delete PVC %s", c.pvcName), func() error {
+			err := ignoreNotFound(c.cw.DeletePVC(ctx, c.pvcNamespace, c.pvcName))
+			if err != nil {
+				return err
+			}
+			return WaitFor(ctx, 0, c.cw.IsPVCDeleted(c.pvcNamespace, c.pvcName))
+		})
+		if err != nil {
+			return
+		}
+	}
+
+	// the local PV is retained until the last step, deleting it leaves the directory alone
+	err = report.do(fmt.Sprintf("delete local PV %s", localPVName(c.pvName)), func() error {
+		return ignoreNotFound(c.cw.DeletePV(ctx, localPVName(c.pvName)))
+	})
+	if err != nil {
+		return
+	}
+
+	if pvcDeleted {
+		err = report.do(fmt.Sprintf("rebind PVC %s to host path PV %s", c.pvcName, c.pvName), func() error {
+			err := c.cw.prebindPV(ctx, c.pvName, c.pvcNamespace, c.pvcName)
+			if err != nil {
+				return err
+			}
+			err = c.cw.RestorePersistence(ctx, c.patcher, c.resourceNamespace, c.resourceName, c.workload, c.volumeName, checkpoint.Persistence)
+			if err != nil {
+				return err
+			}
+			return WaitFor(ctx, c.opts.BindTimeout, c.cw.IsHostPathPVCBound(c.pvcNamespace, c.pvcName))
+		})
+		if err != nil {
+			return
+		}
+	}
+
+	if checkpoint.ReclaimPolicy != "" {
+		err = report.do(fmt.Sprintf("restore reclaim policy %s of PV %s", checkpoint.ReclaimPolicy, c.pvName), func() error {
+			return c.cw.restoreReclaimPolicy(ctx, c.pvName, checkpoint.ReclaimPolicy)
+		})
+		if err != nil {
+			return
+		}
+	}
+
+	replicas := "nothing"
+	if checkpoint.Replicas != nil {
+		replicas = fmt.Sprintf("%s at %d replicas", c.workload, *checkpoint.Replicas)
+		err = report.do(fmt.Sprintf("scale %s to %d", c.workload, *checkpoint.Replicas), func() error {
+			return c.cw.ScaleWorkload(ctx, c.workload, int(*checkpoint.Replicas))
+		})
+		if err != nil {
+			return
+		}
+	}
+
+	report.Restored = true
+	report.State = fmt.Sprintf("PVC %s is bound to host path PV %s and mounted by %s", c.pvcName, c.pvName, replicas)
+	return
+}
@@ -0,0 +1,51 @@
+package kube
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestLocalVolume(t *testing.T) {
+	affinity := &corev1.VolumeNodeAffinity{Required: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{{
+		MatchExpressions: []corev1.NodeSelectorRequirement{{Key: "kubernetes.io/hostname", Operator: corev1.NodeSelectorOpIn, Values: []string{"node-1"}}},
+	}}}}
+	hostPath := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "pvc-1234",
+			Annotations: map[string]string{
+				"local.path.provisioner/selected-node": "node-1",
+				"pv.kubernetes.io/bound-by-controller": "yes",
+			},
+		},
+		Spec: corev1.PersistentVolumeSpec{
+			Capacity:                      corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("1Gi")},
+			AccessModes:                   []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			StorageClassName:              "local-path",
+			NodeAffinity:                  affinity,
+			PersistentVolumeReclaimPolicy: corev1.PersistentVolumeReclaimDelete,
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				HostPath: &corev1.HostPathVolumeSource{Path: "/var/lib/rancher/k3s/storage/pvc-1234_default_app-config"},
+			},
+			ClaimRef: &corev1.ObjectReference{Namespace: "default", Name: "app-config", UID: "1234"},
+		},
+	}
+
+	local, err := localVolume(hostPath, "default", "app-config")
+	require.NoError(t, err)
+	assert.Equal(t, "pvc-1234-local", local.Name)
+	assert.Equal(t, "/var/lib/rancher/k3s/storage/pvc-1234_default_app-config", local.Spec.Local.Path)
+	assert.Nil(t, local.Spec.HostPath)
+	assert.Equal(t, affinity, local.Spec.NodeAffinity)
+	assert.Equal(t, corev1.PersistentVolumeReclaimRetain, local.Spec.PersistentVolumeReclaimPolicy)
+	assert.Equal(t, &corev1.ObjectReference{Namespace: "default", Name: "app-config"}, local.Spec.ClaimRef)
+	assert.Equal(t, map[string]string{"local.path.provisioner/selected-node": "node-1"}, local.Annotations)
+
+	hostPath.Spec.NodeAffinity = nil
+	_, err = localVolume(hostPath, "default", "app-config")
+	assert.Error(t, err)
+}
@@ -0,0 +1,87 @@
+package kube
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// GetHostPathVolume resolves the host path PV bound to pvcName for the given resource,
+// the same volume the survey would offer for selection.
+func (cw *ClientWrapper) GetHostPathVolume(ctx context.Context, patcher Patcher, resourceNamespace, resourceName, pvcName string) (*corev1.PersistentVolume, error) {
+	return cw.getResourceVolume(ctx, patcher, resourceNamespace, resourceName, pvcName, func(pv *corev1.PersistentVolume) error {
+		if pv.Spec.PersistentVolumeSource.HostPath == nil {
+			return errors.New(fmt.Sprintf("PVC %s is not bound to a host path volume", pvcName))
+		}
+		return nil
+	})
+}
+
+// GetLocalVolume resolves the local PV bound to pvcName for the given resource, for reverting a conversion.
+func (cw *ClientWrapper) GetLocalVolume(ctx context.Context, patcher Patcher, resourceNamespace, resourceName, pvcName string) (*corev1.PersistentVolume, error) {
+	return cw.getResourceVolume(ctx, patcher, resourceNamespace, resourceName, pvcName, func(pv *corev1.PersistentVolume) error {
+		if pv.Spec.PersistentVolumeSource.Local == nil {
+			return errors.New(fmt.Sprintf("PVC %s is not bound to a local volume", pvcName))
+		}
+		return nil
+	})
+}
+
+// GetStorageClassVolume resolves the PV of any type bound to pvcName for the given resource, for migrating it to
+// storageClass.
+func (cw *ClientWrapper) GetStorageClassVolume(ctx context.Context, patcher Patcher, resourceNamespace, resourceName, pvcName, storageClass string) (*corev1.PersistentVolume, error) {
+	return cw.getResourceVolume(ctx, patcher, resourceNamespace, resourceName, pvcName, func(pv *corev1.PersistentVolume) error {
+		if pv.Spec.StorageClassName == storageClass {
+			return errors.New(fmt.Sprintf("PVC %s is already bound to a volume of storage class %s", pvcName, storageClass))
+		}
+		return nil
+	})
+}
+
+func (cw *ClientWrapper) getResourceVolume(ctx context.Context, patcher Patcher, resourceNamespace, resourceName, pvcName string, check func(*corev1.PersistentVolume) error) (*corev1.PersistentVolume, error) {
+	resource, err := cw.GetResource(ctx, resourceNamespace, resourceName, patcher.getResource())
+	if err != nil {
+		return nil, err
+	}
+
+	pvcNamespace, found, err := unstructured.NestedString(resource.UnstructuredContent(), patcher.GetNamespacePath()...)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errors.New(fmt.Sprintf("target namespace not found on resource %s", resourceName))
+	}
+
+	pvc, err := cw.GetPVCByName(ctx, pvcNamespace, pvcName)
+	if err != nil {
+		return nil, err
+	}
+
+	// a PVC of another resource in the same namespace is not offered by the survey either
+	workload, err := cw.GetPVCWorkload(ctx, pvcNamespace, pvcName, resourceName)
+	if err != nil {
+		return nil, err
+	}
+	_, found, err = cw.getPersistenceEntry(ctx, patcher, resourceNamespace, resourceName, workload, workload.valuesKey(pvcName))
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errors.New(fmt.Sprintf("PVC %s is not declared by resource %s", pvcName, resourceName))
+	}
+
+	pv, err := cw.GetPVByName(ctx, pvc.Spec.VolumeName)
+	if err != nil {
+		return nil, err
+	}
+
+	err = check(pv)
+	if err != nil {
+		return nil, err
+	}
+
+	return pv, nil
+}
@@ -0,0 +1,27 @@
+package kube
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestGetHostPathVolume(t *testing.T) {
+	persistence := map[string]interface{}{"config": map[string]interface{}{"enabled": true}}
+	// other-data belongs to the release other in the same namespace
+	cluster := newFakeCluster(t, 1, []runtime.Object{fakeHelmRelease(persistence, nil)},
+		fakeHostPathVolume("config"), fakePVC("app-config", "pvc-config", false), fakeDeployment("worker", "app-config"),
+		fakeHostPathVolume("data"), fakePVC("other-data", "pvc-data", false), fakeDeployment("other", "other-data"),
+	)
+	ctx := context.Background()
+
+	pv, err := cluster.cw.GetHostPathVolume(ctx, HelmReleasePatcher{}, "default", "app", "app-config")
+	require.NoError(t, err)
+	assert.Equal(t, "pvc-config", pv.Name)
+
+	_, err = cluster.cw.GetHostPathVolume(ctx, HelmReleasePatcher{}, "default", "app", "other-data")
+	assert.EqualError(t, err, "PVC other-data is not declared by resource app")
+}
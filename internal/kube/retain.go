@@ -0,0 +1,135 @@
+package kube
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/samber/lo"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// retainedAnnotation marks a PV the conversion switched to Retain, holding the strategy of the conversion.
+	retainedAnnotation = "local-path-provisioner-volume-converter/retained"
+
+	provisionedByAnnotation = "pv.kubernetes.io/provisioned-by"
+
+	purgeTimeout = 5 * time.Minute
+)
+
+// retainPV switches the PV to the Retain reclaim policy so deleting its PVC keeps the data. PVs retained before the
+// conversion are left alone and so never purged.
+func (cw *ClientWrapper) retainPV(ctx context.Context, pvName, strategy string) error {
+	pv, err := cw.GetPVByName(ctx, pvName)
+	if err != nil {
+		return err
+	}
+	if pv.Spec.PersistentVolumeReclaimPolicy == corev1.PersistentVolumeReclaimRetain && pv.Annotations[retainedAnnotation] == "" {
+		return nil
+	}
+
+	err = cw.patchPV(ctx, pvName, map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": map[string]interface{}{retainedAnnotation: strategy}},
+		"spec":     map[string]interface{}{"persistentVolumeReclaimPolicy": corev1.PersistentVolumeReclaimRetain},
+	})
+	if err == nil {
+		log.Printf("PV %s retained\n", pvName)
+	}
+	return err
+}
+
+// restoreReclaimPolicy undoes retainPV.
+func (cw *ClientWrapper) restoreReclaimPolicy(ctx context.Context, pvName string, policy corev1.PersistentVolumeReclaimPolicy) error {
+	return cw.patchPV(ctx, pvName, map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": map[string]interface{}{retainedAnnotation: nil}},
+		"spec":     map[string]interface{}{"persistentVolumeReclaimPolicy": policy},
+	})
+}
+
+// GetRetainedVolumes returns the PVs conversions retained whose PVC is gone, the candidates for PurgeRetainedVolumes.
+// The PV of a conversion that stopped early is its safety net until the conversion finished, so it is left out.
+func (cw *ClientWrapper) GetRetainedVolumes(ctx context.Context) ([]corev1.PersistentVolume, error) {
+	pvs, err := cw.cs.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	pending, err := cw.GetPendingConversions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pendingClaims := lo.Map(pending, func(p PendingConversion, _ int) string {
+		return fmt.Sprintf("%s/%s", p.Checkpoint.PVCNamespace, p.Checkpoint.PVC)
+	})
+
+	return lo.Filter(pvs.Items, func(pv corev1.PersistentVolume, _ int) bool {
+		if pv.Annotations[retainedAnnotation] == "" || pv.Status.Phase != corev1.VolumeReleased {
+			return false
+		}
+		if pv.Spec.ClaimRef != nil && lo.Contains(pendingClaims, fmt.Sprintf("%s/%s", pv.Spec.ClaimRef.Namespace, pv.Spec.ClaimRef.Name)) {
+			log.Printf("PV %s is kept for the pending conversion of PVC %s/%s\n", pv.Name, pv.Spec.ClaimRef.Namespace, pv.Spec.ClaimRef.Name)
+			return false
+		}
+		return true
+	}), nil
+}
+
+// PurgeRetainedVolumes removes the PVs conversions retained and their host directories. The directory of a volume
+// rebound to a local PV is still in use, only the PV itself is deleted then.
+func (cw *ClientWrapper) PurgeRetainedVolumes(ctx context.Context) error {
+	pvs, err := cw.GetRetainedVolumes(ctx)
+	if err != nil {
+		return err
+	}
+	if len(pvs) == 0 {
+		log.Println("No retained volumes to purge")
+		return nil
+	}
+
+	for _, pv := range pvs {
+		if pv.Annotations[retainedAnnotation] == RebindStrategy {
+			err = ignoreNotFound(cw.DeletePV(ctx, pv.Name))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if pv.Annotations[provisionedByAnnotation] != localPathProvisioner {
+			log.Printf("PV %s was not provisioned by %s, delete it and its directory by hand\n", pv.Name, localPathProvisioner)
+			continue
+		}
+
+		// local-path-provisioner removes the directory and the PV once a released PV is set to Delete
+		err = cw.restoreReclaimPolicy(ctx, pv.Name, corev1.PersistentVolumeReclaimDelete)
+		if err != nil {
+			return err
+		}
+		err = WaitFor(ctx, purgeTimeout, cw.isPVDeleted(pv.Name))
+		if err != nil {
+			return errors.New(fmt.Sprintf("waiting for local-path-provisioner to delete PV %s: %s", pv.Name, err.Error()))
+		}
+	}
+
+	return nil
+}
+
+func (cw *ClientWrapper) isPVDeleted(name string) wait.ConditionWithContextFunc {
+	return func(ctx context.Context) (bool, error) {
+		fmt.Print(".")
+
+		_, err := cw.GetPVByName(ctx, name)
+		if apierrors.IsNotFound(err) {
+			log.Printf("\nPV %s and its directory purged\n", name)
+			return true, nil
+		}
+
+		return false, nil
+	}
+}
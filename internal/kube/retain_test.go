@@ -0,0 +1,140 @@
+package kube
+
+import (
+	"context"
+	"testing"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestRetainPV(t *testing.T) {
+	pv := func(name string, policy corev1.PersistentVolumeReclaimPolicy) *corev1.PersistentVolume {
+		return &corev1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: map[string]string{provisionedByAnnotation: localPathProvisioner}},
+			Spec:       corev1.PersistentVolumeSpec{PersistentVolumeReclaimPolicy: policy},
+		}
+	}
+	cw := ClientWrapper{cs: fake.NewSimpleClientset(
+		pv("pvc-delete", corev1.PersistentVolumeReclaimDelete),
+		pv("pvc-retain", corev1.PersistentVolumeReclaimRetain),
+	)}
+	ctx := context.Background()
+
+	require.NoError(t, cw.retainPV(ctx, "pvc-delete", CopyStrategy))
+	retained, err := cw.GetPVByName(ctx, "pvc-delete")
+	require.NoError(t, err)
+	assert.Equal(t, corev1.PersistentVolumeReclaimRetain, retained.Spec.PersistentVolumeReclaimPolicy)
+	assert.Equal(t, CopyStrategy, retained.Annotations[retainedAnnotation])
+
+	// retained by the user before, never purged
+	require.NoError(t, cw.retainPV(ctx, "pvc-retain", CopyStrategy))
+	untouched, err := cw.GetPVByName(ctx, "pvc-retain")
+	require.NoError(t, err)
+	assert.NotContains(t, untouched.Annotations, retainedAnnotation)
+
+	require.NoError(t, cw.restoreReclaimPolicy(ctx, "pvc-delete", corev1.PersistentVolumeReclaimDelete))
+	restored, err := cw.GetPVByName(ctx, "pvc-delete")
+	require.NoError(t, err)
+	assert.Equal(t, corev1.PersistentVolumeReclaimDelete, restored.Spec.PersistentVolumeReclaimPolicy)
+	assert.NotContains(t, restored.Annotations, retainedAnnotation)
+	assert.Equal(t, localPathProvisioner, restored.Annotations[provisionedByAnnotation])
+}
+
+func TestPurgeRetainedVolumes(t *testing.T) {
+	pv := func(name, strategy string, phase corev1.PersistentVolumePhase) *corev1.PersistentVolume {
+		return &corev1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: map[string]string{retainedAnnotation: strategy}},
+			Spec:       corev1.PersistentVolumeSpec{PersistentVolumeReclaimPolicy: corev1.PersistentVolumeReclaimRetain},
+			Status:     corev1.PersistentVolumeStatus{Phase: phase},
+		}
+	}
+	cw := ClientWrapper{cs: fake.NewSimpleClientset(
+		pv("pvc-rebound", RebindStrategy, corev1.VolumeReleased),
+		pv("pvc-converting", CopyStrategy, corev1.VolumeBound),
+		// not provisioned by local-path, so nothing removes its directory
+		pv("pvc-manual", CopyStrategy, corev1.VolumeReleased),
+	)}
+	ctx := context.Background()
+
+	retained, err := cw.GetRetainedVolumes(ctx)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"pvc-rebound", "pvc-manual"}, lo.Map(retained, func(pv corev1.PersistentVolume, _ int) string {
+		return pv.Name
+	}))
+
+	require.NoError(t, cw.PurgeRetainedVolumes(ctx))
+
+	_, err = cw.GetPVByName(ctx, "pvc-rebound")
+	assert.True(t, apierrors.IsNotFound(err))
+	_, err = cw.GetPVByName(ctx, "pvc-converting")
+	assert.NoError(t, err)
+	_, err = cw.GetPVByName(ctx, "pvc-manual")
+	assert.NoError(t, err)
+}
+
+func TestPurgeRetainedVolumesKeepsPendingConversions(t *testing.T) {
+	pv := func(name, claim string) *corev1.PersistentVolume {
+		return &corev1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: map[string]string{retainedAnnotation: RebindStrategy}},
+			Spec: corev1.PersistentVolumeSpec{
+				PersistentVolumeReclaimPolicy: corev1.PersistentVolumeReclaimRetain,
+				ClaimRef:                      &corev1.ObjectReference{Namespace: "default", Name: claim},
+			},
+			Status: corev1.PersistentVolumeStatus{Phase: corev1.VolumeReleased},
+		}
+	}
+	helmRelease := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "helm.toolkit.fluxcd.io/v2beta1",
+		"kind":       "HelmRelease",
+		"metadata": map[string]interface{}{
+			"name":      "app",
+			"namespace": "default",
+			"annotations": map[string]interface{}{
+				checkpointAnnotation("config"): `{"step":"delete-original-pvc","pvc":"app-config","pvcNamespace":"default"}`,
+			},
+		},
+	}}
+	cw := ClientWrapper{
+		cs: fake.NewSimpleClientset(
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}},
+			pv("pvc-pending", "app-config"),
+			pv("pvc-finished", "app-data"),
+		),
+		dc: newFakeDynamicClient(helmRelease),
+	}
+	ctx := context.Background()
+
+	retained, err := cw.GetRetainedVolumes(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"pvc-finished"}, lo.Map(retained, func(pv corev1.PersistentVolume, _ int) string {
+		return pv.Name
+	}))
+
+	require.NoError(t, cw.PurgeRetainedVolumes(ctx))
+
+	_, err = cw.GetPVByName(ctx, "pvc-pending")
+	assert.NoError(t, err)
+	_, err = cw.GetPVByName(ctx, "pvc-finished")
+	assert.True(t, apierrors.IsNotFound(err))
+}
+
+// newFakeDynamicClient returns a dynamic client serving objects, which can list the resources the tool looks up
+// across the cluster.
+func newFakeDynamicClient(objects ...runtime.Object) *dynamicfake.FakeDynamicClient {
+	return dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		FluxHelmReleaseResource:     "HelmReleaseList",
+		HelmChartResource:           "HelmChartList",
+		VolumeSnapshotResource:      "VolumeSnapshotList",
+		VolumeSnapshotClassResource: "VolumeSnapshotClassList",
+	}, objects...)
+}
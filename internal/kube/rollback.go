@@ -0,0 +1,175 @@
+package kube
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// RollbackReport describes what a rollback did and the state the resource was left in.
+type RollbackReport struct {
+	FailedStep string
+	Actions    []string
+	State      string
+	// Restored is set when the resource is back in its original state, rather than left for a rerun to finish.
+	Restored bool
+}
+
+func (r RollbackReport) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Rolled back after step %s failed:\n", r.FailedStep)
+	for _, action := range r.Actions {
+		fmt.Fprintf(&sb, "  - %s\n", action)
+	}
+	fmt.Fprintf(&sb, "State: %s", r.State)
+	return sb.String()
+}
+
+// do runs a single rollback action, recording it once it succeeded.
+func (r *RollbackReport) do(action string, f func() error) error {
+	log.Println("Rollback:", action)
+	err := f()
+	if err != nil {
+		return errors.New(fmt.Sprintf("rollback %s failed: %s", action, err.Error()))
+	}
+	r.Actions = append(r.Actions, action)
+	return nil
+}
+
+// rollback returns the resource to its state before the conversion after failedStep failed.
+// Until the original PVC is deleted only the chart values, the temp PVC and the replica count need restoring.
+// Afterwards the data only lives in the temp PVC, so the original host path PVC is recreated and the data copied
+// back. Once the data has been copied to the converted PVC nothing is rolled back, rerunning finishes the cleanup.
+func (c *conversion) rollback(ctx context.Context, failedStep string, checkpoint Checkpoint) (report RollbackReport, err error) {
+	report.FailedStep = failedStep
+
+	failed := c.stepIndex(failedStep)
+	if failed >= c.stepIndex(StepUnbindTempPVC) {
+		report.State = fmt.Sprintf("PVC %s already holds the converted data, rerun the conversion to finish the cleanup", c.pvcName)
+		return
+	}
+
+	if checkpoint.Persistence == nil {
+		err = errors.New(fmt.Sprintf("original persistence values of %s were not recorded, can not roll back", c.volumeName))
+		return
+	}
+
+	originalDeleted := failed >= c.stepIndex(StepDeleteOriginalPVC)
+	if originalDeleted {
+		_, err = c.cw.GetPVCByName(ctx, c.pvcNamespace, c.pvcName)
+		originalDeleted = err != nil
+		err = ignoreNotFound(err)
+		if err != nil {
+			return
+		}
+		// the original PVC survived a failed delete, or has already been recreated as a local volume
+		if !originalDeleted && failed > c.stepIndex(StepDeleteOriginalPVC) {
+			err = report.do(fmt.Sprintf("scale %s to 0", c.workload), func() error {
+				return c.cw.ScaleWorkload(ctx, c.workload, 0)
+			})
+			if err != nil {
+				return
+			}
+			err = report.do(fmt.Sprintf("delete recreated PVC %s", c.pvcName), func() error {
+				err := ignoreNotFound(c.cw.DeletePVC(ctx, c.pvcNamespace, c.pvcName))
+				if err != nil {
+					return err
+				}
+				return WaitFor(ctx, 0, c.cw.IsPVCDeleted(c.pvcNamespace, c.pvcName))
+			})
+			if err != nil {
+				return
+			}
+			originalDeleted = true
+		}
+	}
+
+	// the original PV stays bound to the original PVC, retaining it would let a purge remove it once the PVC is gone
+	if !originalDeleted && checkpoint.ReclaimPolicy != "" {
+		err = report.do(fmt.Sprintf("restore reclaim policy %s of PV %s", checkpoint.ReclaimPolicy, c.pvName), func() error {
+			return c.cw.restoreReclaimPolicy(ctx, c.pvName, checkpoint.ReclaimPolicy)
+		})
+		if err != nil {
+			return
+		}
+	}
+
+	err = report.do(fmt.Sprintf("restore persistence values of %s", c.volumeName), func() error {
+		return c.cw.RestorePersistence(ctx, c.patcher, c.resourceNamespace, c.resourceName, c.workload, c.volumeName, checkpoint.Persistence)
+	})
+	if err != nil {
+		return
+	}
+
+	// removing the temp entry also makes the release recreate a deleted original PVC, the temp PVC itself is
+	// retained by the chart so the data can still be copied back from it
+	_, tempFound, err := c.cw.getPersistenceEntry(ctx, c.patcher, c.resourceNamespace, c.resourceName, c.workload, tempPVCKey(c.volumeName))
+	if err != nil {
+		return
+	}
+	if tempFound {
+		err = report.do(fmt.Sprintf("remove persistence entry %s", tempPVCKey(c.volumeName)), func() error {
+			return c.cw.UnbindTempPVC(ctx, c.patcher, c.resourceNamespace, c.resourceName, c.workload, c.volumeName)
+		})
+		if err != nil {
+			return
+		}
+	}
+
+	if originalDeleted {
+		source := c.tempPVCName
+		if checkpoint.Snapshot != nil {
+			source = fmt.Sprintf("VolumeSnapshot %s", checkpoint.Snapshot.Name)
+		}
+		err = report.do(fmt.Sprintf("copy data from %s back to recreated PVC %s", source, c.pvcName), func() error {
+			err := WaitFor(ctx, c.opts.BindTimeout, c.isSourceBound(c.pvcName))
+			if err != nil {
+				return err
+			}
+			err = c.cw.waitForRollout(ctx, c.workload)
+			if err != nil {
+				return err
+			}
+			err = c.cw.ScaleWorkload(ctx, c.workload, 0)
+			if err != nil {
+				return err
+			}
+			return c.migrateBack(ctx, checkpoint)
+		})
+		if err != nil {
+			return
+		}
+	}
+
+	_, err = c.cw.GetPVCByName(ctx, c.pvcNamespace, c.tempPVCName)
+	tempPVCExists := err == nil
+	err = ignoreNotFound(err)
+	if err != nil {
+		return
+	}
+	if tempPVCExists {
+		err = report.do(fmt.Sprintf("delete PVC %s", c.tempPVCName), func() error {
+			return ignoreNotFound(c.cw.DeletePVC(ctx, c.pvcNamespace, c.tempPVCName))
+		})
+		if err != nil {
+			return
+		}
+	}
+
+	replicas := "an unknown number of replicas"
+	if checkpoint.Replicas != nil {
+		replicas = fmt.Sprintf("%d replicas", *checkpoint.Replicas)
+		err = report.do(fmt.Sprintf("scale %s to %d", c.workload, *checkpoint.Replicas), func() error {
+			return c.cw.ScaleWorkload(ctx, c.workload, int(*checkpoint.Replicas))
+		})
+		if err != nil {
+			return
+		}
+	}
+
+	report.Restored = true
+	report.State = fmt.Sprintf("PVC %s is provisioned from its original persistence values again, no temp PVC exists and %s runs %s", c.pvcName, c.workload, replicas)
+	return
+}
@@ -0,0 +1,311 @@
+package kube
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestRollback(t *testing.T) {
+	original := func() map[string]interface{} {
+		return map[string]interface{}{"enabled": true, "annotations": map[string]interface{}{"team": "a"}}
+	}
+	converted := map[string]interface{}{"enabled": true, "annotations": map[string]interface{}{"team": "a", "volumeType": "local"}}
+	temp := map[string]interface{}{"enabled": true, "retain": true, "annotations": map[string]interface{}{"volumeType": "local"}}
+
+	tests := []struct {
+		failedStep string
+		// name tells cases failing at the same step apart
+		name        string
+		replicas    int32
+		persistence map[string]interface{}
+		objects     []runtime.Object
+		migrations  []string
+		restored    bool
+		// reclaimPolicy of the original PV after the rollback
+		reclaimPolicy corev1.PersistentVolumeReclaimPolicy
+	}{
+		{
+			failedStep:    StepAddTempPVC,
+			replicas:      1,
+			persistence:   map[string]interface{}{"config": original()},
+			objects:       []runtime.Object{fakePVC("app-config", "pvc-config", false)},
+			restored:      true,
+			reclaimPolicy: corev1.PersistentVolumeReclaimDelete,
+		},
+		{
+			failedStep:  StepMigrateToTempPVC,
+			persistence: map[string]interface{}{"config": original(), "config-temp": temp},
+			objects: []runtime.Object{
+				fakePVC("app-config", "pvc-config", false),
+				fakePVC("app-config-temp", "pvc-config-temp", true), fakePV("pvc-config-temp", true),
+			},
+			restored:      true,
+			reclaimPolicy: corev1.PersistentVolumeReclaimDelete,
+		},
+		{
+			failedStep:  StepDeleteOriginalPVC,
+			persistence: map[string]interface{}{"config": original(), "config-temp": temp},
+			objects: []runtime.Object{
+				fakePVC("app-config-temp", "pvc-config-temp", true), fakePV("pvc-config-temp", true),
+			},
+			migrations:    []string{"app-config-temp -> app-config"},
+			restored:      true,
+			reclaimPolicy: corev1.PersistentVolumeReclaimRetain,
+		},
+		{
+			failedStep:  StepDeleteOriginalPVC,
+			name:        "original PVC left",
+			persistence: map[string]interface{}{"config": original(), "config-temp": temp},
+			objects: []runtime.Object{
+				fakePVC("app-config", "pvc-config", false),
+				fakePVC("app-config-temp", "pvc-config-temp", true), fakePV("pvc-config-temp", true),
+			},
+			restored:      true,
+			reclaimPolicy: corev1.PersistentVolumeReclaimDelete,
+		},
+		{
+			// the original PVC was recreated as a local volume and its entry carries the volumeType annotation
+			failedStep:  StepWaitOriginalPodReady,
+			replicas:    1,
+			persistence: map[string]interface{}{"config": converted, "config-temp": temp},
+			objects: []runtime.Object{
+				fakePVC("app-config", "pvc-config-local", true), fakePV("pvc-config-local", true),
+				fakePVC("app-config-temp", "pvc-config-temp", true), fakePV("pvc-config-temp", true),
+			},
+			migrations:    []string{"app-config-temp -> app-config"},
+			restored:      true,
+			reclaimPolicy: corev1.PersistentVolumeReclaimRetain,
+		},
+		{
+			failedStep:  StepUnbindTempPVC,
+			persistence: map[string]interface{}{"config": converted, "config-temp": temp},
+			objects: []runtime.Object{
+				fakePVC("app-config", "pvc-config-local", true), fakePV("pvc-config-local", true),
+				fakePVC("app-config-temp", "pvc-config-temp", true), fakePV("pvc-config-temp", true),
+			},
+			reclaimPolicy: corev1.PersistentVolumeReclaimRetain,
+		},
+	}
+	for _, test := range tests {
+		t.Run(strings.TrimSpace(test.failedStep+" "+test.name), func(t *testing.T) {
+			objects := append([]runtime.Object{fakePV("pvc-config", false)}, test.objects...)
+			cluster := newFakeCluster(t, test.replicas, []runtime.Object{fakeHelmRelease(test.persistence, nil)}, objects...)
+			workload := Workload{Kind: DeploymentKind, Namespace: "default", Name: "app"}
+			c := newConversion(cluster.cw, ConvertOptions{Migrator: RsyncMigrator{}}, HelmReleasePatcher{}, "default", "app", workload, "app-config", "default", "1Gi")
+			c.pvName = "pvc-config"
+			replicas := int32(1)
+			checkpoint := Checkpoint{Replicas: &replicas, Persistence: original(), ReclaimPolicy: corev1.PersistentVolumeReclaimDelete}
+			ctx := context.Background()
+
+			report, err := c.rollback(ctx, test.failedStep, checkpoint)
+			require.NoError(t, err)
+			assert.Equal(t, test.restored, report.Restored, report.String())
+			assert.Equal(t, test.migrations, cluster.migrations)
+			assert.Equal(t, test.reclaimPolicy, cluster.reclaimPolicy(t, "pvc-config"))
+			if !test.restored {
+				assert.Empty(t, report.Actions)
+				return
+			}
+
+			entry, found, err := cluster.cw.getPersistenceEntry(ctx, HelmReleasePatcher{}, "default", "app", workload, "config")
+			require.NoError(t, err)
+			require.True(t, found)
+			assert.Equal(t, original(), entry)
+			_, found, err = cluster.cw.getPersistenceEntry(ctx, HelmReleasePatcher{}, "default", "app", workload, "config-temp")
+			require.NoError(t, err)
+			assert.False(t, found)
+
+			assert.NotNil(t, cluster.boundPV(t, "app-config").Spec.HostPath)
+			assert.Nil(t, cluster.pvc(t, "app-config-temp"))
+			assert.Equal(t, int32(1), cluster.replicas(t))
+		})
+	}
+}
+
+func TestRollbackRaw(t *testing.T) {
+	tests := []struct {
+		failedStep string
+		// name tells cases failing at the same step apart
+		name          string
+		replicas      int32
+		objects       []runtime.Object
+		migrations    []string
+		restored      bool
+		reclaimPolicy corev1.PersistentVolumeReclaimPolicy
+	}{
+		{
+			failedStep:    StepRawRetainOriginalPV,
+			replicas:      1,
+			objects:       []runtime.Object{fakePVC("app-config", "pvc-config", false), fakePVC("app-config-temp", "", true)},
+			restored:      true,
+			reclaimPolicy: corev1.PersistentVolumeReclaimDelete,
+		},
+		{
+			failedStep: StepRawMigrateToTempPVC,
+			objects: []runtime.Object{
+				fakePVC("app-config", "pvc-config", false),
+				fakePVC("app-config-temp", "pvc-config-temp", true), fakePV("pvc-config-temp", true),
+			},
+			restored:      true,
+			reclaimPolicy: corev1.PersistentVolumeReclaimDelete,
+		},
+		{
+			failedStep: StepRawDeleteOriginalPVC,
+			name:       "original PVC left",
+			objects: []runtime.Object{
+				fakePVC("app-config", "pvc-config", false),
+				fakePVC("app-config-temp", "pvc-config-temp", true), fakePV("pvc-config-temp", true),
+			},
+			restored:      true,
+			reclaimPolicy: corev1.PersistentVolumeReclaimDelete,
+		},
+		{
+			failedStep: StepRawRecreateOriginalPVC,
+			objects: []runtime.Object{
+				fakePVC("app-config-temp", "pvc-config-temp", true), fakePV("pvc-config-temp", true),
+			},
+			migrations:    []string{"app-config-temp -> app-config"},
+			restored:      true,
+			reclaimPolicy: corev1.PersistentVolumeReclaimRetain,
+		},
+		{
+			failedStep: StepRawMigrateToOriginalPVC,
+			objects: []runtime.Object{
+				fakePVC("app-config", "pvc-config-local", true), fakePV("pvc-config-local", true),
+				fakePVC("app-config-temp", "pvc-config-temp", true), fakePV("pvc-config-temp", true),
+			},
+			migrations:    []string{"app-config-temp -> app-config"},
+			restored:      true,
+			reclaimPolicy: corev1.PersistentVolumeReclaimRetain,
+		},
+		{
+			failedStep: StepRawScaleUp,
+			objects: []runtime.Object{
+				fakePVC("app-config", "pvc-config-local", true), fakePV("pvc-config-local", true),
+				fakePVC("app-config-temp", "pvc-config-temp", true), fakePV("pvc-config-temp", true),
+			},
+			reclaimPolicy: corev1.PersistentVolumeReclaimRetain,
+		},
+	}
+	for _, test := range tests {
+		t.Run(strings.TrimSpace(test.failedStep+" "+test.name), func(t *testing.T) {
+			objects := append([]runtime.Object{fakePV("pvc-config", false)}, test.objects...)
+			cluster := newFakeCluster(t, test.replicas, nil, objects...)
+			workload := Workload{Kind: DeploymentKind, Namespace: "default", Name: "app"}
+			c := newRawConversion(cluster.cw, ConvertOptions{Migrator: RsyncMigrator{}}, workload, "app-config", "default", "1Gi")
+			c.pvName = "pvc-config"
+			replicas := int32(1)
+			checkpoint := Checkpoint{
+				Replicas:      &replicas,
+				Claim:         originalClaim(fakePVC("app-config", "pvc-config", false)),
+				ReclaimPolicy: corev1.PersistentVolumeReclaimDelete,
+			}
+
+			report, err := c.rollbackRaw(context.Background(), test.failedStep, checkpoint)
+			require.NoError(t, err)
+			assert.Equal(t, test.restored, report.Restored, report.String())
+			assert.Equal(t, test.migrations, cluster.migrations)
+			assert.Equal(t, test.reclaimPolicy, cluster.reclaimPolicy(t, "pvc-config"))
+			if !test.restored {
+				assert.Empty(t, report.Actions)
+				return
+			}
+
+			assert.NotNil(t, cluster.boundPV(t, "app-config").Spec.HostPath)
+			assert.NotContains(t, cluster.pvc(t, "app-config").Annotations, "volumeType")
+			assert.Nil(t, cluster.pvc(t, "app-config-temp"))
+			assert.Equal(t, int32(1), cluster.replicas(t))
+		})
+	}
+}
+
+func TestRollbackRebind(t *testing.T) {
+	original := func() map[string]interface{} {
+		return map[string]interface{}{"enabled": true, "annotations": map[string]interface{}{"team": "a"}}
+	}
+	converted := map[string]interface{}{"enabled": true, "annotations": map[string]interface{}{"team": "a", "volumeType": "local"}}
+
+	tests := []struct {
+		failedStep    string
+		replicas      int32
+		persistence   map[string]interface{}
+		objects       []runtime.Object
+		restored      bool
+		reclaimPolicy corev1.PersistentVolumeReclaimPolicy
+	}{
+		{
+			failedStep:    StepScaleDownForRebind,
+			replicas:      1,
+			persistence:   map[string]interface{}{"config": original()},
+			objects:       []runtime.Object{fakePVC("app-config", "pvc-config", false)},
+			restored:      true,
+			reclaimPolicy: corev1.PersistentVolumeReclaimDelete,
+		},
+		{
+			failedStep:    StepDeleteHostPathPVC,
+			persistence:   map[string]interface{}{"config": original()},
+			objects:       []runtime.Object{fakePV("pvc-config-local", true)},
+			restored:      true,
+			reclaimPolicy: corev1.PersistentVolumeReclaimDelete,
+		},
+		{
+			// the PVC was recreated bound to the local PV and its entry carries the volumeType annotation
+			failedStep:  StepWaitReboundPVCBound,
+			replicas:    1,
+			persistence: map[string]interface{}{"config": converted},
+			objects: []runtime.Object{
+				fakePVC("app-config", "pvc-config-local", true), fakePV("pvc-config-local", true),
+			},
+			restored:      true,
+			reclaimPolicy: corev1.PersistentVolumeReclaimDelete,
+		},
+		{
+			failedStep:  StepRestoreReclaimPolicy,
+			replicas:    1,
+			persistence: map[string]interface{}{"config": converted},
+			objects: []runtime.Object{
+				fakePVC("app-config", "pvc-config-local", true), fakePV("pvc-config-local", true),
+			},
+			reclaimPolicy: corev1.PersistentVolumeReclaimRetain,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.failedStep, func(t *testing.T) {
+			objects := append([]runtime.Object{fakePV("pvc-config", false)}, test.objects...)
+			cluster := newFakeCluster(t, test.replicas, []runtime.Object{fakeHelmRelease(test.persistence, nil)}, objects...)
+			workload := Workload{Kind: DeploymentKind, Namespace: "default", Name: "app"}
+			c := newConversion(cluster.cw, ConvertOptions{Migrator: RsyncMigrator{}}, HelmReleasePatcher{}, "default", "app", workload, "app-config", "default", "1Gi")
+			c.strategy = RebindStrategy
+			c.pvName = "pvc-config"
+			replicas := int32(1)
+			checkpoint := Checkpoint{Replicas: &replicas, Persistence: original(), ReclaimPolicy: corev1.PersistentVolumeReclaimDelete}
+			ctx := context.Background()
+
+			report, err := c.rollbackRebind(ctx, test.failedStep, checkpoint)
+			require.NoError(t, err)
+			assert.Equal(t, test.restored, report.Restored, report.String())
+			assert.Equal(t, test.reclaimPolicy, cluster.reclaimPolicy(t, "pvc-config"))
+			if !test.restored {
+				assert.Empty(t, report.Actions)
+				return
+			}
+
+			entry, found, err := cluster.cw.getPersistenceEntry(ctx, HelmReleasePatcher{}, "default", "app", workload, "config")
+			require.NoError(t, err)
+			require.True(t, found)
+			assert.Equal(t, original(), entry)
+
+			assert.Equal(t, "pvc-config", cluster.boundPV(t, "app-config").Name)
+			_, err = cluster.cw.GetPVByName(ctx, "pvc-config-local")
+			assert.True(t, apierrors.IsNotFound(err))
+			assert.Equal(t, int32(1), cluster.replicas(t))
+		})
+	}
+}
@@ -0,0 +1,297 @@
+package kube
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/samber/lo"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+var (
+	VolumeSnapshotResource = schema.GroupVersionResource{
+		Group:    "snapshot.storage.k8s.io",
+		Version:  "v1",
+		Resource: "volumesnapshots",
+	}
+	VolumeSnapshotClassResource = schema.GroupVersionResource{
+		Group:    "snapshot.storage.k8s.io",
+		Version:  "v1",
+		Resource: "volumesnapshotclasses",
+	}
+)
+
+const (
+	StepSnapshotOriginalPVC    = "snapshot-original-pvc"
+	StepRawSnapshotOriginalPVC = "raw-snapshot-original-pvc"
+)
+
+// SnapshotRef is a VolumeSnapshot taken of the original PVC and the storage class to restore it with.
+type SnapshotRef struct {
+	Name         string `json:"name"`
+	StorageClass string `json:"storageClass,omitempty"`
+}
+
+func snapshotName(pvcName string) string {
+	return pvcName + "-converter-snapshot"
+}
+
+func snapshotRestorePVCName(pvcName string) string {
+	return pvcName + "-snapshot-restore"
+}
+
+// snapshotStep takes a VolumeSnapshot of the original PVC before it is deleted, for the rollback to restore from
+// instead of the temp PVC. Only CSI volumes with a matching snapshot class can be snapshotted, elsewhere it does
+// nothing.
+func snapshotStep(name string) conversionStep {
+	return conversionStep{
+		name: name,
+		run: func(ctx context.Context, c *conversion) error {
+			if !c.opts.Snapshot {
+				return nil
+			}
+
+			class, err := c.cw.getSnapshotClass(ctx, c.pvName)
+			if err != nil || class == "" {
+				return err
+			}
+			pvc, err := c.cw.GetPVCByName(ctx, c.pvcNamespace, c.pvcName)
+			if err != nil {
+				return err
+			}
+
+			err = ignoreAlreadyExists(c.cw.CreateVolumeSnapshot(ctx, c.pvcNamespace, snapshotName(c.pvcName), c.pvcName, class))
+			if err != nil {
+				return err
+			}
+			err = WaitFor(ctx, c.opts.BindTimeout, c.cw.IsSnapshotReady(c.pvcNamespace, snapshotName(c.pvcName)))
+			if err != nil {
+				return err
+			}
+
+			c.checkpoint.Snapshot = &SnapshotRef{Name: snapshotName(c.pvcName), StorageClass: lo.FromPtr(pvc.Spec.StorageClassName)}
+			return nil
+		},
+	}
+}
+
+// hasSnapshotAPI reports whether the cluster serves the CSI snapshot API.
+func (cw *ClientWrapper) hasSnapshotAPI() bool {
+	resources, err := cw.cs.Discovery().ServerResourcesForGroupVersion(VolumeSnapshotResource.GroupVersion().String())
+	if err != nil {
+		return false
+	}
+	_, found := lo.Find(resources.APIResources, func(r metav1.APIResource) bool {
+		return r.Name == VolumeSnapshotResource.Resource
+	})
+	return found
+}
+
+// getSnapshotClass returns the VolumeSnapshotClass for the CSI driver of the PV, or nothing if the PV can not be
+// snapshotted.
+func (cw *ClientWrapper) getSnapshotClass(ctx context.Context, pvName string) (string, error) {
+	class, reason, err := cw.findSnapshotClass(ctx, pvName)
+	if reason != "" {
+		log.Printf("%s, skipping the snapshot\n", reason)
+	}
+	return class, err
+}
+
+// findSnapshotClass returns the VolumeSnapshotClass for the CSI driver of the PV, or the reason the PV can not be
+// snapshotted.
+func (cw *ClientWrapper) findSnapshotClass(ctx context.Context, pvName string) (class, reason string, err error) {
+	if !cw.hasSnapshotAPI() {
+		reason = "the cluster has no VolumeSnapshot API"
+		return
+	}
+
+	pv, err := cw.GetPVByName(ctx, pvName)
+	if err != nil {
+		return
+	}
+	if pv.Spec.CSI == nil {
+		reason = fmt.Sprintf("PV %s is not a CSI volume", pvName)
+		return
+	}
+
+	classes, err := cw.dc.Resource(VolumeSnapshotClassResource).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return
+	}
+
+	var matching []unstructured.Unstructured
+	for _, c := range classes.Items {
+		driver, _, _ := unstructured.NestedString(c.Object, "driver")
+		if driver != pv.Spec.CSI.Driver {
+			continue
+		}
+		if c.GetAnnotations()["snapshot.storage.kubernetes.io/is-default-class"] == "true" {
+			class = c.GetName()
+			return
+		}
+		matching = append(matching, c)
+	}
+	if len(matching) == 0 {
+		reason = fmt.Sprintf("no VolumeSnapshotClass for driver %s of PV %s", pv.Spec.CSI.Driver, pvName)
+		return
+	}
+	class = matching[0].GetName()
+	return
+}
+
+func (cw *ClientWrapper) CreateVolumeSnapshot(ctx context.Context, namespace, name, pvcName, class string) error {
+	snapshot := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": VolumeSnapshotResource.GroupVersion().String(),
+		"kind":       "VolumeSnapshot",
+		"metadata": map[string]interface{}{
+			"name":      name,
+			"namespace": namespace,
+			"labels":    map[string]interface{}{managedByLabel: managedBy},
+		},
+		"spec": map[string]interface{}{
+			"volumeSnapshotClassName": class,
+			"source":                  map[string]interface{}{"persistentVolumeClaimName": pvcName},
+		},
+	}}
+
+	_, err := cw.dc.Resource(VolumeSnapshotResource).Namespace(namespace).Create(ctx, snapshot, metav1.CreateOptions{})
+	if err == nil {
+		log.Printf("VolumeSnapshot %s of PVC %s created\n", name, pvcName)
+	}
+	return err
+}
+
+func (cw *ClientWrapper) IsSnapshotReady(namespace, name string) wait.ConditionWithContextFunc {
+	return func(ctx context.Context) (bool, error) {
+		fmt.Print(".")
+
+		snapshot, err := cw.GetResource(ctx, namespace, name, VolumeSnapshotResource)
+		if err != nil {
+			return false, nil
+		}
+
+		message, found, _ := unstructured.NestedString(snapshot.Object, "status", "error", "message")
+		if found {
+			return false, errors.New(fmt.Sprintf("VolumeSnapshot %s failed: %s", name, message))
+		}
+		ready, _, _ := unstructured.NestedBool(snapshot.Object, "status", "readyToUse")
+		if ready {
+			log.Printf("\nVolumeSnapshot %s ready\n", name)
+		}
+		return ready, nil
+	}
+}
+
+// migrateBack copies the original data back into the recreated original PVC during a rollback.
+func (c *conversion) migrateBack(ctx context.Context, checkpoint Checkpoint) error {
+	source, cleanup, err := c.getRollbackSource(ctx, checkpoint)
+	if err != nil {
+		return err
+	}
+
+	err = c.migrate(ctx, source, c.pvcName)
+	if err != nil {
+		return err
+	}
+	return cleanup()
+}
+
+// getRollbackSource returns the PVC the rollback copies the original data back from, a PVC restored from the
+// snapshot if one was taken, otherwise the temp PVC. cleanup removes a restored PVC again.
+func (c *conversion) getRollbackSource(ctx context.Context, checkpoint Checkpoint) (source string, cleanup func() error, err error) {
+	cleanup = func() error { return nil }
+	if checkpoint.Snapshot == nil {
+		return c.tempPVCName, cleanup, nil
+	}
+
+	size, err := resource.ParseQuantity(checkpoint.Size)
+	if err != nil {
+		return
+	}
+
+	source = snapshotRestorePVCName(c.pvcName)
+	var storageClass *string
+	if checkpoint.Snapshot.StorageClass != "" {
+		storageClass = &checkpoint.Snapshot.StorageClass
+	}
+	apiGroup := VolumeSnapshotResource.Group
+	restore := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      source,
+			Namespace: c.pvcNamespace,
+			Labels:    map[string]string{managedByLabel: managedBy},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes:      []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			StorageClassName: storageClass,
+			Resources:        corev1.ResourceRequirements{Requests: corev1.ResourceList{corev1.ResourceStorage: size}},
+			DataSource:       &corev1.TypedLocalObjectReference{APIGroup: &apiGroup, Kind: "VolumeSnapshot", Name: checkpoint.Snapshot.Name},
+		},
+	}
+	err = ignoreAlreadyExists(c.cw.CreatePVC(ctx, restore))
+	if err != nil {
+		return
+	}
+
+	cleanup = func() error {
+		return ignoreNotFound(c.cw.DeletePVC(ctx, c.pvcNamespace, source))
+	}
+	return
+}
+
+// GetVolumeSnapshots returns the snapshots conversions took. The snapshot of a conversion that stopped early is the
+// source of its rollback, so it is left out.
+func (cw *ClientWrapper) GetVolumeSnapshots(ctx context.Context) ([]unstructured.Unstructured, error) {
+	if !cw.hasSnapshotAPI() {
+		return nil, nil
+	}
+
+	snapshots, err := cw.dc.Resource(VolumeSnapshotResource).List(ctx, metav1.ListOptions{LabelSelector: fmt.Sprintf("%s=%s", managedByLabel, managedBy)})
+	if err != nil {
+		return nil, err
+	}
+
+	pending, err := cw.GetPendingConversions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pendingSnapshots := lo.FilterMap(pending, func(p PendingConversion, _ int) (string, bool) {
+		if p.Checkpoint.Snapshot == nil {
+			return "", false
+		}
+		return fmt.Sprintf("%s/%s", p.Checkpoint.PVCNamespace, p.Checkpoint.Snapshot.Name), true
+	})
+
+	return lo.Filter(snapshots.Items, func(snapshot unstructured.Unstructured, _ int) bool {
+		if lo.Contains(pendingSnapshots, fmt.Sprintf("%s/%s", snapshot.GetNamespace(), snapshot.GetName())) {
+			log.Printf("VolumeSnapshot %s/%s is kept for the rollback of a pending conversion\n", snapshot.GetNamespace(), snapshot.GetName())
+			return false
+		}
+		return true
+	}), nil
+}
+
+// DeleteVolumeSnapshots removes the snapshots conversions took.
+func (cw *ClientWrapper) DeleteVolumeSnapshots(ctx context.Context) error {
+	snapshots, err := cw.GetVolumeSnapshots(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, snapshot := range snapshots {
+		err = cw.dc.Resource(VolumeSnapshotResource).Namespace(snapshot.GetNamespace()).Delete(ctx, snapshot.GetName(), metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		log.Printf("VolumeSnapshot %s/%s deleted\n", snapshot.GetNamespace(), snapshot.GetName())
+	}
+	return nil
+}
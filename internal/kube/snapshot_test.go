@@ -0,0 +1,138 @@
+package kube
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestGetSnapshotClass(t *testing.T) {
+	snapshotClass := func(name, driver string, isDefault bool) *unstructured.Unstructured {
+		class := &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "snapshot.storage.k8s.io/v1",
+			"kind":       "VolumeSnapshotClass",
+			"metadata":   map[string]interface{}{"name": name},
+			"driver":     driver,
+		}}
+		if isDefault {
+			class.SetAnnotations(map[string]string{"snapshot.storage.kubernetes.io/is-default-class": "true"})
+		}
+		return class
+	}
+
+	cs := fake.NewSimpleClientset(
+		&corev1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "pvc-csi"},
+			Spec: corev1.PersistentVolumeSpec{PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{Driver: "rook-ceph.rbd.csi.ceph.com"},
+			}},
+		},
+		&corev1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "pvc-host-path"},
+			Spec: corev1.PersistentVolumeSpec{PersistentVolumeSource: corev1.PersistentVolumeSource{
+				HostPath: &corev1.HostPathVolumeSource{Path: "/var/lib/rancher/k3s/storage/pvc-host-path"},
+			}},
+		},
+	)
+	cw := ClientWrapper{cs: cs, dc: dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(),
+		snapshotClass("nfs", "nfs.csi.k8s.io", true),
+		snapshotClass("ceph", "rook-ceph.rbd.csi.ceph.com", false),
+		snapshotClass("ceph-default", "rook-ceph.rbd.csi.ceph.com", true),
+	)}
+	ctx := context.Background()
+
+	// without the snapshot API nothing is snapshotted
+	class, err := cw.getSnapshotClass(ctx, "pvc-csi")
+	require.NoError(t, err)
+	assert.Empty(t, class)
+
+	cs.Discovery().(*fakediscovery.FakeDiscovery).Resources = []*metav1.APIResourceList{{
+		GroupVersion: VolumeSnapshotResource.GroupVersion().String(),
+		APIResources: []metav1.APIResource{{Name: VolumeSnapshotResource.Resource}, {Name: VolumeSnapshotClassResource.Resource}},
+	}}
+
+	class, err = cw.getSnapshotClass(ctx, "pvc-csi")
+	require.NoError(t, err)
+	assert.Equal(t, "ceph-default", class)
+
+	class, err = cw.getSnapshotClass(ctx, "pvc-host-path")
+	require.NoError(t, err)
+	assert.Empty(t, class)
+}
+
+func TestDeleteVolumeSnapshotsKeepsPendingConversions(t *testing.T) {
+	snapshot := func(name string) *unstructured.Unstructured {
+		return &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "snapshot.storage.k8s.io/v1",
+			"kind":       "VolumeSnapshot",
+			"metadata": map[string]interface{}{
+				"name":      name,
+				"namespace": "default",
+				"labels":    map[string]interface{}{managedByLabel: managedBy},
+			},
+		}}
+	}
+	helmRelease := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "helm.toolkit.fluxcd.io/v2beta1",
+		"kind":       "HelmRelease",
+		"metadata": map[string]interface{}{
+			"name":      "app",
+			"namespace": "default",
+			"annotations": map[string]interface{}{
+				checkpointAnnotation("config"): `{"step":"delete-original-pvc","pvc":"app-config","pvcNamespace":"default","snapshot":{"name":"app-config-converter-snapshot"}}`,
+			},
+		},
+	}}
+	cs := fake.NewSimpleClientset(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}})
+	cs.Discovery().(*fakediscovery.FakeDiscovery).Resources = []*metav1.APIResourceList{{
+		GroupVersion: VolumeSnapshotResource.GroupVersion().String(),
+		APIResources: []metav1.APIResource{{Name: VolumeSnapshotResource.Resource}, {Name: VolumeSnapshotClassResource.Resource}},
+	}}
+	cw := ClientWrapper{cs: cs, dc: newFakeDynamicClient(
+		helmRelease,
+		snapshot("app-config-converter-snapshot"),
+		snapshot("app-data-converter-snapshot"),
+	)}
+	ctx := context.Background()
+
+	require.NoError(t, cw.DeleteVolumeSnapshots(ctx))
+
+	_, err := cw.GetResource(ctx, "default", "app-config-converter-snapshot", VolumeSnapshotResource)
+	assert.NoError(t, err)
+	_, err = cw.GetResource(ctx, "default", "app-data-converter-snapshot", VolumeSnapshotResource)
+	assert.True(t, apierrors.IsNotFound(err))
+}
+
+func TestCheckSnapshot(t *testing.T) {
+	hostPath := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pvc-host-path"},
+		Spec: corev1.PersistentVolumeSpec{PersistentVolumeSource: corev1.PersistentVolumeSource{
+			HostPath: &corev1.HostPathVolumeSource{Path: "/var/lib/rancher/k3s/storage/pvc-host-path"},
+		}},
+	}
+	cs := fake.NewSimpleClientset(hostPath)
+	cw := ClientWrapper{cs: cs, dc: newFakeDynamicClient()}
+	ctx := context.Background()
+
+	result := cw.checkSnapshot(ctx, hostPath)
+	assert.True(t, result.Warning)
+	assert.Contains(t, result.Problem, "no VolumeSnapshot API")
+
+	cs.Discovery().(*fakediscovery.FakeDiscovery).Resources = []*metav1.APIResourceList{{
+		GroupVersion: VolumeSnapshotResource.GroupVersion().String(),
+		APIResources: []metav1.APIResource{{Name: VolumeSnapshotResource.Resource}, {Name: VolumeSnapshotClassResource.Resource}},
+	}}
+	result = cw.checkSnapshot(ctx, hostPath)
+	assert.True(t, result.Warning)
+	assert.Contains(t, result.Problem, "not a CSI volume")
+}
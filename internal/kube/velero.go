@@ -0,0 +1,178 @@
+package kube
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/samber/lo"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+var VeleroBackupResource = schema.GroupVersionResource{
+	Group:    "velero.io",
+	Version:  "v1",
+	Resource: "backups",
+}
+
+const (
+	DefaultVeleroNamespace = "velero"
+
+	StepAnnotateBackupVolumes = "annotate-backup-volumes"
+
+	podAnnotationsKey             = "podAnnotations"
+	veleroBackupVolumesAnnotation = "backup.velero.io/backup-volumes"
+)
+
+// annotateBackupVolumesStep opts the converted volume into the file system backup of Velero, which skips host path
+// volumes but backs up local ones. A reverted volume is taken out of it again.
+var annotateBackupVolumesStep = conversionStep{
+	name: StepAnnotateBackupVolumes,
+	group: func(ctx context.Context, cs []*conversion) error {
+		c := cs[0]
+		if !c.opts.Velero {
+			return nil
+		}
+		volumeNames := lo.Map(cs, func(c *conversion, _ int) string {
+			return c.volumeName
+		})
+		return c.cw.setBackupVolumes(ctx, c.patcher, c.resourceNamespace, c.resourceName, volumeNames, !c.revert)
+	},
+}
+
+// backup creates a Velero backup of the namespaces of the resource and PVCs and waits for it to complete.
+func backup(ctx context.Context, cs []*conversion) error {
+	c := cs[0]
+	namespaces := lo.Uniq(lo.Compact(append([]string{c.resourceNamespace}, lo.Map(cs, func(c *conversion, _ int) string {
+		return c.pvcNamespace
+	})...)))
+
+	name, err := c.cw.CreateVeleroBackup(ctx, c.opts.veleroNamespace(), namespaces)
+	if err != nil {
+		return errors.New(fmt.Sprintf("creating Velero backup: %s", err.Error()))
+	}
+	log.Printf("Velero backup %s/%s of namespaces %s created\n", c.opts.veleroNamespace(), name, strings.Join(namespaces, ", "))
+
+	return WaitFor(ctx, 0, c.cw.IsBackupCompleted(c.opts.veleroNamespace(), name))
+}
+
+func (cw *ClientWrapper) CreateVeleroBackup(ctx context.Context, veleroNamespace string, namespaces []string) (string, error) {
+	backup := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": VeleroBackupResource.GroupVersion().String(),
+		"kind":       "Backup",
+		"metadata": map[string]interface{}{
+			"generateName": "volume-converter-",
+			"namespace":    veleroNamespace,
+			"labels":       map[string]interface{}{managedByLabel: managedBy},
+		},
+		"spec": map[string]interface{}{
+			"includedNamespaces": lo.ToAnySlice(namespaces),
+		},
+	}}
+
+	created, err := cw.dc.Resource(VeleroBackupResource).Namespace(veleroNamespace).Create(ctx, backup, metav1.CreateOptions{})
+	if err != nil {
+		return "", err
+	}
+	return created.GetName(), nil
+}
+
+func (cw *ClientWrapper) IsBackupCompleted(namespace, name string) wait.ConditionWithContextFunc {
+	return func(ctx context.Context) (bool, error) {
+		fmt.Print(".")
+
+		backup, err := cw.GetResource(ctx, namespace, name, VeleroBackupResource)
+		if err != nil {
+			return false, nil
+		}
+
+		phase, _, _ := unstructured.NestedString(backup.Object, "status", "phase")
+		switch phase {
+		case "Completed":
+			log.Printf("\nVelero backup %s completed\n", name)
+			return true, nil
+		case "Failed", "PartiallyFailed", "FailedValidation":
+			return false, errors.New(fmt.Sprintf("Velero backup %s/%s finished as %s, see \"velero backup describe %s\"", namespace, name, phase, name))
+		default:
+			return false, nil
+		}
+	}
+}
+
+// AnnotateBackupVolumes adds volumeNames to the backup-volumes pod annotation in the values of the resource, keeping
+// the volumes already listed.
+func (cw *ClientWrapper) AnnotateBackupVolumes(ctx context.Context, patcher Patcher, namespace, chartName string, volumeNames ...string) error {
+	return cw.setBackupVolumes(ctx, patcher, namespace, chartName, volumeNames, true)
+}
+
+// RemoveBackupVolume undoes AnnotateBackupVolumes for volumeName.
+func (cw *ClientWrapper) RemoveBackupVolume(ctx context.Context, patcher Patcher, namespace, chartName, volumeName string) error {
+	return cw.setBackupVolumes(ctx, patcher, namespace, chartName, []string{volumeName}, false)
+}
+
+func (cw *ClientWrapper) setBackupVolumes(ctx context.Context, patcher Patcher, namespace, chartName string, volumeNames []string, backup bool) error {
+	chartsClient := cw.dc.Resource(patcher.getResource()).Namespace(namespace)
+	chart, err := chartsClient.Get(ctx, chartName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	values, err := patcher.getValues(chart.UnstructuredContent(), chartName)
+	if err != nil {
+		return err
+	}
+
+	annotations, _ := values[podAnnotationsKey].(map[string]interface{})
+	if annotations == nil {
+		annotations = map[string]interface{}{}
+	}
+	listed, _ := annotations[veleroBackupVolumesAnnotation].(string)
+	volumes := lo.Filter(lo.Map(strings.Split(listed, ","), func(v string, _ int) string {
+		return strings.TrimSpace(v)
+	}), func(v string, _ int) bool {
+		return v != ""
+	})
+	changed := lo.Filter(volumeNames, func(v string, _ int) bool {
+		return lo.Contains(volumes, v) != backup
+	})
+	if len(changed) == 0 {
+		return nil
+	}
+
+	if backup {
+		volumes = append(volumes, changed...)
+	} else {
+		volumes = lo.Without(volumes, changed...)
+	}
+	sort.Strings(volumes)
+	if len(volumes) > 0 {
+		annotations[veleroBackupVolumesAnnotation] = strings.Join(volumes, ",")
+	} else {
+		// nil removes the key with a merge patch, the values content of a HelmChart drops it
+		annotations[veleroBackupVolumesAnnotation] = nil
+	}
+	values[podAnnotationsKey] = annotations
+
+	payload, patchType, err := patcher.getValuesPayload(values, podAnnotationsKey)
+	if err != nil {
+		return err
+	}
+
+	_, err = chartsClient.Patch(ctx, chartName, patchType, payload, metav1.PatchOptions{})
+	if err != nil {
+		return err
+	}
+
+	if backup {
+		log.Printf("Volume %s added to the Velero backup volumes of %s\n", strings.Join(changed, ", "), chartName)
+	} else {
+		log.Printf("Volume %s removed from the Velero backup volumes of %s\n", strings.Join(changed, ", "), chartName)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package kube
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func TestAnnotateBackupVolumes(t *testing.T) {
+	helmRelease := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "helm.toolkit.fluxcd.io/v2beta1",
+		"kind":       "HelmRelease",
+		"metadata":   map[string]interface{}{"name": "app", "namespace": "default"},
+		"spec": map[string]interface{}{
+			"values": map[string]interface{}{
+				"podAnnotations": map[string]interface{}{"backup.velero.io/backup-volumes": "data"},
+			},
+		},
+	}}
+	cw := ClientWrapper{dc: dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), helmRelease)}
+	ctx := context.Background()
+
+	backupVolumes := func() (string, bool) {
+		chart, err := cw.GetResource(ctx, "default", "app", FluxHelmReleaseResource)
+		require.NoError(t, err)
+		volumes, found, err := unstructured.NestedString(chart.Object, "spec", "values", "podAnnotations", veleroBackupVolumesAnnotation)
+		require.NoError(t, err)
+		return volumes, found
+	}
+
+	require.NoError(t, cw.AnnotateBackupVolumes(ctx, HelmReleasePatcher{}, "default", "app", "config"))
+	volumes, _ := backupVolumes()
+	assert.Equal(t, "config,data", volumes)
+
+	require.NoError(t, cw.AnnotateBackupVolumes(ctx, HelmReleasePatcher{}, "default", "app", "config"))
+	volumes, _ = backupVolumes()
+	assert.Equal(t, "config,data", volumes)
+
+	require.NoError(t, cw.RemoveBackupVolume(ctx, HelmReleasePatcher{}, "default", "app", "data"))
+	require.NoError(t, cw.RemoveBackupVolume(ctx, HelmReleasePatcher{}, "default", "app", "config"))
+	_, found := backupVolumes()
+	assert.False(t, found)
+}
+
+func TestIsBackupCompleted(t *testing.T) {
+	backup := func(name, phase string) *unstructured.Unstructured {
+		return &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "velero.io/v1",
+			"kind":       "Backup",
+			"metadata":   map[string]interface{}{"name": name, "namespace": DefaultVeleroNamespace},
+			"status":     map[string]interface{}{"phase": phase},
+		}}
+	}
+	cw := ClientWrapper{dc: dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(),
+		backup("completed", "Completed"),
+		backup("running", "InProgress"),
+		backup("failed", "PartiallyFailed"),
+	)}
+	ctx := context.Background()
+
+	done, err := cw.IsBackupCompleted(DefaultVeleroNamespace, "completed")(ctx)
+	assert.NoError(t, err)
+	assert.True(t, done)
+
+	done, err = cw.IsBackupCompleted(DefaultVeleroNamespace, "running")(ctx)
+	assert.NoError(t, err)
+	assert.False(t, done)
+
+	_, err = cw.IsBackupCompleted(DefaultVeleroNamespace, "failed")(ctx)
+	assert.ErrorContains(t, err, "PartiallyFailed")
+}
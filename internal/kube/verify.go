@@ -0,0 +1,97 @@
+package kube
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const DefaultVerifyImage = "busybox:1.36"
+
+// verifyScript lists size, SHA-256 and path of every file below both mounts and fails if the lists differ. The
+// counts, total sizes and the hash of each list, the tree hash, are printed for the log.
+const verifyScript = `set -eu
+manifest() {
+  cd "$1"
+  find . -type f | sort | while IFS= read -r f; do
+    printf '%s %s %s\n' "$(stat -c %s "$f")" "$(sha256sum < "$f" | cut -d ' ' -f 1)" "$f"
+  done
+}
+manifest /source > /tmp/source
+manifest /destination > /tmp/destination
+for side in source destination; do
+  echo "$side: $(wc -l < /tmp/$side) files, $(awk '{ s += $1 } END { print s + 0 }' /tmp/$side) bytes, tree hash $(sha256sum < /tmp/$side | cut -d ' ' -f 1)"
+done
+diff /tmp/source /tmp/destination
+`
+
+// VerifyJob returns a job mounting both PVCs read only that fails unless they hold the same files with the same
+// content.
+func VerifyJob(namespace, fromPVC, toPVC, image string) *batchv1.Job {
+	var backOffLimit int32 = 0
+
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: "volume-converter-verify-",
+			Namespace:    namespace,
+			Labels:       map[string]string{managedByLabel: managedBy},
+		},
+		Spec: batchv1.JobSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name:    "verify",
+							Image:   image,
+							Command: []string{"sh", "-c", verifyScript},
+							VolumeMounts: []corev1.VolumeMount{
+								{Name: "source", MountPath: "/source", ReadOnly: true},
+								{Name: "destination", MountPath: "/destination", ReadOnly: true},
+							},
+						},
+					},
+					Volumes: []corev1.Volume{
+						{
+							Name:         "source",
+							VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: fromPVC, ReadOnly: true}},
+						},
+						{
+							Name:         "destination",
+							VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: toPVC, ReadOnly: true}},
+						},
+					},
+					RestartPolicy: corev1.RestartPolicyNever,
+				},
+			},
+			BackoffLimit: &backOffLimit,
+		},
+	}
+}
+
+// verify compares the data of both PVCs after a migration, failing the step if anything differs.
+func (c *conversion) verify(ctx context.Context, fromPVC, toPVC string) error {
+	job := VerifyJob(c.pvcNamespace, fromPVC, toPVC, c.opts.verifyImage())
+	jobName, err := c.cw.CreateJob(ctx, job.Namespace, job)
+	if err != nil {
+		return err
+	}
+
+	err = c.waitForJob(ctx, job.Namespace, jobName, fmt.Sprintf("[verify %s -> %s]", fromPVC, toPVC))
+	// the job is removed with the migration objects, so its diff goes into the error
+	var failed *JobFailedError
+	if errors.As(err, &failed) {
+		return errors.New(fmt.Sprintf("data in PVC %s does not match %s:\n%s", toPVC, fromPVC, strings.TrimSpace(failed.Logs)))
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Data in PVC %s matches %s\n", toPVC, fromPVC)
+	return ignoreNotFound(c.cw.deleteJob(ctx, job.Namespace, jobName))
+}
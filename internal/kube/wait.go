@@ -1,34 +1,79 @@
 package kube
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
-	"strings"
 	"time"
 
+	"github.com/samber/lo"
+	appsv1 "k8s.io/api/apps/v1"
 	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/wait"
 )
 
-func WaitFor(condition wait.ConditionFunc) error {
-	return wait.PollImmediateInfinite(time.Second, condition)
+// WaitFor polls condition every second until it is met, ctx is done or the timeout, if not zero, passes.
+func WaitFor(ctx context.Context, timeout time.Duration, condition wait.ConditionWithContextFunc) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	err := wait.PollImmediateUntilWithContext(ctx, time.Second, condition)
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) && timeout > 0 {
+		return errors.New(fmt.Sprintf("timed out after %s", timeout))
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+func (cw *ClientWrapper) IsPVCBound(namespace, pvcName string) wait.ConditionWithContextFunc {
+	return cw.isPVCBoundTo(namespace, pvcName, func(pv *corev1.PersistentVolume) bool {
+		return pv.Spec.PersistentVolumeSource.Local != nil
+	})
 }
 
-func (cw *ClientWrapper) IsPVCBound(namespace, pvcName string) wait.ConditionFunc {
-	return func() (bool, error) {
+func (cw *ClientWrapper) IsHostPathPVCBound(namespace, pvcName string) wait.ConditionWithContextFunc {
+	return cw.isPVCBoundTo(namespace, pvcName, func(pv *corev1.PersistentVolume) bool {
+		return pv.Spec.PersistentVolumeSource.HostPath != nil
+	})
+}
+
+// IsStorageClassPVCBound waits for the PVC to bind to a volume of storageClass.
+func (cw *ClientWrapper) IsStorageClassPVCBound(namespace, pvcName, storageClass string) wait.ConditionWithContextFunc {
+	return cw.isPVCBoundTo(namespace, pvcName, func(pv *corev1.PersistentVolume) bool {
+		return pv.Spec.StorageClassName == storageClass
+	})
+}
+
+// IsPVCBoundOutsideStorageClass waits for the PVC to bind to a volume of any other class than storageClass.
+func (cw *ClientWrapper) IsPVCBoundOutsideStorageClass(namespace, pvcName, storageClass string) wait.ConditionWithContextFunc {
+	return cw.isPVCBoundTo(namespace, pvcName, func(pv *corev1.PersistentVolume) bool {
+		return pv.Spec.StorageClassName != storageClass
+	})
+}
+
+func (cw *ClientWrapper) isPVCBoundTo(namespace, pvcName string, matches func(*corev1.PersistentVolume) bool) wait.ConditionWithContextFunc {
+	return func(ctx context.Context) (bool, error) {
 		fmt.Print(".")
 
-		pvc, err := cw.GetPVCByName(namespace, pvcName)
+		pvc, err := cw.GetPVCByName(ctx, namespace, pvcName)
 		if err != nil {
 			return false, nil
 		}
 
 		switch pvc.Status.Phase {
 		case corev1.ClaimBound:
-			pv, _ := cw.GetPVByName(pvc.Spec.VolumeName)
+			pv, err := cw.GetPVByName(ctx, pvc.Spec.VolumeName)
 			// TODO possibly recreate volume?
-			if pv.Spec.PersistentVolumeSource.Local == nil {
+			if err != nil || !matches(pv) {
 				return false, nil
 			}
 			log.Printf("\nNew PVC %s bound\n", pvcName)
@@ -39,39 +84,101 @@ func (cw *ClientWrapper) IsPVCBound(namespace, pvcName string) wait.ConditionFun
 	}
 }
 
-func (cw *ClientWrapper) IsPodReady(namespace, name string) wait.ConditionFunc {
-	return func() (bool, error) {
+func (cw *ClientWrapper) IsPVCDeleted(namespace, pvcName string) wait.ConditionWithContextFunc {
+	return func(ctx context.Context) (bool, error) {
 		fmt.Print(".")
 
-		pod, err := cw.GetPodByName(namespace, name)
-		if err != nil {
-			return false, nil
-		}
-
-		for _, cond := range pod.Status.Conditions {
-			if cond.Type == corev1.PodReady && cond.Status == "True" {
-				log.Printf("\n%s pod bound\n", pod.Name)
-				return true, nil
-			}
+		_, err := cw.GetPVCByName(ctx, namespace, pvcName)
+		if apierrors.IsNotFound(err) {
+			log.Printf("\nPVC %s gone\n", pvcName)
+			return true, nil
 		}
 
 		return false, nil
 	}
 }
 
-func (cw *ClientWrapper) IsJobFinished(namespace, name string) wait.ConditionFunc {
-	return func() (bool, error) {
+// IsPodReady waits for the rollout of the workload to finish, the same way "kubectl rollout status" does. Every
+// desired replica has to be updated and ready, terminating pods of an older ReplicaSet or revision do not count.
+func (cw *ClientWrapper) IsPodReady(w Workload) wait.ConditionWithContextFunc {
+	return func(ctx context.Context) (bool, error) {
 		fmt.Print(".")
 
-		job, err := cw.getJobByName(namespace, name)
+		status, err := cw.getRolloutStatus(ctx, w)
+		if err != nil || !status.done() {
+			return false, nil
+		}
+
+		log.Printf("\n%s ready with %d/%d replicas\n", w, status.ready, status.desired)
+		return true, nil
+	}
+}
+
+type rolloutStatus struct {
+	desired int32
+	// current counts the pods not terminating, of any revision
+	current  int32
+	updated  int32
+	ready    int32
+	observed bool
+}
+
+func (s rolloutStatus) done() bool {
+	return s.observed && s.updated >= s.desired && s.ready >= s.desired && s.current <= s.updated
+}
+
+func (cw *ClientWrapper) getRolloutStatus(ctx context.Context, w Workload) (rolloutStatus, error) {
+	switch w.Kind {
+	case StatefulSetKind:
+		sts, err := cw.cs.AppsV1().StatefulSets(w.Namespace).Get(ctx, w.Name, metav1.GetOptions{})
+		if err != nil {
+			return rolloutStatus{}, err
+		}
+		updated := sts.Status.UpdatedReplicas
+		if sts.Spec.UpdateStrategy.Type == appsv1.OnDeleteStatefulSetStrategyType || sts.Status.UpdateRevision == sts.Status.CurrentRevision {
+			// pods are only replaced by hand, or the rollout finished and the counts moved to current
+			updated = sts.Status.Replicas
+		}
+		return rolloutStatus{
+			desired:  lo.FromPtrOr(sts.Spec.Replicas, 1),
+			current:  sts.Status.Replicas,
+			updated:  updated,
+			ready:    sts.Status.ReadyReplicas,
+			observed: sts.Status.ObservedGeneration >= sts.Generation,
+		}, nil
+	default:
+		deployment, err := cw.cs.AppsV1().Deployments(w.Namespace).Get(ctx, w.Name, metav1.GetOptions{})
+		if err != nil {
+			return rolloutStatus{}, err
+		}
+		return rolloutStatus{
+			desired:  lo.FromPtrOr(deployment.Spec.Replicas, 1),
+			current:  deployment.Status.Replicas,
+			updated:  deployment.Status.UpdatedReplicas,
+			ready:    deployment.Status.ReadyReplicas,
+			observed: deployment.Status.ObservedGeneration >= deployment.Generation,
+		}, nil
+	}
+}
+
+// IsJobFinished waits for the job to complete. Progress is shown by the streamed job logs instead of dots.
+func (cw *ClientWrapper) IsJobFinished(namespace, name string) wait.ConditionWithContextFunc {
+	return func(ctx context.Context) (bool, error) {
+		job, err := cw.getJobByName(ctx, namespace, name)
 		if err != nil {
 			return false, nil
 		}
 
 		for _, cond := range job.Status.Conditions {
-			if cond.Type == batchv1.JobComplete && cond.Status == "True" {
+			if cond.Status != corev1.ConditionTrue {
+				continue
+			}
+			switch cond.Type {
+			case batchv1.JobComplete:
 				log.Printf("%s job complete\n", name)
 				return true, nil
+			case batchv1.JobFailed:
+				return false, cw.jobFailed(ctx, job, cond)
 			}
 		}
 
@@ -79,15 +186,15 @@ func (cw *ClientWrapper) IsJobFinished(namespace, name string) wait.ConditionFun
 	}
 }
 
-func (cw *ClientWrapper) isPodScaled(namespace, name string) wait.ConditionFunc {
-	return func() (bool, error) {
+func (cw *ClientWrapper) isPodScaled(w Workload) wait.ConditionWithContextFunc {
+	return func(ctx context.Context) (bool, error) {
 		fmt.Print(".")
 
-		_, err := cw.GetPodByName(namespace, name)
-		if err != nil && strings.Contains(err.Error(), "not ready yet") {
-			return true, nil
+		pods, err := cw.GetWorkloadPods(ctx, w)
+		if err != nil {
+			return false, nil
 		}
 
-		return false, nil
+		return len(pods) == 0, nil
 	}
 }
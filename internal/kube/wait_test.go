@@ -0,0 +1,135 @@
+package kube
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestIsPodReady(t *testing.T) {
+	replicas := int32(2)
+	deployment := func(generation int64, status appsv1.DeploymentStatus) *appsv1.Deployment {
+		return &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default", Generation: generation},
+			Spec:       appsv1.DeploymentSpec{Replicas: &replicas},
+			Status:     status,
+		}
+	}
+
+	tests := []struct {
+		name       string
+		deployment *appsv1.Deployment
+		expected   bool
+	}{
+		{
+			name:       "ready",
+			deployment: deployment(2, appsv1.DeploymentStatus{ObservedGeneration: 2, Replicas: 2, UpdatedReplicas: 2, ReadyReplicas: 2}),
+			expected:   true,
+		},
+		{
+			name:       "spec change not observed",
+			deployment: deployment(3, appsv1.DeploymentStatus{ObservedGeneration: 2, Replicas: 2, UpdatedReplicas: 2, ReadyReplicas: 2}),
+			expected:   false,
+		},
+		{
+			name:       "old replica set still running",
+			deployment: deployment(2, appsv1.DeploymentStatus{ObservedGeneration: 2, Replicas: 3, UpdatedReplicas: 2, ReadyReplicas: 3}),
+			expected:   false,
+		},
+		{
+			name:       "replica not ready",
+			deployment: deployment(2, appsv1.DeploymentStatus{ObservedGeneration: 2, Replicas: 2, UpdatedReplicas: 2, ReadyReplicas: 1}),
+			expected:   false,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cw := ClientWrapper{cs: fake.NewSimpleClientset(test.deployment)}
+
+			ready, err := cw.IsPodReady(Workload{Kind: DeploymentKind, Namespace: "default", Name: "app"})(context.Background())
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, ready)
+		})
+	}
+}
+
+func TestIsJobFinishedFailed(t *testing.T) {
+	cw := ClientWrapper{cs: fake.NewSimpleClientset(
+		&batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{Name: "pv-migrater-abcde", Namespace: migrationNamespace},
+			Status: batchv1.JobStatus{Conditions: []batchv1.JobCondition{
+				{Type: batchv1.JobFailed, Status: corev1.ConditionTrue, Reason: "BackoffLimitExceeded"},
+			}},
+		},
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Name:      "pv-migrater-abcde-x7k2p",
+			Namespace: migrationNamespace,
+			Labels:    map[string]string{"job-name": "pv-migrater-abcde"},
+		}},
+	)}
+
+	done, err := cw.IsJobFinished(migrationNamespace, "pv-migrater-abcde")(context.Background())
+	assert.False(t, done)
+
+	var failed *JobFailedError
+	require.ErrorAs(t, err, &failed)
+	assert.Equal(t, "BackoffLimitExceeded", failed.Reason)
+	assert.Contains(t, failed.Logs, "pv-migrater-abcde-x7k2p")
+}
+
+func TestStreamJobLogs(t *testing.T) {
+	cw := ClientWrapper{cs: fake.NewSimpleClientset(&corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "pv-migrater-abcde-x7k2p",
+			Namespace: migrationNamespace,
+			Labels:    map[string]string{"job-name": "pv-migrater-abcde"},
+		},
+		Status: corev1.PodStatus{Phase: corev1.PodRunning},
+	})}
+
+	var out strings.Builder
+	err := cw.StreamJobLogs(context.Background(), migrationNamespace, "pv-migrater-abcde", "[config -> config-temp]", &out)
+	require.NoError(t, err)
+	assert.Equal(t, "[config -> config-temp] fake logs\n", out.String())
+}
+
+func TestRolloutTimeout(t *testing.T) {
+	ctx := context.Background()
+	w := Workload{Kind: DeploymentKind, Namespace: "default", Name: "app"}
+
+	// the pod of the deployment never terminates
+	cluster := newFakeCluster(t, 1, nil, &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app-abcde", Namespace: "default", Labels: map[string]string{"app": "app"}},
+	})
+	cluster.cw.SetRolloutTimeout(time.Second)
+	err := cluster.cw.ScaleWorkload(ctx, w, 0)
+	require.EqualError(t, err, "timed out after 1s")
+
+	// the new replica never becomes ready
+	cw := ClientWrapper{cs: fake.NewSimpleClientset(&appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Status:     appsv1.DeploymentStatus{Replicas: 1, UpdatedReplicas: 1},
+	}), rolloutTimeout: time.Second}
+	err = cw.waitForRollout(ctx, w)
+	require.EqualError(t, err, "timed out after 1s")
+
+	// a finalizer keeps the StatefulSet
+	cs := fake.NewSimpleClientset(&appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"}})
+	cs.PrependReactor("delete", "statefulsets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, nil
+	})
+	cw = ClientWrapper{cs: cs, rolloutTimeout: time.Second}
+	err = cw.OrphanDeleteStatefulSet(ctx, "default", "app")
+	require.EqualError(t, err, "timed out after 1s")
+}
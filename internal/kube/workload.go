@@ -0,0 +1,389 @@
+package kube
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/samber/lo"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	DeploymentKind  = "Deployment"
+	StatefulSetKind = "StatefulSet"
+)
+
+// Workload is the controller whose pods mount a PVC.
+type Workload struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	// VolumeClaimTemplate is the template of a StatefulSet the PVC was created from, empty when the PVC is
+	// declared in the persistence values instead.
+	VolumeClaimTemplate string `json:"volumeClaimTemplate,omitempty"`
+}
+
+func (w Workload) String() string {
+	return fmt.Sprintf("%s %s/%s", strings.ToLower(w.Kind), w.Namespace, w.Name)
+}
+
+func (w Workload) section() valuesSection {
+	if w.VolumeClaimTemplate != "" {
+		return volumeClaimTemplatesSection
+	}
+	return persistenceSection
+}
+
+// valuesKey is the key of the values entry declaring pvcName.
+func (w Workload) valuesKey(pvcName string) string {
+	if w.VolumeClaimTemplate != "" {
+		return w.VolumeClaimTemplate
+	}
+	return persistenceKey(pvcName)
+}
+
+// resource is the API resource of the workload.
+func (w Workload) resource() string {
+	if w.Kind == StatefulSetKind {
+		return "statefulsets"
+	}
+	return "deployments"
+}
+
+// claimSuffix is the part the StatefulSet appends to the template name to name the PVC of a pod.
+func (w Workload) claimSuffix(pvcName string) string {
+	return strings.TrimPrefix(pvcName, w.VolumeClaimTemplate)
+}
+
+// workloadSpec is a workload with the parts of its spec deciding which PVCs and pods are its own.
+type workloadSpec struct {
+	Workload
+	meta           metav1.ObjectMeta
+	template       corev1.PodTemplateSpec
+	claimTemplates []corev1.PersistentVolumeClaim
+}
+
+func (cw *ClientWrapper) listWorkloads(ctx context.Context, namespace string) ([]workloadSpec, error) {
+	statefulSets, err := cw.cs.AppsV1().StatefulSets(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	deployments, err := cw.cs.AppsV1().Deployments(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	workloads := lo.Map(statefulSets.Items, func(sts appsv1.StatefulSet, _ int) workloadSpec {
+		return workloadSpec{
+			Workload:       Workload{Kind: StatefulSetKind, Namespace: namespace, Name: sts.Name},
+			meta:           sts.ObjectMeta,
+			template:       sts.Spec.Template,
+			claimTemplates: sts.Spec.VolumeClaimTemplates,
+		}
+	})
+	return append(workloads, lo.Map(deployments.Items, func(deployment appsv1.Deployment, _ int) workloadSpec {
+		return workloadSpec{
+			Workload: Workload{Kind: DeploymentKind, Namespace: namespace, Name: deployment.Name},
+			meta:     deployment.ObjectMeta,
+			template: deployment.Spec.Template,
+		}
+	})...), nil
+}
+
+func (cw *ClientWrapper) getResourceWorkloads(ctx context.Context, namespace, resourceName string) ([]workloadSpec, error) {
+	belongs, err := cw.resourceMatcher(resourceName)
+	if err != nil {
+		return nil, err
+	}
+
+	workloads, err := cw.listWorkloads(ctx, namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	return lo.Filter(workloads, func(w workloadSpec, _ int) bool {
+		return belongs(w.meta)
+	}), nil
+}
+
+// claimTemplate returns the volume claim template of the StatefulSet pvcName was created from, if any.
+func claimTemplate(stsName string, templates []corev1.PersistentVolumeClaim, pvcName string) string {
+	for _, template := range templates {
+		ordinal, found := strings.CutPrefix(pvcName, fmt.Sprintf("%s-%s-", template.Name, stsName))
+		if _, err := strconv.Atoi(ordinal); found && err == nil {
+			return template.Name
+		}
+	}
+	return ""
+}
+
+// GetPVCWorkload finds the Deployment or StatefulSet mounting pvcName. Falls back to the only workload of the
+// resource, or a Deployment named after the resource as rendered by app-template.
+func (cw *ClientWrapper) GetPVCWorkload(ctx context.Context, namespace, pvcName, resourceName string) (Workload, error) {
+	workload, found, err := cw.findPVCWorkload(ctx, namespace, pvcName)
+	if err != nil || found {
+		return workload, err
+	}
+
+	workloads, err := cw.getResourceWorkloads(ctx, namespace, resourceName)
+	if err != nil {
+		return Workload{}, err
+	}
+	if len(workloads) == 1 {
+		return workloads[0].Workload, nil
+	}
+
+	return Workload{Kind: DeploymentKind, Namespace: namespace, Name: resourceName}, nil
+}
+
+// findPVCWorkload walks from the pods mounting pvcName up their owner references. Workloads scaled to zero have no
+// pods, so their volume claim templates and pod templates are searched next.
+func (cw *ClientWrapper) findPVCWorkload(ctx context.Context, namespace, pvcName string) (Workload, bool, error) {
+	workloads, err := cw.listWorkloads(ctx, namespace)
+	if err != nil {
+		return Workload{}, false, err
+	}
+
+	pods, err := cw.cs.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return Workload{}, false, err
+	}
+
+	for _, pod := range pods.Items {
+		if !mountsClaim(pod.Spec, pvcName) {
+			continue
+		}
+
+		owner, found, err := cw.getPodWorkload(ctx, pod)
+		if err != nil {
+			return Workload{}, false, err
+		}
+		if w, ok := lo.Find(workloads, func(w workloadSpec) bool { return found && w.Workload == owner }); ok {
+			w.VolumeClaimTemplate = claimTemplate(w.Name, w.claimTemplates, pvcName)
+			return w.Workload, true, nil
+		}
+	}
+
+	for _, w := range workloads {
+		if template := claimTemplate(w.Name, w.claimTemplates, pvcName); template != "" {
+			w.VolumeClaimTemplate = template
+			return w.Workload, true, nil
+		}
+	}
+
+	for _, w := range workloads {
+		if mountsClaim(w.template.Spec, pvcName) {
+			return w.Workload, true, nil
+		}
+	}
+
+	return Workload{}, false, nil
+}
+
+// getPodWorkload follows the controller owner references of a pod, through its ReplicaSet for a Deployment.
+func (cw *ClientWrapper) getPodWorkload(ctx context.Context, pod corev1.Pod) (Workload, bool, error) {
+	owner := metav1.GetControllerOf(&pod)
+	if owner == nil {
+		return Workload{}, false, nil
+	}
+
+	switch owner.Kind {
+	case StatefulSetKind:
+		return Workload{Kind: StatefulSetKind, Namespace: pod.Namespace, Name: owner.Name}, true, nil
+	case "ReplicaSet":
+		rs, err := cw.cs.AppsV1().ReplicaSets(pod.Namespace).Get(ctx, owner.Name, metav1.GetOptions{})
+		if err != nil {
+			return Workload{}, false, ignoreNotFound(err)
+		}
+		if owner := metav1.GetControllerOf(rs); owner != nil && owner.Kind == DeploymentKind {
+			return Workload{Kind: DeploymentKind, Namespace: pod.Namespace, Name: owner.Name}, true, nil
+		}
+	}
+
+	return Workload{}, false, nil
+}
+
+// GetWorkloadPods returns the pods matched by the selector of the workload.
+func (cw *ClientWrapper) GetWorkloadPods(ctx context.Context, w Workload) ([]corev1.Pod, error) {
+	var labelSelector *metav1.LabelSelector
+	switch w.Kind {
+	case StatefulSetKind:
+		sts, err := cw.cs.AppsV1().StatefulSets(w.Namespace).Get(ctx, w.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		labelSelector = sts.Spec.Selector
+	default:
+		deployment, err := cw.cs.AppsV1().Deployments(w.Namespace).Get(ctx, w.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		labelSelector = deployment.Spec.Selector
+	}
+
+	selector, err := metav1.LabelSelectorAsSelector(labelSelector)
+	if err != nil {
+		return nil, err
+	}
+
+	pods, err := cw.cs.CoreV1().Pods(w.Namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, err
+	}
+
+	return pods.Items, nil
+}
+
+// GetWorkloadPod returns a ready pod of the workload, ignoring pods being terminated.
+func (cw *ClientWrapper) GetWorkloadPod(ctx context.Context, w Workload) (corev1.Pod, error) {
+	pods, err := cw.GetWorkloadPods(ctx, w)
+	if err != nil {
+		return corev1.Pod{}, err
+	}
+
+	pod, found := lo.Find(pods, func(pod corev1.Pod) bool {
+		return pod.DeletionTimestamp == nil && lo.SomeBy(pod.Status.Conditions, func(cond corev1.PodCondition) bool {
+			return cond.Type == corev1.PodReady && cond.Status == corev1.ConditionTrue
+		})
+	})
+	if !found {
+		return corev1.Pod{}, errors.New(fmt.Sprintf("pod of %s not ready yet", w))
+	}
+
+	return pod, nil
+}
+
+// GetPVCConsumer finds the workload of a PVC not declared by a chart. Pods mounting the PVC without a Deployment
+// or StatefulSet that could scale them down are an error, a PVC not mounted at all has no workload.
+func (cw *ClientWrapper) GetPVCConsumer(ctx context.Context, namespace, pvcName string) (Workload, error) {
+	workload, found, err := cw.findPVCWorkload(ctx, namespace, pvcName)
+	if err != nil || found {
+		return workload, err
+	}
+
+	pods, err := cw.cs.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return Workload{}, err
+	}
+
+	for _, pod := range pods.Items {
+		if mountsClaim(pod.Spec, pvcName) {
+			return Workload{}, errors.New(fmt.Sprintf("PVC %s is mounted by pod %s which is not managed by a Deployment or StatefulSet", pvcName, pod.Name))
+		}
+	}
+
+	return Workload{}, nil
+}
+
+func mountsClaim(spec corev1.PodSpec, pvcName string) bool {
+	for _, volume := range spec.Volumes {
+		if volume.PersistentVolumeClaim != nil && volume.PersistentVolumeClaim.ClaimName == pvcName {
+			return true
+		}
+	}
+	return false
+}
+
+func (cw *ClientWrapper) GetWorkloadReplicas(ctx context.Context, w Workload) (int32, error) {
+	switch w.Kind {
+	case StatefulSetKind:
+		scale, err := cw.cs.AppsV1().StatefulSets(w.Namespace).GetScale(ctx, w.Name, metav1.GetOptions{})
+		if err != nil {
+			return 0, err
+		}
+		return scale.Spec.Replicas, nil
+	default:
+		scale, err := cw.cs.AppsV1().Deployments(w.Namespace).GetScale(ctx, w.Name, metav1.GetOptions{})
+		if err != nil {
+			return 0, err
+		}
+		return scale.Spec.Replicas, nil
+	}
+}
+
+// ScaleWorkload scales the workload through its scale subresource and waits for the pods to follow.
+func (cw *ClientWrapper) ScaleWorkload(ctx context.Context, w Workload, replicas int) error {
+	err := cw.updateWorkloadScale(ctx, w, int32(replicas), metav1.UpdateOptions{})
+	if err != nil {
+		return err
+	}
+
+	if replicas == 0 {
+		err = WaitFor(ctx, cw.rolloutTimeout, cw.isPodScaled(w))
+	} else {
+		err = cw.waitForRollout(ctx, w)
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("%s finished scaling\n", w)
+	return nil
+}
+
+// waitForRollout waits for the rollout of the workload to finish, at most the rollout timeout.
+func (cw *ClientWrapper) waitForRollout(ctx context.Context, w Workload) error {
+	return WaitFor(ctx, cw.rolloutTimeout, cw.IsPodReady(w))
+}
+
+func (cw *ClientWrapper) updateWorkloadScale(ctx context.Context, w Workload, replicas int32, opts metav1.UpdateOptions) error {
+	switch w.Kind {
+	case StatefulSetKind:
+		statefulSets := cw.cs.AppsV1().StatefulSets(w.Namespace)
+		s, err := statefulSets.GetScale(ctx, w.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		scale := *s
+		scale.Spec.Replicas = replicas
+
+		_, err = statefulSets.UpdateScale(ctx, w.Name, &scale, opts)
+		return err
+	case DeploymentKind:
+		deployments := cw.cs.AppsV1().Deployments(w.Namespace)
+		s, err := deployments.GetScale(ctx, w.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		scale := *s
+		scale.Spec.Replicas = replicas
+
+		_, err = deployments.UpdateScale(ctx, w.Name, &scale, opts)
+		return err
+	default:
+		return errors.New(fmt.Sprintf("unsupported workload kind %s", w.Kind))
+	}
+}
+
+// OrphanDeleteStatefulSet deletes the StatefulSet while keeping its pods and PVCs, and waits until it is gone.
+func (cw *ClientWrapper) OrphanDeleteStatefulSet(ctx context.Context, namespace, name string) error {
+	orphan := metav1.DeletePropagationOrphan
+	err := cw.cs.AppsV1().StatefulSets(namespace).Delete(ctx, name, metav1.DeleteOptions{PropagationPolicy: &orphan})
+	if err != nil {
+		return ignoreNotFound(err)
+	}
+
+	err = WaitFor(ctx, cw.rolloutTimeout, cw.isStatefulSetDeleted(namespace, name))
+	if err != nil {
+		return err
+	}
+
+	log.Printf("statefulset %s deleted, pods orphaned\n", name)
+	return nil
+}
+
+func (cw *ClientWrapper) isStatefulSetDeleted(namespace, name string) wait.ConditionWithContextFunc {
+	return func(ctx context.Context) (bool, error) {
+		_, err := cw.cs.AppsV1().StatefulSets(namespace).Get(ctx, name, metav1.GetOptions{})
+		return apierrors.IsNotFound(err), nil
+	}
+}
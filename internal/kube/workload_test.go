@@ -0,0 +1,133 @@
+package kube
+
+import (
+	"context"
+	"testing"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestGetPVCWorkload(t *testing.T) {
+	podSpec := func(claimName string) corev1.PodTemplateSpec {
+		return corev1.PodTemplateSpec{Spec: corev1.PodSpec{Volumes: []corev1.Volume{{
+			Name:         "data",
+			VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: claimName}},
+		}}}}
+	}
+
+	cw := ClientWrapper{cs: fake.NewSimpleClientset(
+		&appsv1.StatefulSet{
+			ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default"},
+			Spec: appsv1.StatefulSetSpec{
+				VolumeClaimTemplates: []corev1.PersistentVolumeClaim{{ObjectMeta: metav1.ObjectMeta{Name: "data"}}},
+				Template:             podSpec("db-config"),
+			},
+		},
+		&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+			Spec:       appsv1.DeploymentSpec{Template: podSpec("web-config")},
+		},
+	)}
+
+	tests := []struct {
+		pvcName  string
+		expected Workload
+	}{
+		{
+			pvcName:  "data-db-0",
+			expected: Workload{Kind: StatefulSetKind, Namespace: "default", Name: "db", VolumeClaimTemplate: "data"},
+		},
+		{
+			pvcName:  "db-config",
+			expected: Workload{Kind: StatefulSetKind, Namespace: "default", Name: "db"},
+		},
+		{
+			pvcName:  "web-config",
+			expected: Workload{Kind: DeploymentKind, Namespace: "default", Name: "web"},
+		},
+		{
+			pvcName:  "app-config",
+			expected: Workload{Kind: DeploymentKind, Namespace: "default", Name: "app"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.pvcName, func(t *testing.T) {
+			workload, err := cw.GetPVCWorkload(context.Background(), "default", test.pvcName, "app")
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, workload)
+		})
+	}
+
+	c := newConversion(cw, ConvertOptions{}, HelmReleasePatcher{}, "default", "app", tests[0].expected, "data-db-0", "default", "1Gi")
+	assert.Equal(t, "data", c.volumeName)
+	assert.Equal(t, "data-temp-db-0", c.tempPVCName)
+}
+
+func TestGetPVCConsumer(t *testing.T) {
+	cw := ClientWrapper{cs: fake.NewSimpleClientset(
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "bare", Namespace: "default"},
+			Spec: corev1.PodSpec{Volumes: []corev1.Volume{{
+				Name:         "data",
+				VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "bare-data"}},
+			}}},
+		},
+	)}
+
+	_, err := cw.GetPVCConsumer(context.Background(), "default", "bare-data")
+	assert.Error(t, err)
+
+	workload, err := cw.GetPVCConsumer(context.Background(), "default", "unmounted")
+	require.NoError(t, err)
+	assert.Equal(t, Workload{}, workload)
+}
+
+func TestGetPVCWorkloadOwnerReferences(t *testing.T) {
+	controller := true
+	cw := ClientWrapper{cs: fake.NewSimpleClientset(
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "server", Namespace: "default"}},
+		&appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{
+			Name:            "server-5d8f",
+			Namespace:       "default",
+			OwnerReferences: []metav1.OwnerReference{{Kind: DeploymentKind, Name: "server", Controller: &controller}},
+		}},
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            "server-5d8f-x2x7q",
+				Namespace:       "default",
+				OwnerReferences: []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "server-5d8f", Controller: &controller}},
+			},
+			Spec: corev1.PodSpec{Volumes: []corev1.Volume{{
+				Name:         "data",
+				VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "media"}},
+			}}},
+		},
+	)}
+
+	workload, err := cw.GetPVCWorkload(context.Background(), "default", "media", "app")
+	require.NoError(t, err)
+	assert.Equal(t, Workload{Kind: DeploymentKind, Namespace: "default", Name: "server"}, workload)
+}
+
+func TestGetPVCsByResourceNameSelector(t *testing.T) {
+	cw := ClientWrapper{cs: fake.NewSimpleClientset(
+		&corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "app-config", Namespace: "default", Labels: map[string]string{"app": "app"}}},
+		&corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "app-media", Namespace: "default", Annotations: map[string]string{"meta.helm.sh/release-name": "app"}}},
+		&corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "default"}},
+	)}
+
+	pvcs, err := cw.GetPVCsByResourceName(context.Background(), "default", "app")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"app-media"}, lo.Map(pvcs, func(pvc corev1.PersistentVolumeClaim, _ int) string { return pvc.Name }))
+
+	require.NoError(t, cw.SetSelector("app={resource}"))
+	pvcs, err = cw.GetPVCsByResourceName(context.Background(), "default", "app")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"app-config"}, lo.Map(pvcs, func(pvc corev1.PersistentVolumeClaim, _ int) string { return pvc.Name }))
+}
@@ -1,14 +1,19 @@
 package prompt
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/AlecAivazis/survey/v2"
 	"github.com/AnthonyEnr1quez/local-path-provisioner-volume-converter/internal/kube"
 	"github.com/samber/lo"
 	corev1 "k8s.io/api/core/v1"
-	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 )
 
@@ -22,47 +27,98 @@ func askOne(msg string, options []string, description func(value string, index i
 	return
 }
 
-func Survey(cw kube.ClientWrapper) (resourceNamespace, resourceName string, volume *corev1.PersistentVolume, patcher kube.Patcher, err error) {
-	resourceNamespace, resources, err := selectNamespace(&cw)
-	if err != nil {
-		return
+// selectAll is offered first by askMany and stands for every option.
+const selectAll = "(all)"
+
+// askMany asks for any number of options. MultiSelect has no descriptions, so they are appended to the options.
+func askMany(msg string, options []string, description func(value string, index int) string) (answers []string, err error) {
+	labels := []string{fmt.Sprintf("%s - all %d", selectAll, len(options))}
+	optionsByLabel := map[string]string{}
+	for i, option := range options {
+		label := option
+		if description != nil {
+			label = fmt.Sprintf("%s - %s", option, description(option, i))
+		}
+		labels = append(labels, label)
+		optionsByLabel[label] = option
+	}
+
+	prompt := &survey.MultiSelect{
+		Message: msg,
+		Options: labels,
 	}
+	var selected []string
+	err = survey.AskOne(prompt, &selected, survey.WithValidator(survey.Required))
+	if lo.Contains(selected, labels[0]) {
+		return options, err
+	}
+
+	answers = lo.Map(selected, func(label string, _ int) string {
+		return optionsByLabel[label]
+	})
+	return
+}
 
-	resourceName, volumes, patcher, err := selectResource(&cw, resources)
+// SurveyOne selects a single volume the way SurveyMany does, without confirming it. Selecting more than one volume is
+// an error.
+func SurveyOne(ctx context.Context, cw kube.ClientWrapper) (resource kube.ResourceVolumes, volume *corev1.PersistentVolume, err error) {
+	selected, err := selectResourceVolumes(ctx, &cw)
 	if err != nil {
 		return
 	}
 
-	volume, err = selectVolume(volumes)
+	if len(selected) != 1 || len(selected[0].Volumes) != 1 {
+		err = errors.New("Select a single volume")
+		return
+	}
 
+	resource, volume = selected[0], selected[0].Volumes[0]
 	return
 }
 
-func selectNamespace(cw *kube.ClientWrapper) (string, []unstructured.Unstructured, error) {
-	namespaces, err := cw.GetNamespaces()
+// SurveyMany selects any number of resources of a namespace and volumes of each, and confirms converting them with
+// opts after summarizing the impact. Declining the confirmation is an error.
+func SurveyMany(ctx context.Context, cw kube.ClientWrapper, opts kube.ConvertOptions) ([]kube.ResourceVolumes, error) {
+	selected, err := selectResourceVolumes(ctx, &cw)
 	if err != nil {
-		return "", nil, err
+		return nil, err
 	}
 
-	resourcesByNamespace := lo.Associate(namespaces, func(n corev1.Namespace) (string, []unstructured.Unstructured) {
-		helmReleases, err := cw.GetResourceList(n.Name, kube.FluxHelmReleaseResource)
-		if err != nil && !apierrors.IsNotFound(err) {
-			return "", nil
-		}
-		helmCharts, err := cw.GetResourceList(n.Name, kube.HelmChartResource)
-		if err != nil && !apierrors.IsNotFound(err) {
-			return "", nil
-		}
+	err = confirm(ctx, &cw, selected, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return selected, nil
+}
 
-		helmCharts = append(helmCharts, helmReleases...)
-		if len(helmCharts) == 0 {
-			return "", nil
+// selectResourceVolumes selects a namespace, any number of its resources and volumes of each.
+func selectResourceVolumes(ctx context.Context, cw *kube.ClientWrapper) ([]kube.ResourceVolumes, error) {
+	_, resources, err := selectNamespace(ctx, cw)
+	if err != nil {
+		return nil, err
+	}
+
+	selected, err := selectResources(ctx, cw, resources)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range selected {
+		selected[i].Volumes, err = selectVolumes(selected[i], len(selected) > 1)
+		if err != nil {
+			return nil, err
 		}
+	}
 
-		return n.Name, helmCharts
-	})
+	return selected, nil
+}
 
-	filteredResources := lo.OmitByKeys(resourcesByNamespace, []string{""})
+func selectNamespace(ctx context.Context, cw *kube.ClientWrapper) (string, []unstructured.Unstructured, error) {
+	filteredResources, err := cw.GetResourcesByNamespace(ctx)
+	if err != nil {
+		return "", nil, err
+	}
 	if len(filteredResources) == 0 {
 		return "", nil, errors.New("No namespaces that have supported resources")
 	}
@@ -79,71 +135,107 @@ func selectNamespace(cw *kube.ClientWrapper) (string, []unstructured.Unstructure
 	return resourceNamespace, filteredResources[resourceNamespace], err
 }
 
-func selectResource(cw *kube.ClientWrapper, resources []unstructured.Unstructured) (string, []*corev1.PersistentVolume, kube.Patcher, error) {
-	pvsByResourceName := lo.Associate(resources, func(resource unstructured.Unstructured) (string, lo.Tuple2[[]*corev1.PersistentVolume, kube.Patcher]) {
-		name, found, err := unstructured.NestedString(resource.UnstructuredContent(), "metadata", "name")
-		if err != nil || !found {
-			return "", lo.T2[[]*corev1.PersistentVolume, kube.Patcher](nil, nil)
-		}
-
-		patcher, err := kube.NewPatcher(resource.GetKind())
-		if err != nil {
-			return "", lo.T2[[]*corev1.PersistentVolume, kube.Patcher](nil, nil)
-		}
-
-		namespace, found, err := unstructured.NestedString(resource.UnstructuredContent(), patcher.GetNamespacePath()...)
-		if err != nil || !found {
-			return "", lo.T2[[]*corev1.PersistentVolume, kube.Patcher](nil, nil)
-		}
-
-		pvcs, err := cw.GetPVCsByResourceName(namespace, name)
-		if err != nil {
-			return "", lo.T2[[]*corev1.PersistentVolume, kube.Patcher](nil, nil)
-		}
-
-		volumesToUpdate := lo.FilterMap(pvcs, func(pvc corev1.PersistentVolumeClaim, _ int) (*corev1.PersistentVolume, bool) {
-			pv, err := cw.GetPVByName(pvc.Spec.VolumeName)
-			if err != nil {
-				return nil, false
-			}
-
-			if pv.Spec.PersistentVolumeSource.HostPath != nil {
-				return pv, true
-			}
-
-			return nil, false
-		})
-
-		if len(volumesToUpdate) == 0 {
-			return "", lo.T2[[]*corev1.PersistentVolume, kube.Patcher](nil, nil)
-		}
-
-		return name, lo.T2(volumesToUpdate, patcher)
-	})
-
-	filteredPVs := lo.OmitByKeys(pvsByResourceName, []string{""})
+func selectResources(ctx context.Context, cw *kube.ClientWrapper, resources []unstructured.Unstructured) ([]kube.ResourceVolumes, error) {
+	filteredPVs := cw.GetHostPathVolumesByResource(ctx, resources)
 	if len(filteredPVs) == 0 {
-		return "", nil, nil, errors.New("No resources that have host path volumes")
+		return nil, errors.New("No resources that have host path volumes")
+	}
+	if len(filteredPVs) == 1 {
+		return lo.Values(filteredPVs), nil
 	}
 
-	selectedResourceName, err := askOne(
-		"Select Resource",
-		lo.Keys(filteredPVs),
+	names := lo.Keys(filteredPVs)
+	sort.Strings(names)
+	selectedNames, err := askMany(
+		"Select Resources",
+		names,
 		func(value string, _ int) string {
-			count := len(filteredPVs[value].A)
+			count := len(filteredPVs[value].Volumes)
 			return fmt.Sprintf("%d host path volumes", count)
 		},
 	)
 
-	return selectedResourceName, filteredPVs[selectedResourceName].A, filteredPVs[selectedResourceName].B, err
+	return lo.Map(selectedNames, func(name string, _ int) kube.ResourceVolumes {
+		return filteredPVs[name]
+	}), err
 }
 
-func selectVolume(volumes []*corev1.PersistentVolume) (*corev1.PersistentVolume, error) {
-	volsByPVCName := lo.Associate(volumes, func(v *corev1.PersistentVolume) (string, *corev1.PersistentVolume) {
+func selectVolumes(resource kube.ResourceVolumes, showResource bool) ([]*corev1.PersistentVolume, error) {
+	if len(resource.Volumes) == 1 {
+		return resource.Volumes, nil
+	}
+
+	volsByPVCName := lo.Associate(resource.Volumes, func(v *corev1.PersistentVolume) (string, *corev1.PersistentVolume) {
 		return v.Spec.ClaimRef.Name, v
 	})
+	names := lo.Keys(volsByPVCName)
+	sort.Strings(names)
 
-	selectedVolumeName, err := askOne("Select Volume", lo.Keys(volsByPVCName), nil)
+	msg := "Select Volumes"
+	if showResource {
+		msg = fmt.Sprintf("Select Volumes of %s", resource.Name)
+	}
+	selectedNames, err := askMany(msg, names, func(value string, _ int) string {
+		return volsByPVCName[value].Spec.Capacity.Storage().String()
+	})
+
+	return lo.Map(selectedNames, func(name string, _ int) *corev1.PersistentVolume {
+		return volsByPVCName[name]
+	}), err
+}
+
+// confirm lists every selected volume with the PV and node holding its data, the workload and pods the conversion
+// restarts and an estimate of the downtime of each workload, and asks whether to go ahead.
+func confirm(ctx context.Context, cw *kube.ClientWrapper, selected []kube.ResourceVolumes, opts kube.ConvertOptions) error {
+	var sb strings.Builder
+	w := tabwriter.NewWriter(&sb, 0, 0, 2, ' ', 0)
+	var workloads []string
+	impactsByWorkload := map[string][]kube.VolumeImpact{}
+	for _, r := range selected {
+		for _, v := range r.Volumes {
+			impact, err := cw.GetVolumeImpact(ctx, r.Name, v)
+			if err != nil {
+				return err
+			}
+			impact.UsedBytes = cw.GetUsedBytes(ctx, impact)
+
+			used := "unknown, estimated with the capacity"
+			if impact.UsedBytes != nil {
+				used = resource.NewQuantity(int64(*impact.UsedBytes), resource.BinarySI).String()
+			}
+			fmt.Fprintf(w, "PVC %s/%s of %s %s\n", impact.PVCNamespace, impact.PVC, r.Kind, r.Name)
+			fmt.Fprintf(w, "  PV\t%s\n", impact.PV)
+			fmt.Fprintf(w, "  Host path\t%s\n", impact.HostPath)
+			fmt.Fprintf(w, "  Node\t%s\n", lo.Ternary(impact.Node == "", "not pinned", impact.Node))
+			fmt.Fprintf(w, "  Capacity\t%s\n", impact.Capacity.String())
+			fmt.Fprintf(w, "  Used\t%s\n", used)
+			fmt.Fprintf(w, "  Workload\t%s, %d replicas\n", impact.Workload, impact.Replicas)
+			fmt.Fprintf(w, "  Restarted pods\t%s\n\n", lo.Ternary(len(impact.Pods) == 0, "none", strings.Join(impact.Pods, ", ")))
+
+			// the volumes of one workload are converted together
+			key := fmt.Sprintf("%s of %s %s", impact.Workload, r.Kind, r.Name)
+			if _, found := impactsByWorkload[key]; !found {
+				workloads = append(workloads, key)
+			}
+			impactsByWorkload[key] = append(impactsByWorkload[key], impact)
+		}
+	}
+	for _, key := range workloads {
+		fmt.Fprintf(w, "Estimated downtime of %s: about %s\n", key, kube.EstimateDowntime(impactsByWorkload[key], opts).Round(time.Second))
+	}
+	err := w.Flush()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("\n%s\n", sb.String())
 
-	return volsByPVCName[selectedVolumeName], err
+	convert := false
+	err = survey.AskOne(&survey.Confirm{Message: "Convert these volumes?"}, &convert)
+	if err != nil {
+		return err
+	}
+	if !convert {
+		return errors.New("Conversion cancelled")
+	}
+	return nil
 }
@@ -1,42 +1,11 @@
 package main
 
 import (
-	"log"
+	"os"
 
-	"github.com/AlecAivazis/survey/v2/terminal"
-	"github.com/AnthonyEnr1quez/local-path-provisioner-volume-converter/internal/kube"
-	"github.com/AnthonyEnr1quez/local-path-provisioner-volume-converter/internal/prompt"
+	"github.com/AnthonyEnr1quez/local-path-provisioner-volume-converter/internal/cmd"
 )
 
 func main() {
-	log.Print("Use \"Ctrl+C\" to quit\n\n")
-
-	config, err := kube.GetKubeconfig()
-	if err != nil {
-		log.Fatalln(err.Error())
-	}
-
-	cw := kube.GetClientWrapper(config)
-
-	err = cw.CreateMigrationNamespaceAndServiceAccount()
-	if err != nil {
-		log.Fatalln(err.Error())
-	}
-	defer cw.CleanupMigrationObjects()
-
-	for {
-		resourceNamespace, resourceName, volume, patcher, err := prompt.Survey(cw)
-		if err != nil {
-			log.Println(err.Error())
-			if err == terminal.InterruptErr {
-				break
-			}
-			continue
-		}
-
-		err = kube.ConvertVolume(cw, resourceNamespace, resourceName, volume, patcher)
-		if err != nil {
-			log.Fatalln(err.Error())
-		}
-	}
+	os.Exit(cmd.Run(os.Args[1:]))
 }